@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/google/uuid"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/spf13/cobra"
+)
+
+// Remote context name used by the daemon for build contexts uploaded in a separate request
+const uploadRequestRemote = "upload-request"
+
+func addBuildFlags(cmd *cobra.Command, buildOptions *BuildOptions) {
+	cmd.PersistentFlags().StringArrayVar(&buildOptions.buildArgs, "build-arg", []string{}, "Set build-time variables (KEY=VALUE)")
+	cmd.PersistentFlags().StringVar(&buildOptions.target, "target", "", "Set the target build stage to build")
+	cmd.PersistentFlags().StringVar(&buildOptions.platform, "platform", "", "Set platform if server is multi-platform capable")
+	cmd.PersistentFlags().BoolVar(&buildOptions.buildKit, "buildkit", os.Getenv("DOCKER_BUILDKIT") == "1", "Build the dockbox using BuildKit")
+	cmd.PersistentFlags().StringArrayVar(&buildOptions.secrets, "secret", []string{}, "Secret file to expose to the build (only if BuildKit enabled): id=mysecret,src=/local/secret")
+}
+
+// dockboxLabels returns the labels used to identify an image built by dockbox
+// and where it came from
+func dockboxLabels(name string, source string, dirPath string, language string) map[string]string {
+	labels := map[string]string{
+		LABEL_NAME:    name,
+		LABEL_SOURCE:  source,
+		LABEL_PATH:    dirPath,
+		LABEL_VERSION: Version,
+	}
+	if abs, err := filepath.Abs(dirPath); err == nil {
+		labels[LABEL_PATH] = abs
+	}
+	if commit := getGitCommit(dirPath); commit != "" {
+		labels[LABEL_COMMIT] = commit
+	}
+	if language != "" {
+		labels[LABEL_LANGUAGE] = language
+	}
+	return labels
+}
+
+// getGitCommit returns the commit checked out at dirPath, or an empty string
+// if dirPath is not a git repository
+func getGitCommit(dirPath string) string {
+	out, err := exec.Command("git", "-C", dirPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func buildImage(cli dockerClient, dirPath string, dockerFileName string, dockboxName string, labels map[string]string, buildOptions BuildOptions) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tar, err := archive.TarWithOptions(dirPath, &archive.TarOptions{})
+	if err != nil {
+		return "", err
+	}
+	imageName := dockboxNameToImageName(dockboxName)
+	opts := types.ImageBuildOptions{
+		Dockerfile: dockerFileName,
+		Tags:       []string{imageName},
+		Remove:     true,
+		Labels:     labels,
+		BuildArgs:  parseBuildArgs(buildOptions.buildArgs),
+		Target:     buildOptions.target,
+		Platform:   buildOptions.platform,
+	}
+
+	if len(buildOptions.secrets) > 0 && !buildOptions.buildKit {
+		log.Println("Secrets require BuildKit, enabling BuildKit for this build")
+		buildOptions.buildKit = true
+	}
+
+	if buildOptions.buildKit {
+		err = buildImageWithBuildKit(ctx, cli, tar, opts, dockboxName, buildOptions.secrets)
+	} else {
+		err = buildImageWithLegacyBuilder(ctx, cli, tar, opts)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return imageName, nil
+}
+
+func buildImageWithLegacyBuilder(ctx context.Context, cli dockerClient, buildContext io.Reader, opts types.ImageBuildOptions) error {
+	res, err := cli.ImageBuild(ctx, buildContext, opts)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return printImageBuildOutput(res.Body)
+}
+
+// buildImageWithBuildKit builds an image using BuildKit. Like the docker CLI, the
+// build context is sent to the daemon in a separate upload request, while the
+// session is used to provide secrets to the build.
+func buildImageWithBuildKit(ctx context.Context, cli dockerClient, buildContext io.Reader, opts types.ImageBuildOptions, dockboxName string, secretSpecs []string) error {
+	s, err := session.NewSession(ctx, dockboxName, "")
+	if err != nil {
+		return err
+	}
+	if len(secretSpecs) > 0 {
+		secretProvider, err := parseSecretSpecs(secretSpecs)
+		if err != nil {
+			return err
+		}
+		s.Allow(secretProvider)
+	}
+
+	dialSession := func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+		return cli.DialHijack(ctx, "/session", proto, meta)
+	}
+	// The session is only closed once Run returned, as closing it races with Run
+	runCtx, cancelRun := context.WithCancel(ctx)
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		if err := s.Run(runCtx, dialSession); err != nil {
+			log.Printf("BuildKit session ended: %s", err)
+		}
+	}()
+	defer func() {
+		cancelRun()
+		<-runDone
+		s.Close()
+	}()
+
+	buildID := uuid.New().String()
+	uploadDone := make(chan error, 1)
+	go func() {
+		res, err := cli.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+			Version: types.BuilderBuildKit,
+			BuildID: uploadRequestRemote + ":" + buildID,
+		})
+		if err == nil {
+			res.Body.Close()
+		}
+		uploadDone <- err
+	}()
+
+	opts.Version = types.BuilderBuildKit
+	opts.RemoteContext = uploadRequestRemote
+	opts.SessionID = s.ID()
+	opts.BuildID = buildID
+
+	res, err := cli.ImageBuild(ctx, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := printImageBuildOutput(res.Body); err != nil {
+		return err
+	}
+	return <-uploadDone
+}
+
+// parseBuildArgs converts KEY=VALUE pairs into build args. Keys given without a
+// value are looked up in the environment, and left unset if not found.
+func parseBuildArgs(buildArgs []string) map[string]*string {
+	args := make(map[string]*string, len(buildArgs))
+	for _, arg := range buildArgs {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 2 {
+			value := parts[1]
+			args[parts[0]] = &value
+		} else if value, ok := os.LookupEnv(parts[0]); ok {
+			args[parts[0]] = &value
+		} else {
+			args[parts[0]] = nil
+		}
+	}
+	return args
+}
+
+func parseSecretSpecs(specs []string) (session.Attachable, error) {
+	sources := make([]secretsprovider.Source, 0, len(specs))
+	for _, spec := range specs {
+		source, err := parseSecret(spec)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	store, err := secretsprovider.NewStore(sources)
+	if err != nil {
+		return nil, err
+	}
+	return secretsprovider.NewSecretProvider(store), nil
+}
+
+// parseSecret parses a secret in the same format as `docker build --secret`,
+// e.g. id=mysecret,src=/local/secret or id=mysecret,type=env,env=MY_SECRET
+func parseSecret(value string) (secretsprovider.Source, error) {
+	source := secretsprovider.Source{}
+	fields, err := csv.NewReader(strings.NewReader(value)).Read()
+	if err != nil {
+		return source, fmt.Errorf("failed to parse secret %q: %s", value, err)
+	}
+
+	secretType := "file"
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return source, fmt.Errorf("invalid secret field %q: must be a key=value pair", field)
+		}
+		key, val := strings.ToLower(parts[0]), parts[1]
+		switch key {
+		case "type":
+			if val != "file" && val != "env" {
+				return source, fmt.Errorf("unsupported secret type %q", val)
+			}
+			secretType = val
+		case "id":
+			source.ID = val
+		case "source", "src":
+			source.FilePath = val
+		case "env":
+			source.Env = val
+		default:
+			return source, fmt.Errorf("unexpected key %q in secret %q", key, value)
+		}
+	}
+	if secretType == "env" && source.Env == "" {
+		source.Env = source.FilePath
+		source.FilePath = ""
+	}
+	return source, nil
+}
@@ -16,13 +16,22 @@ limitations under the License.
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 
 	"github.com/spf13/cobra"
 )
@@ -32,40 +41,304 @@ func NewCleanCommand(cli dockerClient) *cobra.Command {
 
 	// cleanCmd represents the clean command
 	var cleanCmd = &cobra.Command{
-		Use:   "clean <dockbox name>",
+		Use:   "clean [<name|pattern|path>...]",
 		Short: "Removes a dockbox from your machine",
-		Long:  `Clean up your machine! Get rid of a dockbox on your system`,
+		Long: `Clean up your machine! Get rid of dockboxes on your system.
+	Dockboxes can be given by name, glob pattern (e.g. 'test-*') or path, or
+	selected with --all, --older-than and --unused. All the selected dockboxes
+	are removed in a single plan with one confirmation.`,
 		Run: func(cmd *cobra.Command, args []string) {
-
-			dockboxName := args[0]
-			if !isImageDockbox(dockboxName) && !cleanCmdOptions.isImage {
-				dockboxName = dockboxNameToImageName(dockboxName)
-			}
-			cleanCmdOptions.dockboxName = dockboxName
-
+			cleanCmdOptions.args = args
 			CheckError(RunCleanCommand(cli, cleanCmdOptions))
 		},
-		Args: cobra.ExactArgs(1),
 	}
 
-	// cleanCmd.PersistentFlags().BoolVarP(&cleanCmdOptions.keepFolder, "keep", "k", false, "Keep repository folder after cleaning")
+	cleanCmd.PersistentFlags().BoolVarP(&cleanCmdOptions.keepFolder, "keep-folder", "k", false, "Keep repository folder after cleaning")
+	cleanCmd.PersistentFlags().BoolVar(&cleanCmdOptions.force, "force", false, "Remove repository folders even if they have uncommitted changes")
 	// cleanCmd.PersistentFlags().BoolVarP(&cleanCmdOptions.confirmBefore, "confirm", "i", false, "Confirm before deleting dockboxes")
-	cleanCmd.PersistentFlags().BoolVar(&cleanCmdOptions.isImage, "image", false, "True if given name is an image")
+	cleanCmd.PersistentFlags().BoolVar(&cleanCmdOptions.isImage, "image", false, "True if given names are images")
+	cleanCmd.PersistentFlags().BoolVar(&cleanCmdOptions.all, "all", false, "Remove all dockboxes")
+	cleanCmd.PersistentFlags().StringVar(&cleanCmdOptions.olderThan, "older-than", "", "Only remove dockboxes created before this long ago (e.g. 30d, 12h)")
+	cleanCmd.PersistentFlags().StringVar(&cleanCmdOptions.unused, "unused", "", "Only remove dockboxes without a container started in this long (e.g. 30d)")
+	cleanCmd.PersistentFlags().BoolVar(&cleanCmdOptions.keepBase, "keep-base", false, "Keep the base images of dockboxes, only removing their own layers")
+	cleanCmd.PersistentFlags().BoolVar(&cleanCmdOptions.pruneBuildCache, "prune-build-cache", false, "Also prune all the build cache of the machine that is not in use or shared with other builds, not only that of the dockboxes")
+	cleanCmd.PersistentFlags().BoolVar(&cleanCmdOptions.useTrash, "trash", false, "Save dockboxes to the trash before removing them, see dockbox trash")
+	cleanCmd.PersistentFlags().StringVar(&cleanCmdOptions.trash.retention, "trash-retention", DEFAULT_TRASH_RETENTION, "How long dockboxes are kept in the trash (e.g. 30d, 12h)")
+	cleanCmd.PersistentFlags().BoolVarP(&cleanCmdOptions.yes, "yes", "y", false, "Do not ask for confirmation")
+	addHistoryFlags(cleanCmd, &cleanCmdOptions.history)
 
 	return cleanCmd
 }
 
 func RunCleanCommand(cli dockerClient, cleanOptions CleanOptions) error {
 	ctx := context.Background()
-	err := deleteImageWithTree(ctx, cli, cleanOptions.dockboxName)
+	if cleanOptions.now.IsZero() {
+		cleanOptions.now = time.Now()
+	}
+	cleanOptions.trash.now = cleanOptions.now
+
+	targetIDs, targetPaths, err := selectCleanTargets(ctx, cli, cleanOptions)
+	if err != nil {
+		return err
+	}
+	if len(targetIDs) == 0 {
+		fmt.Println("No dockboxes to clean")
+		return nil
+	}
+
+	treeOptions := cleanOptions.history
+	treeOptions.All = true
+	forest, err := buildImageForest(ctx, cli, treeOptions)
+	if err != nil {
+		return err
+	}
+	imageToContainer := map[string][]string{}
+	if err := populateImageToContainer(ctx, cli, imageToContainer); err != nil {
+		return err
+	}
+	plan, err := planClean(forest, targetIDs, imageToContainer, cleanOptions.keepBase)
 	if err != nil {
 		return err
 	}
-	CheckError(err)
-	fmt.Println("Successfully deleted dockbox: " + cleanOptions.dockboxName)
+	if err := planCleanResources(ctx, cli, plan, targetPaths); err != nil {
+		return err
+	}
+	plan.pruneBuildCache = cleanOptions.pruneBuildCache
+	var retention time.Duration
+	if cleanOptions.useTrash {
+		retention, err = trashRetention(cleanOptions.trash)
+		if err != nil {
+			return err
+		}
+		plan.trashDir, err = openTrash(cleanOptions.trash)
+		if err != nil {
+			return err
+		}
+		// Entries are never replaced, as they may be all that is left of a dockbox
+		for _, dockbox := range plan.dockboxes {
+			if _, err := findTrashEntry(plan.trashDir, dockbox.displayName()); err == nil {
+				return fmt.Errorf("the trash already holds a dockbox named %s, restore it or run dockbox trash empty %s first", dockbox.displayName(), dockbox.displayName())
+			}
+		}
+	}
+	if !cleanOptions.keepFolder {
+		if err := planCleanFolders(ctx, cli, plan, cleanOptions.force); err != nil {
+			return err
+		}
+	}
+
+	fmt.Print(plan.String())
+	if !cleanOptions.yes {
+		res, err := GetUserBoolean("Confirm deletion?")
+		if err != nil {
+			return err
+		}
+		if !res {
+			return errors.New("user aborted cleanup operation")
+		}
+	}
+
+	// Dockboxes are saved before anything is removed so that they can be restored
+	for _, dockbox := range plan.dockboxes {
+		if plan.trashDir == "" {
+			break
+		}
+		if err := trashDockbox(ctx, cli, plan.trashDir, dockbox, plan.dirPaths[dockbox.ID], cleanOptions.now, retention); err != nil {
+			return err
+		}
+	}
+	if err := executeCleanPlan(ctx, cli, plan); err != nil {
+		return err
+	}
+	for _, dockbox := range plan.dockboxes {
+		fmt.Println("Successfully deleted dockbox: " + dockbox.displayName())
+	}
 	return nil
 }
 
+// selectCleanTargets returns the IDs of the images selected by the arguments
+// and selectors of cleanOptions, along with the directories of the dockboxes
+// that were given by path
+func selectCleanTargets(ctx context.Context, cli dockerClient, cleanOptions CleanOptions) ([]string, map[string]string, error) {
+	filtering := cleanOptions.olderThan != "" || cleanOptions.unused != ""
+	if len(cleanOptions.args) == 0 && !cleanOptions.all && !filtering {
+		return nil, nil, errors.New("no dockboxes given: pass names, patterns or paths, or use --all, --older-than or --unused")
+	}
+
+	// Companion images can be cleaned on their own when given by name, but are
+	// otherwise only selected along with their dockbox
+	dockboxImages, err := listDockboxImages(ctx, cli)
+	if err != nil {
+		return nil, nil, err
+	}
+	targetPaths := make(map[string]string)
+	candidates := make([]types.ImageSummary, 0)
+	seen := make(map[string]bool)
+	addCandidate := func(image types.ImageSummary) {
+		if !seen[image.ID] {
+			seen[image.ID] = true
+			candidates = append(candidates, image)
+		}
+	}
+
+	if cleanOptions.all || len(cleanOptions.args) == 0 {
+		for _, image := range dockboxImages {
+			if primaryDockboxTag(image) != "" {
+				addCandidate(image)
+			}
+		}
+	}
+	for _, arg := range cleanOptions.args {
+		if strings.ContainsAny(arg, "*?[") {
+			matched := false
+			for _, image := range dockboxImages {
+				repoTag := primaryDockboxTag(image)
+				if repoTag == "" {
+					continue
+				}
+				ok, err := path.Match(arg, repoTagToDockboxName(repoTag))
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid pattern %q: %s", arg, err)
+				}
+				if ok {
+					matched = true
+					addCandidate(image)
+				}
+			}
+			if !matched {
+				return nil, nil, fmt.Errorf("no dockboxes match %q", arg)
+			}
+			continue
+		}
+
+		imageName := arg
+		if !cleanOptions.isImage {
+			imageName, err = getImageNameFromArg(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		info, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists, _, _ := pathExists(filepath.Join(arg, HIDDEN_DIRECTORY, ".dockbox.yaml")); exists {
+			targetPaths[info.ID] = arg
+		}
+		summary := types.ImageSummary{ID: info.ID, RepoTags: info.RepoTags, Created: parseCreated(info.Created)}
+		if info.Config != nil {
+			summary.Labels = info.Config.Labels
+		}
+		addCandidate(summary)
+	}
+
+	if cleanOptions.olderThan != "" {
+		age, err := parseAge(cleanOptions.olderThan)
+		if err != nil {
+			return nil, nil, err
+		}
+		cutoff := cleanOptions.now.Add(-age).Unix()
+		filtered := make([]types.ImageSummary, 0, len(candidates))
+		for _, image := range candidates {
+			if image.Created < cutoff {
+				filtered = append(filtered, image)
+			}
+		}
+		candidates = filtered
+	}
+
+	if cleanOptions.unused != "" {
+		age, err := parseAge(cleanOptions.unused)
+		if err != nil {
+			return nil, nil, err
+		}
+		lastStarted, err := getLastStarted(ctx, cli)
+		if err != nil {
+			return nil, nil, err
+		}
+		cutoff := cleanOptions.now.Add(-age)
+		filtered := make([]types.ImageSummary, 0, len(candidates))
+		for _, image := range candidates {
+			// Dockboxes that were never entered are unused once they are old enough
+			lastUsed, ok := lastStarted[image.ID]
+			if !ok {
+				lastUsed = time.Unix(image.Created, 0)
+			}
+			if lastUsed.Before(cutoff) {
+				filtered = append(filtered, image)
+			}
+		}
+		candidates = filtered
+	}
+
+	// Snapshots and the images of compose services are removed along with their dockbox
+	selectedNames := make(map[string]bool)
+	for _, image := range candidates {
+		if image.Labels[LABEL_NAME] != "" && !isCompanionImage(image.Labels) {
+			selectedNames[image.Labels[LABEL_NAME]] = true
+		}
+	}
+	for _, image := range dockboxImages {
+		if isCompanionImage(image.Labels) && selectedNames[image.Labels[LABEL_NAME]] {
+			addCandidate(image)
+		}
+	}
+
+	targetIDs := make([]string, len(candidates))
+	for i, image := range candidates {
+		targetIDs[i] = image.ID
+	}
+	return targetIDs, targetPaths, nil
+}
+
+// primaryDockboxTag returns the dockbox/<name>:latest tag of an image that is a
+// dockbox in its own right, or an empty string for other images such as
+// snapshots and the images of compose services
+func primaryDockboxTag(image types.ImageSummary) string {
+	if isCompanionImage(image.Labels) {
+		return ""
+	}
+	for _, repoTag := range image.RepoTags {
+		if isImageDockbox(repoTag) && strings.HasSuffix(repoTag, ":latest") {
+			return repoTag
+		}
+	}
+	return ""
+}
+
+func parseCreated(created string) int64 {
+	t, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// getLastStarted returns when a container of each dockbox image was last started
+func getLastStarted(ctx context.Context, cli dockerClient) (map[string]time.Time, error) {
+	containers, err := listDockboxContainers(ctx, cli, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	lastStarted := make(map[string]time.Time)
+	for _, container := range containers {
+		info, err := cli.ContainerInspect(ctx, container.ID)
+		if err != nil {
+			return nil, err
+		}
+		startedAt := time.Unix(container.Created, 0)
+		if info.ContainerJSONBase != nil && info.State != nil {
+			if t, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil && t.After(startedAt) {
+				startedAt = t
+			}
+		}
+		if startedAt.After(lastStarted[container.ImageID]) {
+			lastStarted[container.ImageID] = startedAt
+		}
+	}
+	return lastStarted, nil
+}
+
 func populateImageToContainer(ctx context.Context, cli dockerClient, imageToContainer map[string][]string) error {
 	log.Printf("Populating image to container map...")
 	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
@@ -73,7 +346,7 @@ func populateImageToContainer(ctx context.Context, cli dockerClient, imageToCont
 		return err
 	}
 	for _, container := range containers {
-		if isImageDockbox(container.Image) {
+		if _, ok := container.Labels[LABEL_SOURCE]; ok {
 			log.Printf("Found dockbox with container: %s %s", container.ImageID, container.Image)
 		}
 		imageToContainer[container.ImageID] = append(imageToContainer[container.ImageID], container.ID)
@@ -84,141 +357,419 @@ func populateImageToContainer(ctx context.Context, cli dockerClient, imageToCont
 
 func removeContainersForImage(ctx context.Context, cli dockerClient, imageToContainer map[string][]string, imageID string) error {
 	for _, containerID := range imageToContainer[imageID] {
-		errContainerRemove := cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{})
-		log.Printf("Removing container: %s", containerID)
-		if errContainerRemove != nil {
-			if strings.Contains(errContainerRemove.Error(), "You cannot remove a running container") {
-				cli.ContainerStop(ctx, containerID, nil)
-				errContainerRemove = cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{})
-				if errContainerRemove != nil {
-					return errContainerRemove
-				}
-			} else {
+		if err := removeContainer(ctx, cli, containerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeContainer removes a container, stopping it first if it is running
+func removeContainer(ctx context.Context, cli dockerClient, containerID string) error {
+	errContainerRemove := cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{})
+	log.Printf("Removing container: %s", containerID)
+	if errContainerRemove != nil {
+		if strings.Contains(errContainerRemove.Error(), "You cannot remove a running container") {
+			cli.ContainerStop(ctx, containerID, nil)
+			errContainerRemove = cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{})
+			if errContainerRemove != nil {
 				return errContainerRemove
 			}
+		} else {
+			return errContainerRemove
 		}
 	}
 	return nil
 }
 
-func postOrder(root *ImageNode, reachedTaggedLeaves *[]*ImageNode, visitedStack *[]*ImageNode) {
-	if root == nil {
-		return
+// planClean computes the images and containers to remove in order to remove
+// the given images. An ancestor is only removed if every tagged image built
+// from it is removed too and no other container uses it. With keepBase, base
+// images are kept as well, so that only the layers of the dockboxes are removed.
+func planClean(forest *ImageForest, targetIDs []string, imageToContainer map[string][]string, keepBase bool) (*cleanPlan, error) {
+	plan := &cleanPlan{targetIDs: make(map[string]bool, len(targetIDs))}
+	for _, imageID := range targetIDs {
+		node, ok := forest.IDToNode[imageID]
+		if !ok {
+			return nil, fmt.Errorf("could not find image %s in the image tree", imageID)
+		}
+		plan.targetIDs[imageID] = true
+		plan.dockboxes = append(plan.dockboxes, node)
 	}
-	if len(root.children) == 0 && root.name != "<none>:<none>" {
-		// if len(root.children) == 0 {
-		*reachedTaggedLeaves = append(*reachedTaggedLeaves, root)
+	plan.dockboxes = sortNodes(plan.dockboxes, SORT_BY_NAME)
+
+	users := forest.taggedUsers()
+	// keepReason explains why an ancestor of the targets must be kept, if it must
+	keepReason := func(node *ImageNode) string {
+		if users[node][node.ID] {
+			return "tagged image"
+		}
+		otherUsers := make([]string, 0)
+		for userID := range users[node] {
+			if !plan.targetIDs[userID] {
+				otherUsers = append(otherUsers, planImageName(forest.IDToNode[userID]))
+			}
+		}
+		if len(otherUsers) > 0 {
+			sort.Strings(otherUsers)
+			return "used by " + strings.Join(otherUsers, ", ")
+		}
+		if len(imageToContainer[node.ID]) > 0 {
+			return "used by container " + shortImageID(imageToContainer[node.ID][0])
+		}
+		if keepBase && (node.parent == nil || node.name != "") {
+			return "base image"
+		}
+		return ""
+	}
+
+	toRemove := make(map[string]bool)
+	kept := make(map[string]bool)
+	for _, imageID := range targetIDs {
+		toRemove[imageID] = true
+		for node := forest.IDToNode[imageID].parent; node != nil && !toRemove[node.ID] && !kept[node.ID]; node = node.parent {
+			if plan.targetIDs[node.ID] {
+				break
+			}
+			if reason := keepReason(node); reason != "" {
+				kept[node.ID] = true
+				plan.kept = append(plan.kept, keptImage{node: node, reason: reason})
+				break
+			}
+			toRemove[node.ID] = true
+		}
 	}
-	for _, child := range root.children {
-		postOrder(child, reachedTaggedLeaves, visitedStack)
+	sort.SliceStable(plan.kept, func(i, j int) bool {
+		return plan.kept[i].node.displayName() < plan.kept[j].node.displayName()
+	})
+
+	// Children must be removed before their parents
+	seenContainers := make(map[string]bool)
+	for _, root := range sortNodes(forest.roots, SORT_BY_NAME) {
+		root.visitPostOrder(func(node *ImageNode) {
+			if !toRemove[node.ID] {
+				return
+			}
+			plan.images = append(plan.images, node)
+			if !plan.targetIDs[node.ID] {
+				return
+			}
+			for _, containerID := range imageToContainer[node.ID] {
+				if !seenContainers[containerID] {
+					seenContainers[containerID] = true
+					plan.containers = append(plan.containers, containerID)
+				}
+			}
+		})
 	}
-	*visitedStack = append(*visitedStack, root)
+	return plan, nil
 }
 
-func deleteImageWithTree(ctx context.Context, cli dockerClient, imageName string) error {
-	forest, err := buildImageForest(ctx, cli, TreeOptions{All: true})
-	if err != nil {
-		return err
+// dockboxResourceFilter matches the containers, volumes and networks created for a dockbox
+func dockboxResourceFilter(name string) filters.Args {
+	return filters.NewArgs(filters.Arg("label", LABEL_NAME+"="+name))
+}
+
+// planCleanResources adds the containers, volumes and networks created for the
+// dockboxes of plan to it, such as the services of a compose project, along
+// with the directories holding the dockboxes. Images
+// built from a dockbox inherit its labels, so besides the container recorded in
+// the folder of a dockbox, only the containers of its services are removed.
+func planCleanResources(ctx context.Context, cli dockerClient, plan *cleanPlan, targetPaths map[string]string) error {
+	seenContainers := make(map[string]bool)
+	for _, containerID := range plan.containers {
+		seenContainers[containerID] = true
+	}
+	plan.dirPaths = make(map[string]string)
+	addContainer := func(containerID string) {
+		if !seenContainers[containerID] {
+			seenContainers[containerID] = true
+			plan.containers = append(plan.containers, containerID)
+		}
 	}
+	for _, dockbox := range plan.dockboxes {
+		labels, err := getImageLabels(ctx, cli, dockbox.ID)
+		if err != nil {
+			return err
+		}
+		dirPath, err := dockboxFolder(ctx, cli, dockbox, labels, targetPaths)
+		if err != nil {
+			return err
+		}
+		if dirPath != "" {
+			plan.dirPaths[dockbox.ID] = dirPath
+			containerID, err := getConfigByKey(dirPath, "container")
+			if err != nil {
+				return err
+			}
+			if containerID != "" {
+				addContainer(containerID)
+			}
+		}
 
-	info, _, err := cli.ImageInspectWithRaw(ctx, imageName)
-	if err != nil {
-		return err
+		if dockbox.name == "" {
+			continue
+		}
+		serviceFilter := dockboxResourceFilter(dockbox.name)
+		serviceFilter.Add("label", LABEL_SERVICE)
+		containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: serviceFilter})
+		if err != nil {
+			return err
+		}
+		for _, container := range containers {
+			addContainer(container.ID)
+		}
+		volumes, err := cli.VolumeList(ctx, dockboxResourceFilter(dockbox.name))
+		if err != nil {
+			return err
+		}
+		for _, volume := range volumes.Volumes {
+			plan.volumes = append(plan.volumes, volume.Name)
+		}
+		networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: dockboxResourceFilter(dockbox.name)})
+		if err != nil {
+			return err
+		}
+		for _, network := range networks {
+			plan.networks = append(plan.networks, network.Name)
+		}
 	}
+	sort.Strings(plan.volumes)
+	sort.Strings(plan.networks)
+	return nil
+}
 
-	deletionOrder := make([]*ImageNode, 0)
-	deletionOrder = append(deletionOrder, forest.IDToNode[info.ID])
-	var lastNode *ImageNode = nil
+// planCleanFolders adds the directories of the dockboxes of plan, found by
+// planCleanResources, to it. The
+// directory of a dockbox created from a local directory is kept, only removing
+// its dockbox metadata. Directories with uncommitted changes are only removed
+// if force is set.
+func planCleanFolders(ctx context.Context, cli dockerClient, plan *cleanPlan, force bool) error {
+	for _, dockbox := range plan.dockboxes {
+		labels, err := getImageLabels(ctx, cli, dockbox.ID)
+		if err != nil {
+			return err
+		}
+		dirPath := plan.dirPaths[dockbox.ID]
+		if dirPath == "" {
+			continue
+		}
 
-	var node, ok = forest.IDToNode[info.ID]
-	if !ok {
-		return errors.New("unknown error occurred while deleting: node not found")
+		folder := cleanFolder{path: dirPath}
+		if source := labels[LABEL_SOURCE]; source == dirPath || source == "" {
+			folder.path = filepath.Join(dirPath, HIDDEN_DIRECTORY)
+			folder.metadataOnly = true
+		} else if !force {
+			changes, err := getUncommittedChanges(dirPath)
+			if err != nil {
+				return err
+			}
+			if changes != "" {
+				return fmt.Errorf("refusing to remove %s as it has uncommitted changes:\n%s\nUse --force to remove it anyway or --keep-folder to keep it", dirPath, changes)
+			}
+		}
+		plan.folders = append(plan.folders, folder)
 	}
-	log.Printf("Starting with %s %s\n", node.ID, node.name)
-	// var rootParent *ImageNode = nil
+	return nil
+}
 
-	for node.parent != nil {
-		// rootParent = node.parent
+// getImageLabels returns the labels of the image with the given ID
+func getImageLabels(ctx context.Context, cli dockerClient, imageID string) (map[string]string, error) {
+	info, _, err := cli.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+	if info.Config == nil {
+		return nil, nil
+	}
+	return info.Config.Labels, nil
+}
 
-		lastNode = node
-		node = node.parent
-		reachedTaggedLeaves, visitedStack := make([]*ImageNode, 0), make([]*ImageNode, 0)
-		for _, child := range node.children {
-			if child.ID != lastNode.ID {
-				postOrder(child, &reachedTaggedLeaves, &visitedStack)
-			}
+// dockboxFolder returns the directory holding the given dockbox, or an empty
+// string if there is none. The path the dockbox was given by is preferred over
+// its label, which may be stale or come from another machine, and a directory
+// is only returned if its configuration refers to the image of the dockbox.
+func dockboxFolder(ctx context.Context, cli dockerClient, dockbox *ImageNode, labels map[string]string, targetPaths map[string]string) (string, error) {
+	// Snapshots and service images share the folder of their dockbox
+	if isCompanionImage(labels) {
+		return "", nil
+	}
+	for _, dirPath := range []string{targetPaths[dockbox.ID], labels[LABEL_PATH]} {
+		if dirPath == "" {
+			continue
 		}
-		// Only need to ask for confirmation for tagged images or images with multiple children
-		var res bool = true
-		var err error = nil
-		if len(reachedTaggedLeaves) > 0 {
-			fmt.Printf("Warning: Removing %s %s will also remove the following images:\n", node.name, node.ID)
-			node.PrintTree(ForestPrintOptions{textColor: "\033[31m"})
-			// for _, leaf := range reachedTaggedLeaves {
-			// 	fmt.Printf("- %s %s\n", leaf.ID, leaf.name)
-			// }
-			printNodes(reachedTaggedLeaves, "")
-			res, err = GetUserBoolean(fmt.Sprintf("Confirm removal of %s %s and all the above images?", node.name, node.ID))
-		} else if node.name != "" {
-			res, err = GetUserBoolean("Remove parent image: %s %s?", node.name, node.ID)
+		dirPath, err := filepath.Abs(dirPath)
+		if err != nil {
+			return "", err
 		}
-
+		if exists, _, _ := pathExists(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml")); !exists {
+			log.Printf("Dockbox directory %s no longer exists", dirPath)
+			continue
+		}
+		imageName, err := getConfigByKey(dirPath, "image")
 		if err != nil {
-			return err
+			return "", err
 		}
-		if !res {
-			for node.parent != nil {
-				// rootParent = node.parent
-				node = node.parent
+		if imageName != "" {
+			info, exists, err := checkDockboxExists(ctx, cli, imageToDockboxName(imageName))
+			if err != nil {
+				return "", err
+			}
+			if exists && info.ID == dockbox.ID {
+				return dirPath, nil
 			}
-			break
 		}
-		deletionOrder = append(deletionOrder, visitedStack...)
-		deletionOrder = append(deletionOrder, node)
+		log.Printf("Keeping %s as it does not hold dockbox %s", dirPath, dockbox.displayName())
+	}
+	return "", nil
+}
+
+// getUncommittedChanges returns the changes in the git repository at dirPath,
+// ignoring the dockbox metadata, or an empty string if it is not a git repository
+func getUncommittedChanges(dirPath string) (string, error) {
+	if exists, _, _ := pathExists(filepath.Join(dirPath, ".git")); !exists {
+		return "", nil
 	}
-	forest.PrintForest(ForestPrintOptions{colorIDS: map[string]string{deletionOrder[len(deletionOrder)-1].ID: "\033[31m"}})
-	// if rootParent != nil && len(deletionOrder) > 0 {
-	// 	rootParent.PrintTree(ForestPrintOptions{colorIDS: map[string]string{deletionOrder[len(deletionOrder)-1].ID: "\033[31m"}})
-	// }
-	// printNodes(deletionOrder, "Deletion List")
-	res, err := GetUserBoolean("Confirm deletion?")
+	out, err := exec.Command("git", "-C", dirPath, "status", "--porcelain", "--", ".", ":(exclude)"+HIDDEN_DIRECTORY).Output()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to check %s for uncommitted changes: %s", dirPath, err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// visitPostOrder calls f on the descendants of node, in name order, and then on node
+func (node *ImageNode) visitPostOrder(f func(*ImageNode)) {
+	children := make([]*ImageNode, 0, len(node.children))
+	for _, child := range node.children {
+		children = append(children, child)
 	}
-	if !res {
-		return errors.New("user aborted cleanup operation")
+	for _, child := range sortNodes(children, SORT_BY_NAME) {
+		child.visitPostOrder(f)
 	}
+	f(node)
+}
 
-	imageToContainer := map[string][]string{}
-	err = populateImageToContainer(ctx, cli, imageToContainer)
-	CheckError(err)
-	for _, image := range deletionOrder {
-		if image.name != "<none>:<none>" {
-			err = removeContainersForImage(ctx, cli, imageToContainer, image.ID)
-			if err != nil && !strings.HasPrefix(err.Error(), "Error: No such container:") {
-				return err
+func (plan *cleanPlan) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "The following dockboxes will be removed:")
+	for _, dockbox := range plan.dockboxes {
+		fmt.Fprintf(&buf, "  %s\n", dockbox.displayName())
+	}
+
+	var total int64
+	fmt.Fprintln(&buf, "\nThe following images will be removed:")
+	tabWriter := tabwriter.NewWriter(&buf, 1, 1, 2, ' ', 0)
+	for _, image := range plan.images {
+		total += image.size
+		fmt.Fprintf(tabWriter, "  %s\t%s\t%s\n", planImageName(image), shortImageID(image.ID), humanSize(image.size))
+	}
+	tabWriter.Flush()
+
+	if len(plan.kept) > 0 {
+		fmt.Fprintln(&buf, "\nThe following images will be kept:")
+		tabWriter = tabwriter.NewWriter(&buf, 1, 1, 2, ' ', 0)
+		for _, image := range plan.kept {
+			fmt.Fprintf(tabWriter, "  %s\t%s\t%s\n", planImageName(image.node), shortImageID(image.node.ID), image.reason)
+		}
+		tabWriter.Flush()
+	}
+
+	if len(plan.folders) > 0 {
+		fmt.Fprintln(&buf, "\nThe following folders will be removed:")
+		for _, folder := range plan.folders {
+			if folder.metadataOnly {
+				fmt.Fprintf(&buf, "  %s (dockbox metadata only)\n", folder.path)
+			} else {
+				fmt.Fprintf(&buf, "  %s\n", folder.path)
 			}
 		}
-		_, err := cli.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{Force: true, PruneChildren: true})
-		log.Printf("Deleted image: %s %s\n", image.ID, image.name)
-		if err != nil && !strings.HasPrefix(err.Error(), "Error: No such image:") {
-			log.Printf("Error while deleting: %s", image.ID)
-			return err
+	}
+
+	if len(plan.containers) > 0 {
+		fmt.Fprintln(&buf, "\nThe following containers will be removed:")
+		for _, containerID := range plan.containers {
+			fmt.Fprintf(&buf, "  %s\n", shortImageID(containerID))
 		}
 	}
+	if len(plan.volumes) > 0 {
+		fmt.Fprintln(&buf, "\nThe following volumes will be removed:")
+		for _, volume := range plan.volumes {
+			fmt.Fprintf(&buf, "  %s\n", volume)
+		}
+	}
+	if len(plan.networks) > 0 {
+		fmt.Fprintln(&buf, "\nThe following networks will be removed:")
+		for _, network := range plan.networks {
+			fmt.Fprintf(&buf, "  %s\n", network)
+		}
+	}
+	if plan.trashDir != "" {
+		fmt.Fprintf(&buf, "\nThe dockboxes will be saved to the trash at %s first\n", plan.trashDir)
+	}
+	if plan.pruneBuildCache {
+		fmt.Fprintln(&buf, "\nAll the build cache of the machine that is not in use or shared with other builds will be pruned")
+	}
+	fmt.Fprintf(&buf, "\nTotal space freed: %s\n", humanSize(total))
+	return buf.String()
+}
 
-	return nil
+func planImageName(node *ImageNode) string {
+	if node.name == "" {
+		return "<none>"
+	}
+	return node.name
 }
 
-func printNodes(nodes []*ImageNode, message string) {
-	names := make([]string, len(nodes))
-	for i, image := range nodes {
-		if image.name == "" {
-			names[i] = image.ID
-		} else {
-			names[i] = image.name
+func executeCleanPlan(ctx context.Context, cli dockerClient, plan *cleanPlan) error {
+	for _, containerID := range plan.containers {
+		err := removeContainer(ctx, cli, containerID)
+		if err != nil && !strings.HasPrefix(err.Error(), "Error: No such container:") {
+			return err
+		}
+	}
+	for _, volume := range plan.volumes {
+		if err := cli.VolumeRemove(ctx, volume, false); err != nil {
+			return err
+		}
+		log.Printf("Removed volume: %s\n", volume)
+	}
+	for _, network := range plan.networks {
+		if err := cli.NetworkRemove(ctx, network); err != nil {
+			return err
 		}
+		log.Printf("Removed network: %s\n", network)
 	}
-	strings.Join(names, "\n-")
-	log.Printf("%s \n- %s", message, strings.Join(names, "\n- "))
+	for _, image := range plan.images {
+		// Ancestors are never forced so that the daemon refuses to remove images
+		// still in use, and parents are never pruned implicitly so that only the
+		// images of the plan are removed
+		force := plan.targetIDs[image.ID]
+		_, err := cli.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{Force: force, PruneChildren: false})
+		if err != nil && !strings.HasPrefix(err.Error(), "Error: No such image:") {
+			if !force {
+				log.Printf("Warning: Keeping image %s: %s", image.ID, err)
+				continue
+			}
+			log.Printf("Error while deleting: %s", image.ID)
+			return err
+		}
+		log.Printf("Deleted image: %s %s\n", image.ID, image.name)
+	}
+	// The daemon cannot tell the build cache of an image, so it is pruned as a whole
+	if plan.pruneBuildCache {
+		report, err := cli.BuildCachePrune(ctx, types.BuildCachePruneOptions{
+			Filters: filters.NewArgs(filters.Arg("inuse", "false"), filters.Arg("shared", "false")),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reclaimed %s of build cache\n", humanSize(int64(report.SpaceReclaimed)))
+	}
+	for _, folder := range plan.folders {
+		if err := os.RemoveAll(folder.path); err != nil {
+			return err
+		}
+		log.Printf("Removed folder: %s\n", folder.path)
+	}
+	return nil
 }
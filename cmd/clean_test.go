@@ -0,0 +1,452 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+var cleanTestNow = time.Unix(1626748200, 0).Add(10 * 24 * time.Hour)
+
+var cleanTestContainers = []types.Container{
+	{ID: "app2_ctr", ImageID: "sha256:app2", Image: "dockbox/app2", Created: 1626748100, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app2"}},
+	{ID: "flask_ctr", ImageID: "sha256:flask", Image: "dockbox/flask", Created: 1626748159, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/flask"}},
+	{ID: "ubuntu_ctr", ImageID: "sha256:ubuntu", Image: "ubuntu:18.04", Created: 1626748159},
+}
+
+var cleanTestStartedAt = map[string]time.Time{
+	"app2_ctr":   cleanTestNow.Add(-24 * time.Hour),
+	"flask_ctr":  cleanTestNow.Add(-7 * 24 * time.Hour),
+	"ubuntu_ctr": cleanTestNow,
+}
+
+var cleanTestVolumes = []*types.Volume{
+	{Name: "app1_data", Labels: map[string]string{LABEL_NAME: "app1"}},
+	{Name: "flask_data", Labels: map[string]string{LABEL_NAME: "flask"}},
+	{Name: "postgres_data"},
+}
+
+var cleanTestNetworks = []types.NetworkResource{
+	{ID: "app2_net_id", Name: "app2_default", Labels: map[string]string{LABEL_NAME: "app2"}},
+	{ID: "bridge_id", Name: "bridge"},
+}
+
+// cleanTestClient records the containers and images removed by clean
+type cleanTestClient struct {
+	*fakeDockerClient
+	mu                sync.Mutex
+	removedContainers []string
+	removedImages     []string
+	forcedImages      []string
+	removedVolumes    []string
+	removedNetworks   []string
+	pruneFilters      []filters.Args
+}
+
+func newCleanTestClient(t *testing.T) *cleanTestClient {
+	cli := &cleanTestClient{fakeDockerClient: newTreeTestClient()}
+	cli.containerList = func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
+		return filterContainersByLabel(cleanTestContainers, clo), nil
+	}
+	cli.containerInspect = func(c context.Context, containerID string) (types.ContainerJSON, error) {
+		startedAt, ok := cleanTestStartedAt[containerID]
+		if !ok {
+			return types.ContainerJSON{}, errors.New("Error: No such container: " + containerID)
+		}
+		return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    containerID,
+			State: &types.ContainerState{StartedAt: startedAt.UTC().Format(time.RFC3339Nano)},
+		}}, nil
+	}
+	cli.containerRemove = func(c context.Context, containerID string, cro types.ContainerRemoveOptions) error {
+		cli.mu.Lock()
+		defer cli.mu.Unlock()
+		cli.removedContainers = append(cli.removedContainers, containerID)
+		return nil
+	}
+	cli.volumeList = func(c context.Context, filter filters.Args) (volume.VolumeListOKBody, error) {
+		volumes := make([]*types.Volume, 0)
+		for _, v := range cleanTestVolumes {
+			if filter.MatchKVList("label", v.Labels) {
+				volumes = append(volumes, v)
+			}
+		}
+		return volume.VolumeListOKBody{Volumes: volumes}, nil
+	}
+	cli.volumeRemove = func(c context.Context, volumeID string, force bool) error {
+		cli.removedVolumes = append(cli.removedVolumes, volumeID)
+		return nil
+	}
+	cli.networkList = func(c context.Context, nlo types.NetworkListOptions) ([]types.NetworkResource, error) {
+		networks := make([]types.NetworkResource, 0)
+		for _, n := range cleanTestNetworks {
+			if nlo.Filters.MatchKVList("label", n.Labels) {
+				networks = append(networks, n)
+			}
+		}
+		return networks, nil
+	}
+	cli.networkRemove = func(c context.Context, networkID string) error {
+		cli.removedNetworks = append(cli.removedNetworks, networkID)
+		return nil
+	}
+	cli.buildCachePrune = func(c context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error) {
+		cli.pruneFilters = append(cli.pruneFilters, opts.Filters)
+		return &types.BuildCachePruneReport{SpaceReclaimed: 42000000}, nil
+	}
+	cli.imageRemove = func(c context.Context, imageID string, iro types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+		cli.mu.Lock()
+		defer cli.mu.Unlock()
+		cli.removedImages = append(cli.removedImages, imageID)
+		if iro.Force {
+			cli.forcedImages = append(cli.forcedImages, imageID)
+		}
+		assert.False(t, iro.PruneChildren)
+		return []types.ImageDeleteResponseItem{{Deleted: imageID}}, nil
+	}
+	return cli
+}
+
+func TestCleanSelectTargets(t *testing.T) {
+	testcases := []struct {
+		name          string
+		cleanOptions  CleanOptions
+		expectedIDs   []string
+		expectedError string
+	}{
+		{name: "Name", cleanOptions: CleanOptions{args: []string{"app1"}}, expectedIDs: []string{"sha256:app1"}},
+		{name: "Names", cleanOptions: CleanOptions{args: []string{"flask", "app1", "flask"}}, expectedIDs: []string{"sha256:flask", "sha256:app1"}},
+		{name: "Pattern", cleanOptions: CleanOptions{args: []string{"app*"}}, expectedIDs: []string{"sha256:app1", "sha256:app2"}},
+		{name: "All", cleanOptions: CleanOptions{all: true}, expectedIDs: []string{"sha256:app1", "sha256:app2", "sha256:flask"}},
+		{name: "OlderThan", cleanOptions: CleanOptions{olderThan: "10d"}, expectedIDs: []string{"sha256:app2", "sha256:flask"}},
+		{name: "PatternOlderThan", cleanOptions: CleanOptions{args: []string{"app*"}, olderThan: "10d"}, expectedIDs: []string{"sha256:app2"}},
+		{name: "Unused", cleanOptions: CleanOptions{unused: "5d"}, expectedIDs: []string{"sha256:app1", "sha256:flask"}},
+		{name: "NoMatch", cleanOptions: CleanOptions{args: []string{"test-*"}}, expectedError: `no dockboxes match "test-*"`},
+		{name: "InvalidAge", cleanOptions: CleanOptions{olderThan: "a month"}, expectedError: `invalid duration "a month"`},
+		{name: "NoTargets", cleanOptions: CleanOptions{}, expectedError: "no dockboxes given: pass names, patterns or paths, or use --all, --older-than or --unused"},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			test.cleanOptions.now = cleanTestNow
+			targetIDs, _, err := selectCleanTargets(context.Background(), newCleanTestClient(t), test.cleanOptions)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedIDs, targetIDs)
+		})
+	}
+}
+
+func TestCleanSkipsImagesBuiltFromDockboxes(t *testing.T) {
+	cli := newCleanTestClient(t)
+	imageList := cli.imageList
+	cli.imageList = func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+		images, err := imageList(c, ilo)
+		// Both images inherit the labels of app1
+		labels := map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_NAME: "app1"}
+		return append(images, filterImagesByLabel([]types.ImageSummary{
+			{ID: "sha256:tool", RepoTags: []string{"myorg/tool:latest"}, Labels: labels},
+			{ID: "sha256:other", RepoTags: []string{"dockbox/other:latest"}, Labels: labels},
+		}, ilo)...), err
+	}
+	targetIDs, _, err := selectCleanTargets(context.Background(), cli, CleanOptions{all: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app2", "sha256:flask"}, targetIDs)
+}
+
+func TestCleanPlan(t *testing.T) {
+	testcases := []struct {
+		name            string
+		targetIDs       []string
+		keepBase        bool
+		untagged        []string
+		extraContainers []types.Container
+	}{
+		{name: "CleanPlanSingle", targetIDs: []string{"sha256:app1"}},
+		{name: "CleanPlanShared", targetIDs: []string{"sha256:app2", "sha256:app1"}},
+		{name: "CleanPlanBase", targetIDs: []string{"sha256:flask", "sha256:python"}},
+		{name: "CleanPlanUntaggedBase", targetIDs: []string{"sha256:flask"}, untagged: []string{"sha256:python"}},
+		{name: "CleanPlanKeepBase", targetIDs: []string{"sha256:flask"}, untagged: []string{"sha256:python"}, keepBase: true},
+		{
+			name:            "CleanPlanContainerOnAncestor",
+			targetIDs:       []string{"sha256:app2", "sha256:app1"},
+			extraContainers: []types.Container{{ID: "setup_ctr", ImageID: "sha256:setup", Image: "sha256:setup"}},
+		},
+		{
+			name:      "CleanPlanUntaggedChild",
+			targetIDs: []string{"sha256:app1"},
+			untagged:  []string{"sha256:app2"},
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			cli := newCleanTestClient(t)
+			untag(cli.fakeDockerClient, test.untagged)
+			containerList := cli.containerList
+			cli.containerList = func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
+				containers, err := containerList(c, clo)
+				return append(containers, filterContainersByLabel(test.extraContainers, clo)...), err
+			}
+			forest, err := buildImageForest(context.Background(), cli, TreeOptions{All: true})
+			assert.Nil(t, err)
+			imageToContainer := map[string][]string{}
+			assert.Nil(t, populateImageToContainer(context.Background(), cli, imageToContainer))
+
+			plan, err := planClean(forest, test.targetIDs, imageToContainer, test.keepBase)
+			assert.Nil(t, err)
+			actual := plan.String()
+			assert.EqualValues(t, goldenValue(t, "clean/"+test.name, actual, *update), actual)
+		})
+	}
+}
+
+// untag removes the tags of the given images, as if the tags were removed after
+// building other images from them. Images without children are still listed,
+// as dangling images.
+func untag(cli *fakeDockerClient, imageIDs []string) {
+	isUntagged := make(map[string]bool)
+	for _, imageID := range imageIDs {
+		isUntagged[imageID] = true
+	}
+	hasChildren := make(map[string]bool)
+	for _, hist := range treeTestHistories {
+		for _, item := range hist[1:] {
+			hasChildren[item.ID] = true
+		}
+	}
+	imageList, imageHistory := cli.imageList, cli.imageHistory
+	cli.imageList = func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+		images, err := imageList(c, ilo)
+		listed := make([]types.ImageSummary, 0, len(images))
+		for _, image := range images {
+			if isUntagged[image.ID] {
+				if hasChildren[image.ID] {
+					continue
+				}
+				image.RepoTags = nil
+			}
+			listed = append(listed, image)
+		}
+		return listed, err
+	}
+	cli.imageHistory = func(c context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+		hist, err := imageHistory(c, imageID)
+		untagged := make([]image.HistoryResponseItem, len(hist))
+		for i, item := range hist {
+			if isUntagged[item.ID] {
+				item.Tags = nil
+			}
+			untagged[i] = item
+		}
+		return untagged, err
+	}
+}
+
+func TestCleanRemovesPlan(t *testing.T) {
+	cli := newCleanTestClient(t)
+	err := RunCleanCommand(cli, CleanOptions{args: []string{"app*"}, yes: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app2_ctr"}, cli.removedContainers)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app2", "sha256:setup"}, cli.removedImages)
+	// Only the dockboxes themselves are forced
+	assert.Equal(t, []string{"sha256:app1", "sha256:app2"}, cli.forcedImages)
+	assert.Equal(t, []string{"app1_data"}, cli.removedVolumes)
+	assert.Equal(t, []string{"app2_default"}, cli.removedNetworks)
+	assert.Nil(t, cli.pruneFilters)
+}
+
+func TestCleanBuildCache(t *testing.T) {
+	cli := newCleanTestClient(t)
+	err := RunCleanCommand(cli, CleanOptions{args: []string{"app1"}, yes: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Nil(t, cli.pruneFilters)
+
+	// The whole build cache of the machine is pruned, which the plan warns about
+	assert.Contains(t, (&cleanPlan{pruneBuildCache: true}).String(), "All the build cache of the machine")
+	cli = newCleanTestClient(t)
+	err = RunCleanCommand(cli, CleanOptions{args: []string{"flask"}, pruneBuildCache: true, yes: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"flask_data"}, cli.removedVolumes)
+	assert.Nil(t, cli.removedNetworks)
+	assert.Len(t, cli.pruneFilters, 1)
+	assert.Equal(t, []string{"false"}, cli.pruneFilters[0].Get("inuse"))
+	assert.Equal(t, []string{"false"}, cli.pruneFilters[0].Get("shared"))
+}
+
+func TestCleanKeepsImagesInUse(t *testing.T) {
+	cli := newCleanTestClient(t)
+	imageRemove := cli.imageRemove
+	cli.imageRemove = func(c context.Context, imageID string, iro types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+		if imageID == "sha256:setup" {
+			return nil, errors.New("Error response from daemon: conflict: unable to delete setup (cannot be forced) - image has dependent child images")
+		}
+		return imageRemove(c, imageID, iro)
+	}
+	err := RunCleanCommand(cli, CleanOptions{args: []string{"app*"}, yes: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app2"}, cli.removedImages)
+}
+
+// newDockboxFolder creates a directory holding the dockbox of the given image, as
+// a git repository if requested
+func newDockboxFolder(t *testing.T, imageName string, gitRepository bool) string {
+	t.Helper()
+	dirPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml"), []byte("image: "+imageName+"\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, "main.go"), []byte("package main\n"), 0644))
+	if gitRepository {
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"add", "main.go"},
+			{"-c", "user.name=dockbox", "-c", "user.email=dockbox@example.com", "commit", "-q", "-m", "Initial commit"},
+		} {
+			out, err := exec.Command("git", append([]string{"-C", dirPath}, args...)...).CombinedOutput()
+			assert.Nil(t, err, string(out))
+		}
+	}
+	return dirPath
+}
+
+func TestCleanFolders(t *testing.T) {
+	testcases := []struct {
+		name          string
+		cleanOptions  CleanOptions
+		dirty         bool
+		expectedError string
+		cloneRemoved  bool
+	}{
+		{name: "RemoveFolders", cleanOptions: CleanOptions{}, cloneRemoved: true},
+		{name: "KeepFolder", cleanOptions: CleanOptions{keepFolder: true}},
+		{name: "UncommittedChanges", cleanOptions: CleanOptions{}, dirty: true, expectedError: "refusing to remove"},
+		{name: "ForceUncommittedChanges", cleanOptions: CleanOptions{force: true}, dirty: true, cloneRemoved: true},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			cloneDir := newDockboxFolder(t, "dockbox/app1", true)
+			localDir := newDockboxFolder(t, "dockbox/app2", false)
+			if test.dirty {
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(cloneDir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644))
+			}
+			labels := map[string]map[string]string{
+				"sha256:app1": {LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_PATH: cloneDir},
+				"sha256:app2": {LABEL_SOURCE: localDir, LABEL_PATH: localDir},
+			}
+
+			cli := newCleanTestClient(t)
+			imageInspectWithRaw := cli.imageInspectWithRaw
+			cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+				info, raw, err := imageInspectWithRaw(c, imageID)
+				if err == nil && labels[info.ID] != nil {
+					info.Config.Labels = labels[info.ID]
+				}
+				return info, raw, err
+			}
+
+			test.cleanOptions.args = []string{"app*"}
+			test.cleanOptions.yes = true
+			test.cleanOptions.now = cleanTestNow
+			err := RunCleanCommand(cli, test.cleanOptions)
+			if test.expectedError != "" {
+				assert.Contains(t, fmt.Sprint(err), test.expectedError)
+				assert.Nil(t, cli.removedImages)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			cloneExists, _, _ := pathExists(cloneDir)
+			assert.Equal(t, !test.cloneRemoved, cloneExists)
+			localExists, _, _ := pathExists(filepath.Join(localDir, "main.go"))
+			assert.True(t, localExists)
+			metadataExists, _, _ := pathExists(filepath.Join(localDir, HIDDEN_DIRECTORY))
+			assert.Equal(t, test.cleanOptions.keepFolder || test.expectedError != "", metadataExists)
+		})
+	}
+}
+
+func TestCleanKeepsForeignFolders(t *testing.T) {
+	testcases := []struct {
+		name         string
+		byPath       bool
+		cloneRemoved bool
+	}{
+		{name: "ByName"},
+		{name: "ByPath", byPath: true, cloneRemoved: true},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			cloneDir := newDockboxFolder(t, "dockbox/app1", true)
+			// The label of app1 points to a checkout of another dockbox
+			foreignDir := newDockboxFolder(t, "dockbox/flask", true)
+
+			cli := newCleanTestClient(t)
+			imageInspectWithRaw := cli.imageInspectWithRaw
+			cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+				info, raw, err := imageInspectWithRaw(c, imageID)
+				if err == nil && info.ID == "sha256:app1" {
+					info.Config.Labels = map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_PATH: foreignDir}
+				}
+				return info, raw, err
+			}
+
+			arg := "app1"
+			if test.byPath {
+				arg = cloneDir
+			}
+			err := RunCleanCommand(cli, CleanOptions{args: []string{arg}, yes: true, now: cleanTestNow})
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"sha256:app1"}, cli.removedImages)
+
+			cloneExists, _, _ := pathExists(cloneDir)
+			assert.Equal(t, !test.cloneRemoved, cloneExists)
+			foreignExists, _, _ := pathExists(filepath.Join(foreignDir, HIDDEN_DIRECTORY, ".dockbox.yaml"))
+			assert.True(t, foreignExists)
+		})
+	}
+}
+
+func TestCleanKeepsDerivedContainers(t *testing.T) {
+	dirPath := newDockboxFolder(t, "dockbox/app1", false)
+	// The dockbox was entered from a snapshot
+	assert.Nil(t, setConfigKey("container", "app1_snap_ctr", dirPath))
+	labels := map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_NAME: "app1", LABEL_PATH: dirPath}
+	// The container of an image built from app1 carries its labels
+	containers := []types.Container{
+		{ID: "app1_snap_ctr", ImageID: "sha256:app1snap", Image: "dockbox/app1:snap", State: "exited", Labels: labels},
+		{ID: "derived_ctr", ImageID: "sha256:derived", Image: "derived", State: "running", Labels: labels},
+	}
+
+	cli := newCleanTestClient(t)
+	imageInspectWithRaw, containerList := cli.imageInspectWithRaw, cli.containerList
+	cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+		info, raw, err := imageInspectWithRaw(c, imageID)
+		if err == nil && info.ID == "sha256:app1" {
+			info.Config.Labels = labels
+		}
+		return info, raw, err
+	}
+	cli.containerList = func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
+		list, err := containerList(c, clo)
+		return append(list, filterContainersByLabel(containers, clo)...), err
+	}
+
+	err := RunCleanCommand(cli, CleanOptions{args: []string{"app1"}, keepFolder: true, yes: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app1_snap_ctr"}, cli.removedContainers)
+	assert.Equal(t, []string{"sha256:app1"}, cli.removedImages)
+}
@@ -6,15 +6,49 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/google/uuid"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/viper"
 )
 
 const PREFIX = "dockbox"
 const HIDDEN_DIRECTORY = ".dockbox"
 
+// Labels set on images built by dockbox
+const LABEL_SOURCE = "io.dockbox.source"
+const LABEL_PATH = "io.dockbox.path"
+const LABEL_COMMIT = "io.dockbox.commit"
+const LABEL_LANGUAGE = "io.dockbox.language"
+const LABEL_VERSION = "io.dockbox.version"
+const LABEL_NAME = "io.dockbox.name"
+const LABEL_SNAPSHOT = "io.dockbox.snapshot"
+const LABEL_SERVICE = "io.dockbox.service"
+
+// Orders in which images of a tree can be sorted
+const SORT_BY_NAME = "name"
+const SORT_BY_CREATED = "created"
+const SORT_BY_SIZE = "size"
+
+// Output formats of the tree command
+const FORMAT_TREE = "tree"
+const FORMAT_DOT = "dot"
+const FORMAT_MERMAID = "mermaid"
+
+// Output formats of the du command
+const FORMAT_TABLE = "table"
+const FORMAT_JSON = "json"
+
 func CheckError(err error) {
 	if err == nil {
 		return
@@ -51,14 +85,21 @@ func SortMap(m map[string]int) []Pair {
 }
 
 func repoTagToDockboxName(repoTag string) string {
-	if !strings.HasPrefix(repoTag, PREFIX) {
+	if !isImageDockbox(repoTag) {
 		return repoTag
 	}
 	boxName := repoTag[len(PREFIX)+1:]
-	if strings.ContainsRune(boxName, ':') {
-		boxName = boxName[:strings.Index(boxName, ":")]
+	// Other tags, such as the tags of snapshots, are kept in the name
+	return strings.TrimSuffix(boxName, ":latest")
+}
+
+// imageToDockboxName returns the name of the dockbox of an image, ignoring its
+// tag so that snapshots belong to their dockbox
+func imageToDockboxName(imageName string) string {
+	if named, err := reference.ParseNormalizedNamed(imageName); err == nil {
+		imageName = reference.FamiliarName(named)
 	}
-	return boxName
+	return repoTagToDockboxName(imageName)
 }
 
 func dockboxNameToImageName(boxName string) string {
@@ -66,7 +107,88 @@ func dockboxNameToImageName(boxName string) string {
 }
 
 func isImageDockbox(imageName string) bool {
-	return strings.HasPrefix(imageName, PREFIX)
+	return strings.HasPrefix(imageName, PREFIX+"/")
+}
+
+// isDockbox reports whether an image or container with the given labels and
+// image names belongs to a dockbox. Images built from a dockbox inherit its
+// labels, so only images of the dockbox repository count, and only in the
+// repository of the dockbox they are labelled with. Dockboxes created before
+// images were labelled have no name label.
+func isDockbox(labels map[string]string, imageNames ...string) bool {
+	for _, imageName := range imageNames {
+		if !isImageDockbox(imageName) {
+			continue
+		}
+		if name := labels[LABEL_NAME]; name == "" || name == imageToDockboxName(imageName) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompanionImage reports whether an image with the given labels belongs to
+// another dockbox, such as its snapshots and the images of its compose services
+func isCompanionImage(labels map[string]string) bool {
+	return labels[LABEL_SNAPSHOT] != "" || labels[LABEL_SERVICE] != ""
+}
+
+// listDockboxImages returns the images created by dockbox, including companion
+// images. The daemon lists the labelled images, then the images of the dockbox
+// repository created before images were labelled.
+func listDockboxImages(ctx context.Context, cli dockerClient) ([]types.ImageSummary, error) {
+	dockboxImages := make([]types.ImageSummary, 0)
+	listed := make(map[string]bool)
+	for _, filter := range []filters.Args{
+		filters.NewArgs(filters.Arg("label", LABEL_SOURCE)),
+		filters.NewArgs(filters.Arg("reference", PREFIX+"/*")),
+	} {
+		images, err := cli.ImageList(ctx, types.ImageListOptions{Filters: filter})
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			if !listed[image.ID] && isDockbox(image.Labels, image.RepoTags...) {
+				listed[image.ID] = true
+				dockboxImages = append(dockboxImages, image)
+			}
+		}
+	}
+	return dockboxImages, nil
+}
+
+// listDockboxContainers returns the containers of dockbox images
+func listDockboxContainers(ctx context.Context, cli dockerClient, options types.ContainerListOptions) ([]types.Container, error) {
+	containers, err := cli.ContainerList(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	dockboxContainers := make([]types.Container, 0)
+	for _, container := range containers {
+		if isDockbox(container.Labels, container.Image) {
+			dockboxContainers = append(dockboxContainers, container)
+		}
+	}
+	return dockboxContainers, nil
+}
+
+// getImageNameFromArg returns the image of a dockbox given either the path of
+// a directory containing a dockbox or the name of a dockbox
+func getImageNameFromArg(arg string) (string, error) {
+	if exists, _, _ := pathExists(filepath.Join(arg, HIDDEN_DIRECTORY, ".dockbox.yaml")); exists {
+		imageName, err := getConfigByKey(arg, "image")
+		if err != nil {
+			return "", err
+		}
+		if imageName == "" {
+			return "", errors.New("no image found for dockbox")
+		}
+		return imageName, nil
+	}
+	if isImageDockbox(arg) {
+		return arg, nil
+	}
+	return dockboxNameToImageName(arg), nil
 }
 
 func getConfigByKey(path string, key string) (string, error) {
@@ -82,10 +204,25 @@ func getConfigByKey(path string, key string) (string, error) {
 	return viper.GetString(key), nil
 }
 func setConfigKey(key string, value string, path string) error {
+	return writeConfig(path, map[string]string{key: value})
+}
+
+// writeConfig sets keys of the configuration of the dockbox at path, keeping its
+// other keys. A separate instance keeps these values from leaking into the
+// configuration of other dockboxes.
+func writeConfig(path string, values map[string]string) error {
 	configPath := filepath.Join(path, HIDDEN_DIRECTORY, ".dockbox.yaml")
-	viper.Set(key, value)
-	err := viper.WriteConfigAs(configPath)
-	return err
+	config := viper.New()
+	config.SetConfigFile(configPath)
+	if exists, _, _ := pathExists(configPath); exists {
+		if err := config.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+	for key, value := range values {
+		config.Set(key, value)
+	}
+	return config.WriteConfigAs(configPath)
 }
 
 func pathExists(path string) (bool, os.FileInfo, error) {
@@ -99,8 +236,86 @@ func pathExists(path string) (bool, os.FileInfo, error) {
 	return false, nil, err
 }
 
-func checkDockboxExists(ctx context.Context, cli dockerClient, name string) bool {
-	imageName := repoTagToDockboxName(name)
-	_, _, err := cli.ImageInspectWithRaw(ctx, imageName)
-	return err != nil
+// normalizePlatform validates a platform given as os[/arch[/variant]] and
+// returns it in its normalized form, e.g. "amd64" becomes "linux/amd64"
+func normalizePlatform(platform string) (string, error) {
+	if platform == "" {
+		return "", nil
+	}
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return "", err
+	}
+	return platforms.Format(p), nil
+}
+
+func parsePlatform(platform string) (*specs.Platform, error) {
+	if platform == "" {
+		return nil, nil
+	}
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// checkDockboxExists returns the image of the dockbox with the given name if
+// there is one. Errors other than the image not being found are returned.
+func checkDockboxExists(ctx context.Context, cli dockerClient, name string) (types.ImageInspect, bool, error) {
+	info, _, err := cli.ImageInspectWithRaw(ctx, dockboxNameToImageName(name))
+	if err == nil {
+		return info, true, nil
+	}
+	if client.IsErrNotFound(err) || strings.Contains(err.Error(), "No such image") {
+		return info, false, nil
+	}
+	return info, false, err
+}
+
+// validateDockboxName checks that name can be used in the dockbox/<name> repository
+// of an image, following Docker's reference grammar
+func validateDockboxName(name string) error {
+	if name == "" {
+		return errors.New("dockbox name cannot be empty")
+	}
+	if strings.ContainsAny(name, "/:@") {
+		return fmt.Errorf("invalid dockbox name %q: cannot contain '/', ':' or '@'", name)
+	}
+	if _, err := reference.ParseNormalizedNamed(dockboxNameToImageName(name)); err != nil {
+		return fmt.Errorf("invalid dockbox name %q: must only contain lowercase letters, digits and separators (., _, -) and start with a letter or digit", name)
+	}
+	return nil
+}
+
+var invalidNameCharacters = regexp.MustCompile(`[^a-z0-9._-]+`)
+var repeatedNameSeparators = regexp.MustCompile(`[._-]{2,}`)
+
+// sanitizeDockboxName turns a directory or repository name into a valid dockbox
+// name, e.g. My.Repo becomes my.repo
+func sanitizeDockboxName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".git")
+	name = invalidNameCharacters.ReplaceAllString(name, "-")
+	name = repeatedNameSeparators.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "._-")
+	if validateDockboxName(name) != nil {
+		return uuid.New().String()
+	}
+	return name
+}
+
+// parseAge parses a duration such as 12h, also accepting a number of days such as 30d
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration %q", age)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q", age)
+	}
+	return duration, nil
 }
@@ -0,0 +1,542 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/cli/cli/compose/loader"
+	composetypes "github.com/docker/cli/cli/compose/types"
+	"github.com/docker/cli/opts"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/go-connections/nat"
+)
+
+// Compose files looked for at the root of a repository, in order of preference
+var composeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// Shell the primary service of a compose project is entered with
+var composeShell = []string{"/bin/sh", "-c", "if command -v bash > /dev/null; then exec bash; else exec sh; fi"}
+
+// findComposeFile returns the name of the compose file of the repository at
+// dirPath, or an empty string if it does not have one
+func findComposeFile(dirPath string) string {
+	for _, name := range composeFileNames {
+		if exists, info, _ := pathExists(filepath.Join(dirPath, name)); exists && !info.IsDir() {
+			return name
+		}
+	}
+	return ""
+}
+
+// loadComposeProject loads the compose file fileName of the repository at dirPath.
+// Variables are interpolated from the environment and the .env file of the
+// repository, like docker compose does.
+func loadComposeProject(dirPath string, fileName string) (*composetypes.Config, error) {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(absPath, fileName))
+	if err != nil {
+		return nil, err
+	}
+	dict, err := loader.ParseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", fileName, err)
+	}
+	normalizeComposeDict(dict, fileName)
+
+	environment, err := composeEnvironment(absPath)
+	if err != nil {
+		return nil, err
+	}
+	// Files without a version follow the compose specification, which is not
+	// covered by the schemas of the loader
+	project, err := loader.Load(composetypes.ConfigDetails{
+		WorkingDir:  absPath,
+		ConfigFiles: []composetypes.ConfigFile{{Filename: fileName, Config: dict}},
+		Environment: environment,
+	}, func(options *loader.Options) { options.SkipValidation = true })
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", fileName, err)
+	}
+	if len(project.Services) == 0 {
+		return nil, fmt.Errorf("invalid %s: no services defined", fileName)
+	}
+	for _, service := range project.Services {
+		if service.Image == "" && service.Build.Context == "" {
+			return nil, fmt.Errorf("invalid %s: service %s has neither an image nor a build", fileName, service.Name)
+		}
+		for _, dependency := range service.DependsOn {
+			if _, ok := findComposeService(project, dependency); !ok {
+				return nil, fmt.Errorf("invalid %s: service %s depends on undefined service %s", fileName, service.Name, dependency)
+			}
+		}
+		// Like the mounts of a manifest, only folders of the repository are mounted
+		for _, serviceVolume := range service.Volumes {
+			if serviceVolume.Type != string(mount.TypeBind) {
+				continue
+			}
+			source, err := filepath.Rel(absPath, serviceVolume.Source)
+			if err == nil {
+				_, err = resolveMountSource(absPath, source)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: service %s: %s", fileName, service.Name, err)
+			}
+		}
+	}
+	return project, nil
+}
+
+// normalizeComposeDict converts the parts of a compose file written for older
+// versions or for the compose specification that the loader does not support
+func normalizeComposeDict(dict map[string]interface{}, fileName string) {
+	if version, _ := dict["version"].(string); !strings.HasPrefix(version, "3") {
+		dict["version"] = "3.9"
+	}
+	services, _ := dict["services"].(map[string]interface{})
+	for name, value := range services {
+		service, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// depends_on can map services to the condition they must reach
+		if dependsOn, ok := service["depends_on"].(map[string]interface{}); ok {
+			dependencies := make([]interface{}, 0, len(dependsOn))
+			for dependency := range dependsOn {
+				dependencies = append(dependencies, dependency)
+			}
+			service["depends_on"] = dependencies
+		}
+		for property := range composetypes.ForbiddenProperties {
+			if _, ok := service[property]; ok {
+				log.Printf("Warning: Ignoring %s of service %s in %s", property, name, fileName)
+				delete(service, property)
+			}
+		}
+	}
+}
+
+// composeEnvironment returns the variables compose files are interpolated with
+func composeEnvironment(dirPath string) (map[string]string, error) {
+	environment := make(map[string]string)
+	envFile := filepath.Join(dirPath, ".env")
+	if exists, _, _ := pathExists(envFile); exists {
+		variables, err := opts.ParseEnvFile(envFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, variable := range variables {
+			parts := strings.SplitN(variable, "=", 2)
+			environment[parts[0]] = parts[len(parts)-1]
+		}
+	}
+	for _, variable := range os.Environ() {
+		parts := strings.SplitN(variable, "=", 2)
+		environment[parts[0]] = parts[len(parts)-1]
+	}
+	return environment, nil
+}
+
+func findComposeService(project *composetypes.Config, name string) (composetypes.ServiceConfig, bool) {
+	for _, service := range project.Services {
+		if service.Name == name {
+			return service, true
+		}
+	}
+	return composetypes.ServiceConfig{}, false
+}
+
+// choosePrimaryService returns the service of the project that is entered: the
+// given one, or else the service built from the root of the repository at
+// dirPath, the first service built or the first service
+func choosePrimaryService(project *composetypes.Config, dirPath string, name string) (composetypes.ServiceConfig, error) {
+	if name != "" {
+		service, ok := findComposeService(project, name)
+		if !ok {
+			return service, fmt.Errorf("no service named %s in %s", name, project.Filename)
+		}
+		return service, nil
+	}
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return composetypes.ServiceConfig{}, err
+	}
+	services := make([]composetypes.ServiceConfig, len(project.Services))
+	copy(services, project.Services)
+	sort.SliceStable(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	for _, service := range services {
+		if service.Build.Context != "" && resolveBuildContext(absPath, service.Build.Context) == absPath {
+			return service, nil
+		}
+	}
+	for _, service := range services {
+		if service.Build.Context != "" {
+			return service, nil
+		}
+	}
+	return services[0], nil
+}
+
+// resolveBuildContext returns the absolute path of the build context of a service
+func resolveBuildContext(dirPath string, context string) string {
+	if filepath.IsAbs(context) {
+		return filepath.Clean(context)
+	}
+	return filepath.Join(dirPath, context)
+}
+
+// composeDependencies returns the services the service depends on, directly or
+// not, each after its own dependencies
+func composeDependencies(project *composetypes.Config, name string) ([]composetypes.ServiceConfig, error) {
+	dependencies := make([]composetypes.ServiceConfig, 0)
+	visited := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		for _, ancestor := range path {
+			if ancestor == name {
+				return fmt.Errorf("dependency cycle between services: %s", strings.Join(append(path, name), " -> "))
+			}
+		}
+		if visited[name] {
+			return nil
+		}
+		service, ok := findComposeService(project, name)
+		if !ok {
+			return fmt.Errorf("no service named %s in %s", name, project.Filename)
+		}
+		dependsOn := make([]string, len(service.DependsOn))
+		copy(dependsOn, service.DependsOn)
+		sort.Strings(dependsOn)
+		for _, dependency := range dependsOn {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visited[name] = true
+		if len(path) > 0 {
+			dependencies = append(dependencies, service)
+		}
+		return nil
+	}
+	return dependencies, visit(name, nil)
+}
+
+// composeServiceImage returns the image the container of a service is created
+// from. Services built by dockbox are tagged after the dockbox.
+func composeServiceImage(dockboxName string, service composetypes.ServiceConfig) string {
+	if service.Build.Context != "" {
+		return dockboxNameToImageName(dockboxName + ":" + service.Name)
+	}
+	return service.Image
+}
+
+func composeNetworkName(dockboxName string) string {
+	return dockboxName + "_default"
+}
+
+func composeContainerName(dockboxName string, service string) string {
+	return dockboxName + "_" + service
+}
+
+// buildComposeProject builds the images of the services of the compose project
+// of the dockbox at dirPath, returning the image of its primary service. The
+// primary service is built as the dockbox itself, or from a Dockerfile generated
+// for its image if it is not built. Other services are tagged with their name.
+func buildComposeProject(cli dockerClient, dirPath string, project *composetypes.Config, primary string, dockboxName string, source string, buildOptions BuildOptions) (string, error) {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return "", err
+	}
+	imageName := dockboxNameToImageName(dockboxName)
+	for _, service := range project.Services {
+		labels := dockboxLabels(dockboxName, source, dirPath, "")
+		if service.Name != primary {
+			if service.Build.Context == "" {
+				continue
+			}
+			labels[LABEL_SERVICE] = service.Name
+		}
+
+		contextPath, dockerFileName := absPath, ""
+		serviceBuildOptions := buildOptions
+		if service.Build.Context != "" {
+			contextPath = resolveBuildContext(absPath, service.Build.Context)
+			dockerFileName = service.Build.Dockerfile
+			if dockerFileName == "" {
+				dockerFileName = "Dockerfile"
+			}
+			serviceBuildOptions.buildArgs = append(composeBuildArgs(service.Build.Args), buildOptions.buildArgs...)
+			if service.Build.Target != "" && buildOptions.target == "" {
+				serviceBuildOptions.target = service.Build.Target
+			}
+		} else {
+			log.Printf("Service %s is not built, generating a Dockerfile from %s...", service.Name, service.Image)
+			dockerFileName, err = createDockerFileForLanguage(absPath, Image{Image: service.Image})
+			if err != nil {
+				return "", err
+			}
+		}
+
+		name := dockboxName
+		if service.Name != primary {
+			name = dockboxName + ":" + service.Name
+		}
+		log.Printf("Building service %s of dockbox %s...", service.Name, dockboxName)
+		if _, err := buildImage(cli, contextPath, dockerFileName, name, labels, serviceBuildOptions); err != nil {
+			return "", fmt.Errorf("failed to build service %s: %s", service.Name, err)
+		}
+	}
+	return imageName, nil
+}
+
+func composeBuildArgs(args composetypes.MappingWithEquals) []string {
+	buildArgs := make([]string, 0, len(args))
+	for key, value := range args {
+		if value != nil {
+			buildArgs = append(buildArgs, key+"="+*value)
+		}
+	}
+	sort.Strings(buildArgs)
+	return buildArgs
+}
+
+// loadDockboxComposeProject loads the compose project the dockbox at dirPath was
+// created from, returning a nil project if it was not created from one
+func loadDockboxComposeProject(dirPath string) (*composetypes.Config, composetypes.ServiceConfig, error) {
+	fileName, err := getConfigByKey(dirPath, "compose")
+	if err != nil || fileName == "" {
+		return nil, composetypes.ServiceConfig{}, err
+	}
+	serviceName, err := getConfigByKey(dirPath, "service")
+	if err != nil {
+		return nil, composetypes.ServiceConfig{}, err
+	}
+	project, err := loadComposeProject(dirPath, fileName)
+	if err != nil {
+		return nil, composetypes.ServiceConfig{}, err
+	}
+	primary, err := choosePrimaryService(project, dirPath, serviceName)
+	return project, primary, err
+}
+
+// applyComposeService sets the environment, ports, mounts and network of the
+// primary service of the compose project of the dockbox at dirPath on its
+// container, which is entered with a shell. The host configuration is nil if
+// the dockbox was not created from a compose project.
+func applyComposeService(ctx context.Context, cli dockerClient, dirPath string, dockboxName string, config *container.Config) (*container.HostConfig, *network.NetworkingConfig, error) {
+	project, primary, err := loadDockboxComposeProject(dirPath)
+	if err != nil || project == nil {
+		return nil, nil, err
+	}
+	hostConfig, networkingConfig, err := configureComposeService(ctx, cli, project, primary, dockboxName, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Entrypoint = strslice.StrSlice(composeShell)
+	config.Cmd = nil
+	return hostConfig, networkingConfig, nil
+}
+
+// configureComposeService sets the settings of a service on the configuration of
+// its container, joining it to the network of the dockbox under its name
+func configureComposeService(ctx context.Context, cli dockerClient, project *composetypes.Config, service composetypes.ServiceConfig, dockboxName string, config *container.Config) (*container.HostConfig, *network.NetworkingConfig, error) {
+	networkName, err := ensureComposeNetwork(ctx, cli, dockboxName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Labels == nil {
+		config.Labels = make(map[string]string)
+	}
+	config.Labels[LABEL_NAME] = dockboxName
+	config.Labels[LABEL_SERVICE] = service.Name
+	for key, value := range service.Environment {
+		if value != nil {
+			config.Env = append(config.Env, key+"="+*value)
+		}
+	}
+	sort.Strings(config.Env)
+	config.WorkingDir = service.WorkingDir
+	config.User = service.User
+	if len(service.Entrypoint) > 0 {
+		config.Entrypoint = strslice.StrSlice(service.Entrypoint)
+	}
+	if len(service.Command) > 0 {
+		config.Cmd = strslice.StrSlice(service.Command)
+	}
+
+	hostConfig := &container.HostConfig{NetworkMode: container.NetworkMode(networkName)}
+	config.ExposedPorts = nat.PortSet{}
+	hostConfig.PortBindings = nat.PortMap{}
+	for _, port := range service.Ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		containerPort, err := nat.NewPort(protocol, fmt.Sprint(port.Target))
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ExposedPorts[containerPort] = struct{}{}
+		binding := nat.PortBinding{}
+		if port.Published != 0 {
+			binding.HostPort = fmt.Sprint(port.Published)
+		}
+		hostConfig.PortBindings[containerPort] = append(hostConfig.PortBindings[containerPort], binding)
+	}
+
+	for _, serviceVolume := range service.Volumes {
+		m := mount.Mount{Type: mount.Type(serviceVolume.Type), Source: serviceVolume.Source, Target: serviceVolume.Target, ReadOnly: serviceVolume.ReadOnly}
+		if m.Type == mount.TypeVolume && m.Source != "" {
+			projectVolume := project.Volumes[m.Source]
+			if projectVolume.External.External {
+				if projectVolume.Name != "" {
+					m.Source = projectVolume.Name
+				}
+			} else {
+				if m.Source, err = createDockboxVolume(ctx, cli, dockboxName, m.Source); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, m)
+	}
+
+	networkingConfig := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{
+		networkName: {Aliases: []string{service.Name}},
+	}}
+	return hostConfig, networkingConfig, nil
+}
+
+// ensureComposeNetwork creates the network the services of a dockbox reach each
+// other on, unless it already exists
+func ensureComposeNetwork(ctx context.Context, cli dockerClient, dockboxName string) (string, error) {
+	networkName := composeNetworkName(dockboxName)
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: filters.NewArgs(filters.Arg("name", networkName))})
+	if err != nil {
+		return "", err
+	}
+	for _, n := range networks {
+		// The name filter also matches networks whose name contains networkName
+		if n.Name == networkName {
+			return networkName, nil
+		}
+	}
+	_, err = cli.NetworkCreate(ctx, networkName, types.NetworkCreate{
+		CheckDuplicate: true,
+		Labels:         map[string]string{LABEL_NAME: dockboxName},
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created network: %s\n", networkName)
+	return networkName, nil
+}
+
+// startComposeServices starts the services the primary service of the dockbox at
+// dirPath depends on, creating their containers if needed
+func startComposeServices(ctx context.Context, cli dockerClient, dirPath string) error {
+	project, primary, err := loadDockboxComposeProject(dirPath)
+	if err != nil || project == nil {
+		return err
+	}
+	imageName, err := getConfigByKey(dirPath, "image")
+	if err != nil {
+		return err
+	}
+	dockboxName := imageToDockboxName(imageName)
+	dependencies, err := composeDependencies(project, primary.Name)
+	if err != nil {
+		return err
+	}
+	for _, service := range dependencies {
+		if err := startComposeService(ctx, cli, project, service, dockboxName); err != nil {
+			return fmt.Errorf("failed to start service %s: %s", service.Name, err)
+		}
+	}
+	return nil
+}
+
+func startComposeService(ctx context.Context, cli dockerClient, project *composetypes.Config, service composetypes.ServiceConfig, dockboxName string) error {
+	containerName := composeContainerName(dockboxName, service.Name)
+	if info, err := cli.ContainerInspect(ctx, containerName); err == nil {
+		if info.State != nil && info.State.Running {
+			return nil
+		}
+		log.Printf("Starting service %s...", service.Name)
+		return cli.ContainerStart(ctx, containerName, types.ContainerStartOptions{})
+	}
+
+	imageName := composeServiceImage(dockboxName, service)
+	if service.Build.Context == "" {
+		if err := ensureImage(ctx, cli, imageName); err != nil {
+			return err
+		}
+	}
+	config := &container.Config{Image: imageName}
+	hostConfig, networkingConfig, err := configureComposeService(ctx, cli, project, service, dockboxName, config)
+	if err != nil {
+		return err
+	}
+	hostConfig.RestartPolicy = container.RestartPolicy{Name: "unless-stopped"}
+	if _, err := cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, containerName); err != nil {
+		return err
+	}
+	log.Printf("Starting service %s...", service.Name)
+	return cli.ContainerStart(ctx, containerName, types.ContainerStartOptions{})
+}
+
+// ensureImage pulls an image unless it is already present
+func ensureImage(ctx context.Context, cli dockerClient, imageName string) error {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, imageName); err == nil {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return fmt.Errorf("invalid image %q: %s", imageName, err)
+	}
+	named = reference.TagNameOnly(named)
+	auth, err := registryAuth(named, "")
+	if err != nil {
+		return err
+	}
+	refName := reference.FamiliarString(named)
+	log.Printf("Pulling %s...", refName)
+	body, err := cli.ImagePull(ctx, refName, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := printTransferProgress(body); err != nil {
+		return fmt.Errorf("failed to pull %s: %s", refName, err)
+	}
+	return nil
+}
+
+// removeComposeServices removes the containers of the services of the dockbox
+// built by dockbox, so that they are created again from their new images
+func removeComposeServices(ctx context.Context, cli dockerClient, project *composetypes.Config, primary string, dockboxName string) error {
+	for _, service := range project.Services {
+		if service.Name == primary || service.Build.Context == "" {
+			continue
+		}
+		err := removeContainer(ctx, cli, composeContainerName(dockboxName, service.Name))
+		if err != nil && !strings.Contains(err.Error(), "No such container") {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+const testComposeFile = `services:
+  app:
+    build: .
+    ports:
+      - "8000:8000"
+    environment:
+      DATABASE_URL: postgres://postgres:${DB_PASSWORD}@db/app
+    volumes:
+      - .:/app
+    depends_on:
+      - db
+      - cache
+  worker:
+    build:
+      context: ./worker
+      args:
+        MODE: worker
+    depends_on:
+      db:
+        condition: service_healthy
+  db:
+    image: postgres:13
+    mem_limit: 512m
+    environment:
+      - POSTGRES_PASSWORD=${DB_PASSWORD}
+    volumes:
+      - dbdata:/var/lib/postgresql/data
+  cache:
+    image: redis:6
+    command: redis-server --appendonly yes
+volumes:
+  dbdata:
+`
+
+// newComposeTestFolder returns a repository holding the given compose file and a .env file
+func newComposeTestFolder(t *testing.T, composeFile string) string {
+	return newTestFolder(t, map[string]string{
+		"worker/":            "",
+		"docker-compose.yml": composeFile,
+		".env":               "DB_PASSWORD=secret\n",
+	})
+}
+
+func TestLoadComposeProject(t *testing.T) {
+	dirPath := newComposeTestFolder(t, testComposeFile)
+	assert.Equal(t, "docker-compose.yml", findComposeFile(dirPath))
+	assert.Equal(t, "", findComposeFile(t.TempDir()))
+
+	project, err := loadComposeProject(dirPath, "docker-compose.yml")
+	assert.Nil(t, err)
+	db, ok := findComposeService(project, "db")
+	assert.True(t, ok)
+	assert.Equal(t, "secret", *db.Environment["POSTGRES_PASSWORD"])
+	worker, _ := findComposeService(project, "worker")
+	assert.Equal(t, []string{"db"}, worker.DependsOn)
+
+	primary, err := choosePrimaryService(project, dirPath, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "app", primary.Name)
+	primary, err = choosePrimaryService(project, dirPath, "worker")
+	assert.Nil(t, err)
+	assert.Equal(t, "worker", primary.Name)
+	_, err = choosePrimaryService(project, dirPath, "web")
+	assert.EqualError(t, err, "no service named web in docker-compose.yml")
+
+	dependencies, err := composeDependencies(project, "app")
+	assert.Nil(t, err)
+	names := make([]string, len(dependencies))
+	for i, service := range dependencies {
+		names[i] = service.Name
+	}
+	assert.Equal(t, []string{"cache", "db"}, names)
+}
+
+func TestLoadComposeProjectErrors(t *testing.T) {
+	testcases := []struct {
+		name          string
+		composeFile   string
+		expectedError string
+	}{
+		{
+			name:          "NoServices",
+			composeFile:   "services: {}\n",
+			expectedError: "invalid docker-compose.yml: no services defined",
+		},
+		{
+			name:          "NoImage",
+			composeFile:   "services:\n  app:\n    ports: [\"80\"]\n",
+			expectedError: "invalid docker-compose.yml: service app has neither an image nor a build",
+		},
+		{
+			name:          "UndefinedDependency",
+			composeFile:   "services:\n  app:\n    build: .\n    depends_on: [db]\n",
+			expectedError: "invalid docker-compose.yml: service app depends on undefined service db",
+		},
+		{
+			name:          "NotAMapping",
+			composeFile:   "- app\n",
+			expectedError: "invalid docker-compose.yml: Top-level object must be a mapping",
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := newComposeTestFolder(t, test.composeFile)
+			_, err := loadComposeProject(dirPath, "docker-compose.yml")
+			assert.EqualError(t, err, test.expectedError)
+		})
+	}
+
+	// Only folders of the repository can be mounted
+	for _, source := range []string{"/", "../.."} {
+		dirPath := newComposeTestFolder(t, "services:\n  app:\n    build: .\n    volumes: [\""+source+":/host\"]\n")
+		mounted := source
+		if !filepath.IsAbs(source) {
+			mounted = filepath.Join(dirPath, source)
+		}
+		_, err := loadComposeProject(dirPath, "docker-compose.yml")
+		assert.EqualError(t, err, "invalid docker-compose.yml: service app: mounted folder "+mounted+" is outside of the dockbox")
+	}
+
+	dirPath := newComposeTestFolder(t, "services:\n  app:\n    build: .\n    depends_on: [db]\n  db:\n    image: postgres:13\n    depends_on: [app]\n")
+	project, err := loadComposeProject(dirPath, "docker-compose.yml")
+	assert.Nil(t, err)
+	_, err = composeDependencies(project, "app")
+	assert.EqualError(t, err, "dependency cycle between services: app -> db -> app")
+}
+
+// composeTestClient stands in for a daemon running the services of a dockbox
+type composeTestClient struct {
+	*fakeDockerClient
+	images     map[string]bool
+	networks   []string
+	volumes    []string
+	pulled     []string
+	containers map[string]*container.Config
+	hosts      map[string]*container.HostConfig
+	endpoints  map[string]*network.NetworkingConfig
+	started    []string
+}
+
+func newComposeTestClient(t *testing.T) *composeTestClient {
+	cli := &composeTestClient{
+		images:     map[string]bool{"postgres:13": true, "dockbox/app1": true},
+		containers: map[string]*container.Config{},
+		hosts:      map[string]*container.HostConfig{},
+		endpoints:  map[string]*network.NetworkingConfig{},
+	}
+	cli.fakeDockerClient = &fakeDockerClient{
+		imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+			if !cli.images[imageID] {
+				return types.ImageInspect{}, nil, errors.New("Error: No such image: " + imageID)
+			}
+			return types.ImageInspect{ID: imageID}, nil, nil
+		},
+		imagePull: func(c context.Context, refStr string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			cli.pulled = append(cli.pulled, refStr)
+			cli.images[refStr] = true
+			return ioutil.NopCloser(strings.NewReader(`{"status":"Downloaded newer image for ` + refStr + `"}`)), nil
+		},
+		networkList: func(c context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+			networks := make([]types.NetworkResource, 0)
+			for _, name := range cli.networks {
+				if options.Filters.Match("name", name) {
+					networks = append(networks, types.NetworkResource{Name: name})
+				}
+			}
+			return networks, nil
+		},
+		networkCreate: func(c context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+			assert.Equal(t, map[string]string{LABEL_NAME: "app1"}, options.Labels)
+			cli.networks = append(cli.networks, name)
+			return types.NetworkCreateResponse{ID: name + "_id"}, nil
+		},
+		volumeCreate: func(c context.Context, options volume.VolumeCreateBody) (types.Volume, error) {
+			assert.Equal(t, map[string]string{LABEL_NAME: "app1"}, options.Labels)
+			cli.volumes = append(cli.volumes, options.Name)
+			return types.Volume{Name: options.Name, Labels: options.Labels}, nil
+		},
+		containerInspect: func(c context.Context, containerID string) (types.ContainerJSON, error) {
+			if _, ok := cli.containers[containerID]; !ok {
+				return types.ContainerJSON{}, errors.New("Error: No such container: " + containerID)
+			}
+			running := false
+			for _, started := range cli.started {
+				running = running || started == containerID
+			}
+			return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Running: running}}}, nil
+		},
+		containerCreate: func(c context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+			if containerName == "" {
+				containerName = "app1_ctr"
+			}
+			cli.containers[containerName] = config
+			cli.hosts[containerName] = hostConfig
+			cli.endpoints[containerName] = networkingConfig
+			return container.ContainerCreateCreatedBody{ID: containerName}, nil
+		},
+		containerStart: func(c context.Context, containerID string, options types.ContainerStartOptions) error {
+			cli.started = append(cli.started, containerID)
+			return nil
+		},
+	}
+	return cli
+}
+
+func TestComposeContainers(t *testing.T) {
+	dirPath := newComposeTestFolder(t, testComposeFile)
+	assert.Nil(t, writeConfig(dirPath, map[string]string{"image": "dockbox/app1", "compose": "docker-compose.yml", "service": "app", "container": ""}))
+	cli := newComposeTestClient(t)
+
+	assert.Nil(t, startComposeServices(context.Background(), cli, dirPath))
+	assert.Equal(t, []string{"redis:6"}, cli.pulled)
+	assert.Equal(t, []string{"app1_default"}, cli.networks)
+	assert.Equal(t, []string{"app1_cache", "app1_db"}, cli.started)
+	assert.Equal(t, []string{"app1_dbdata"}, cli.volumes)
+
+	db := cli.containers["app1_db"]
+	assert.Equal(t, "postgres:13", db.Image)
+	assert.Equal(t, []string{"POSTGRES_PASSWORD=secret"}, db.Env)
+	assert.Equal(t, map[string]string{LABEL_NAME: "app1", LABEL_SERVICE: "db"}, db.Labels)
+	assert.Equal(t, []mount.Mount{{Type: mount.TypeVolume, Source: "app1_dbdata", Target: "/var/lib/postgresql/data"}}, cli.hosts["app1_db"].Mounts)
+	assert.Equal(t, container.NetworkMode("app1_default"), cli.hosts["app1_db"].NetworkMode)
+	assert.Equal(t, []string{"db"}, cli.endpoints["app1_db"].EndpointsConfig["app1_default"].Aliases)
+	assert.Equal(t, strslice.StrSlice{"redis-server", "--appendonly", "yes"}, cli.containers["app1_cache"].Cmd)
+
+	// The primary service is entered with a shell
+	containerID, err := createContainerFromPath(context.Background(), cli, dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "app1_ctr", containerID)
+	app := cli.containers["app1_ctr"]
+	assert.Equal(t, "dockbox/app1", app.Image)
+	assert.Equal(t, strslice.StrSlice(composeShell), app.Entrypoint)
+	assert.Equal(t, []string{"DATABASE_URL=postgres://postgres:secret@db/app"}, app.Env)
+	assert.Equal(t, nat.PortMap{"8000/tcp": {{HostPort: "8000"}}}, cli.hosts["app1_ctr"].PortBindings)
+	assert.Equal(t, []mount.Mount{{Type: mount.TypeBind, Source: dirPath, Target: "/app"}}, cli.hosts["app1_ctr"].Mounts)
+	assert.Equal(t, []string{"app"}, cli.endpoints["app1_ctr"].EndpointsConfig["app1_default"].Aliases)
+	assert.Equal(t, []string{"app1_default"}, cli.networks, "the network must only be created once")
+	assert.Equal(t, "app1_ctr", readTestConfig(t, dirPath).GetString("container"))
+
+	// Services already running are left alone
+	assert.Nil(t, startComposeServices(context.Background(), cli, dirPath))
+	assert.Equal(t, []string{"app1_cache", "app1_db"}, cli.started)
+}
+
+func TestCleanIncludesComposeServices(t *testing.T) {
+	labels := map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_NAME: "app1"}
+	serviceLabels := map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_NAME: "app1", LABEL_SERVICE: "worker"}
+	service := types.ImageSummary{ID: "sha256:app1worker", RepoTags: []string{"dockbox/app1:worker"}, Created: 1626748400, Labels: serviceLabels}
+	serviceContainers := []types.Container{
+		{ID: "app1_db_ctr", ImageID: "sha256:postgres", Image: "postgres:13", Labels: map[string]string{LABEL_NAME: "app1", LABEL_SERVICE: "db"}},
+		// Images built from the dockbox inherit its labels
+		{ID: "derived_ctr", ImageID: "sha256:derived", Image: "derived", Labels: labels},
+	}
+
+	cli := newCleanTestClient(t)
+	imageList, imageHistory, imageInspectWithRaw, containerList := cli.imageList, cli.imageHistory, cli.imageInspectWithRaw, cli.containerList
+	cli.imageList = func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+		images, err := imageList(c, ilo)
+		for i := range images {
+			if images[i].ID == "sha256:app1" {
+				images[i].Labels = labels
+			}
+		}
+		return append(images, filterImagesByLabel([]types.ImageSummary{service}, ilo)...), err
+	}
+	cli.imageHistory = func(c context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+		if imageID == service.ID {
+			return []image.HistoryResponseItem{{ID: service.ID, Created: service.Created, Tags: service.RepoTags}}, nil
+		}
+		return imageHistory(c, imageID)
+	}
+	cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+		info, raw, err := imageInspectWithRaw(c, imageID)
+		if err == nil && info.ID == "sha256:app1" {
+			info.Config.Labels = labels
+		}
+		return info, raw, err
+	}
+	cli.containerList = func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
+		containers, err := containerList(c, clo)
+		return append(containers, filterContainersByLabel(serviceContainers, clo)...), err
+	}
+
+	targetIDs, _, err := selectCleanTargets(context.Background(), cli, CleanOptions{args: []string{"app1"}, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app1worker"}, targetIDs)
+
+	plan := &cleanPlan{dockboxes: []*ImageNode{{ID: "sha256:app1", name: "app1"}}}
+	assert.Nil(t, planCleanResources(context.Background(), cli, plan, nil))
+	assert.Equal(t, []string{"app1_db_ctr"}, plan.containers)
+	assert.Equal(t, []string{"app1_data"}, plan.volumes)
+}
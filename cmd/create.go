@@ -16,7 +16,6 @@ limitations under the License.
 package cmd
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -30,19 +29,15 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 
-	"github.com/spf13/viper"
-
 	"github.com/karrick/godirwalk"
 
 	// "github.com/mitchellh/go-homedir"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/pkg/archive"
-
 	getter "github.com/hashicorp/go-getter"
 )
 
@@ -70,14 +65,25 @@ func NewCreateCommand(cli dockerClient) *cobra.Command {
 			CheckError(RunCreateCommand(cli, createOptions))
 		},
 	}
-	// createCmd.PersistentFlags().StringVarP(&createOptions.dockerFile, "dockerfile", "d", "", "Use this option to set a dockerfile")
+	createCmd.PersistentFlags().StringVarP(&createOptions.dockboxName, "name", "n", "", "Name of the dockbox (defaults to the name of the directory or repository)")
+	addBuildFlags(createCmd, &createOptions.build)
+	createCmd.PersistentFlags().StringVarP(&createOptions.dockerFile, "dockerfile", "d", "", "Path of the Dockerfile to build, relative to the dockbox (skips the Dockerfile search)")
+	createCmd.PersistentFlags().StringVarP(&createOptions.service, "service", "s", "", "Service of the compose file to enter (defaults to the service built from the root of the repository)")
 	// createCmd.PersistentFlags().BoolVarP(&createOptions.remove, "remove", "r", false, "Removes code and artifacts after completion")
 	// createCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
 	return createCmd
 }
 
 func RunCreateCommand(cli dockerClient, createOptions CreateOptions) error {
+	platform, err := normalizePlatform(createOptions.build.platform)
+	if err != nil {
+		return err
+	}
+	createOptions.build.platform = platform
+
 	dockboxName := ""
+	source := createOptions.source
+	fetchSource := false
 	// User passed in a file path
 	if exists, info, _ := pathExists(createOptions.source); exists {
 		if !info.IsDir() {
@@ -95,12 +101,10 @@ func RunCreateCommand(cli dockerClient, createOptions CreateOptions) error {
 			return err
 		}
 		log.Printf("Given cleaned source %s %s\n", createOptions.source, abs)
+		source = abs
 
 		dockboxName = filepath.Base(abs)
 		log.Printf("Using directory %s\n", dockboxName)
-		if dockboxName == "/" {
-			dockboxName = uuid.New().String()
-		}
 		createOptions.destPath = createOptions.source
 
 	} else {
@@ -111,14 +115,23 @@ func RunCreateCommand(cli dockerClient, createOptions CreateOptions) error {
 		if createOptions.destPath == "" {
 			createOptions.destPath = "./" + dockboxName
 		}
-		fmt.Println("Fetching data from source...")
-		getRepositoryData(createOptions.source, createOptions.destPath)
-		fmt.Println("Successfully retrieved data from source")
+		fetchSource = true
 	}
 
 	if createOptions.dockboxName == "" {
-		// TODO: use this value
-		createOptions.dockboxName = dockboxName
+		createOptions.dockboxName = sanitizeDockboxName(dockboxName)
+	} else if err := validateDockboxName(createOptions.dockboxName); err != nil {
+		return err
+	}
+	createOptions.dockboxName, err = resolveDockboxName(context.Background(), cli, createOptions.dockboxName, createOptions.destPath)
+	if err != nil {
+		return err
+	}
+
+	if fetchSource {
+		fmt.Println("Fetching data from source...")
+		getRepositoryData(createOptions.source, createOptions.destPath)
+		fmt.Println("Successfully retrieved data from source")
 	}
 
 	// Data is now at createOptions.destPath
@@ -126,28 +139,75 @@ func RunCreateCommand(cli dockerClient, createOptions CreateOptions) error {
 	os.Mkdir(path.Join(createOptions.destPath, HIDDEN_DIRECTORY), 0755)
 
 	log.Println("Creating dockbox...")
-	dockerFileName, err := getDockerfile(createOptions.destPath)
-	log.Printf("Using Dockerfile at: %s\n", dockerFileName)
-	if err != nil {
-		return err
+	config := map[string]string{"platform": createOptions.build.platform, "compose": "", "service": ""}
+	imageName := ""
+	composeFile := findComposeFile(createOptions.destPath)
+	// A manifest or devcontainer.json takes precedence over the compose file
+	useCompose := composeFile != "" && createOptions.dockerFile == ""
+	if useCompose {
+		manifest, err := readProjectManifest(createOptions.destPath)
+		if err != nil {
+			return err
+		}
+		useCompose = manifest == nil
 	}
+	if useCompose {
+		log.Printf("Found %s in repository! Using it to create dockbox...\n", composeFile)
+		project, err := loadComposeProject(createOptions.destPath, composeFile)
+		if err != nil {
+			return err
+		}
+		primary, err := choosePrimaryService(project, createOptions.destPath, createOptions.service)
+		if err != nil {
+			return err
+		}
+		log.Printf("Building dockbox at %s with primary service %s...", createOptions.destPath, primary.Name)
+		imageName, err = buildComposeProject(cli, createOptions.destPath, project, primary.Name, createOptions.dockboxName, source, createOptions.build)
+		if err != nil {
+			return err
+		}
+		config["compose"] = composeFile
+		config["service"] = primary.Name
+		config["Dockerfile"] = ""
+		config["language"] = ""
+	} else {
+		if createOptions.service != "" {
+			return errors.New("--service requires a compose file in the repository")
+		}
+		dockerFileName, language, buildOptions := createOptions.dockerFile, "", createOptions.build
+		if dockerFileName != "" {
+			dockerFileName, err = resolveDockerfileFlag(createOptions.destPath, dockerFileName)
+		} else {
+			dockerFileName, language, err = getDockerfile(createOptions.destPath)
+			if err == nil {
+				buildOptions, err = devcontainerBuildOptions(createOptions.destPath, buildOptions)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Using Dockerfile at: %s\n", dockerFileName)
 
-	log.Printf("Building dockbox at %s...", createOptions.destPath)
-	imageName, err := buildImage(cli, createOptions.destPath, dockerFileName, createOptions.dockboxName)
-	if err != nil {
-		return err
+		log.Printf("Building dockbox at %s...", createOptions.destPath)
+		labels := dockboxLabels(createOptions.dockboxName, source, createOptions.destPath, language)
+		imageName, err = buildGeneratedImage(cli, createOptions.destPath, dockerFileName, createOptions.dockboxName, labels, buildOptions, language)
+		if err != nil {
+			return err
+		}
+		config["Dockerfile"] = dockerFileName
+		config["language"] = language
 	}
 	log.Printf("Successfully created new dockbox: %s\n", imageName)
 
-	viper.Set("image", imageName)
-	viper.Set("Dockerfile", dockerFileName)
-	configPath := path.Join(createOptions.destPath, HIDDEN_DIRECTORY, ".dockbox.yaml")
-	err = viper.WriteConfigAs(configPath)
-	if err != nil {
+	config["image"] = imageName
+	if err := writeConfig(createOptions.destPath, config); err != nil {
 		return err
 	}
-	log.Printf("Wrote config to %s\n", configPath)
+	log.Printf("Wrote config to %s\n", path.Join(createOptions.destPath, HIDDEN_DIRECTORY, ".dockbox.yaml"))
 
+	if err := startComposeServices(context.Background(), cli, createOptions.destPath); err != nil {
+		return err
+	}
 	containerID, err := createContainerFromPath(context.Background(), cli, createOptions.destPath)
 	if err != nil {
 		return err
@@ -163,6 +223,66 @@ func RunCreateCommand(cli dockerClient, createOptions CreateOptions) error {
 	return err
 }
 
+// resolveDockboxName checks whether another dockbox already uses name, and if
+// so asks the user whether to overwrite it, rename the new dockbox or add a suffix
+func resolveDockboxName(ctx context.Context, cli dockerClient, name string, dirPath string) (string, error) {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return "", err
+	}
+	for {
+		info, exists, err := checkDockboxExists(ctx, cli, name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+		labels := map[string]string{}
+		if info.Config != nil && info.Config.Labels != nil {
+			labels = info.Config.Labels
+		}
+		if labels[LABEL_PATH] == absPath {
+			// Recreating the same dockbox
+			return name, nil
+		}
+
+		fmt.Printf("A dockbox named %s already exists (source: %s)\n", name, labels[LABEL_SOURCE])
+		choice, err := GetUserString("Would you like to [o]verwrite it, [r]ename the new dockbox or add a [s]uffix? ")
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToLower(choice) {
+		case "o", "overwrite":
+			return name, nil
+		case "r", "rename":
+			newName, err := GetUserString("New name for the dockbox: ")
+			if err != nil {
+				return "", err
+			}
+			if err := validateDockboxName(newName); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			name = newName
+		case "s", "suffix":
+			for i := 2; ; i++ {
+				suffixed := fmt.Sprintf("%s-%d", name, i)
+				_, exists, err := checkDockboxExists(ctx, cli, suffixed)
+				if err != nil {
+					return "", err
+				}
+				if !exists {
+					log.Printf("Using name %s for new dockbox", suffixed)
+					return suffixed, nil
+				}
+			}
+		default:
+			fmt.Println("Please enter 'o', 'r' or 's'")
+		}
+	}
+}
+
 func getRepositoryData(url string, dest string) {
 	if strings.Contains(url, "github") || strings.Contains(url, "gitlab") && !strings.HasPrefix(url, "git::") {
 		url = "git::" + url
@@ -195,31 +315,169 @@ func getRepositoryData(url string, dest string) {
 	// })
 }
 
-func getDockerfile(dirPath string) (string, error) {
+// getDockerfile returns the path of the Dockerfile to build relative to dirPath,
+// generating one from the manifest of the repository, or if it has neither a
+// manifest nor a Dockerfile, from its language. If a Dockerfile was generated
+// for a language, the language is returned too.
+func getDockerfile(dirPath string) (string, string, error) {
+	if dockerFileName, err := generateDockerfileFromManifest(dirPath); dockerFileName != "" || err != nil {
+		return dockerFileName, "", err
+	}
 	if _, err := os.Stat(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".Dockerfile.dockbox")); err == nil {
-		return filepath.Join(HIDDEN_DIRECTORY, ".Dockerfile.dockbox"), nil
+		return filepath.Join(HIDDEN_DIRECTORY, ".Dockerfile.dockbox"), "", nil
+	}
+	candidates, ambiguous, err := findDockerfiles(dirPath)
+	if err != nil {
+		return "", "", err
+	}
+	if len(candidates) > 0 {
+		dockerFileName := candidates[0]
+		if ambiguous {
+			dockerFileName, err = chooseDockerfile(candidates)
+			if err != nil {
+				return "", "", err
+			}
+		}
+		if dockerFileName != "" {
+			log.Printf("Found a Dockerfile in cloned repository! Using '%s' to create dockbox...\n", dockerFileName)
+			return dockerFileName, "", nil
+		}
 	}
+
+	log.Println("Could not find a Dockerfile in the repository. Generating one for you...")
+	return generateDockerfile(dirPath)
+
+}
+
+// resolveDockerfileFlag returns the path of the Dockerfile given with --dockerfile
+// relative to the dockbox at dirPath, as it must be part of the build context
+func resolveDockerfileFlag(dirPath string, dockerFileName string) (string, error) {
+	absDir, err := filepath.Abs(dirPath)
+	if err != nil {
+		return "", err
+	}
+	absFile := dockerFileName
+	if !filepath.IsAbs(absFile) {
+		absFile = filepath.Join(absDir, dockerFileName)
+	}
+	if !isWithinDir(absDir, absFile) {
+		return "", fmt.Errorf("Dockerfile %s must be inside the dockbox folder %s", dockerFileName, dirPath)
+	}
+	relPath, err := filepath.Rel(absDir, absFile)
+	if err != nil {
+		return "", err
+	}
+	if exists, info, _ := pathExists(absFile); !exists || info.IsDir() {
+		return "", fmt.Errorf("no Dockerfile found at %s in %s", relPath, dirPath)
+	}
+	return relPath, nil
+}
+
+// Folders that never hold the Dockerfile of a repository
+var ignoredDockerfileFolders = map[string]bool{HIDDEN_DIRECTORY: true, ".git": true, "node_modules": true, "vendor": true}
+
+// Extensions of documentation that mention Dockerfiles, such as Dockerfile.md
+var documentationExtensions = map[string]bool{".md": true, ".txt": true, ".rst": true, ".adoc": true}
+
+// dockerfileRank returns how likely a file is to be the Dockerfile of a
+// repository: an exact Dockerfile ranks first, then variants such as
+// Dockerfile.dev or app.Dockerfile. Other files rank -1.
+func dockerfileRank(name string) int {
+	lower := strings.ToLower(name)
+	if documentationExtensions[filepath.Ext(lower)] {
+		return -1
+	}
+	if lower == "dockerfile" {
+		return 0
+	}
+	if strings.HasPrefix(lower, "dockerfile.") || strings.HasSuffix(lower, ".dockerfile") {
+		return 1
+	}
+	return -1
+}
+
+// findDockerfiles returns the Dockerfiles of the repository at dirPath relative
+// to it, best first. Dockerfiles at the root of the repository come before those
+// of its immediate subfolders, such as docker/Dockerfile. The result is ambiguous
+// if the best candidates rank the same.
+func findDockerfiles(dirPath string) ([]string, bool, error) {
+	type candidate struct {
+		name string
+		rank int
+	}
+	candidates := make([]candidate, 0)
 	files, err := ioutil.ReadDir(dirPath)
-	CheckError(err)
-	r, _ := regexp.Compile("(?i)(dockerfile)")
+	if err != nil {
+		return nil, false, err
+	}
 	for _, f := range files {
-		if !f.IsDir() && r.MatchString(f.Name()) {
-			log.Printf("Found a Dockerfile in cloned repository! Using '%s' to create dockbox...\n", f.Name())
-			return f.Name(), nil
+		if !f.IsDir() {
+			if rank := dockerfileRank(f.Name()); rank >= 0 {
+				candidates = append(candidates, candidate{f.Name(), rank})
+			}
+			continue
+		}
+		if ignoredDockerfileFolders[f.Name()] || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		subFiles, err := ioutil.ReadDir(filepath.Join(dirPath, f.Name()))
+		if err != nil {
+			log.Printf("Warning: Unable to read %s: %s", f.Name(), err)
+			continue
+		}
+		for _, subFile := range subFiles {
+			if rank := dockerfileRank(subFile.Name()); !subFile.IsDir() && rank >= 0 {
+				candidates = append(candidates, candidate{filepath.Join(f.Name(), subFile.Name()), rank + 2})
+			}
 		}
 	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].name < candidates[j].name
+	})
 
-	log.Println("Could not find Dockerfile in root directory of repository. Generating one for you...")
-	name, err := generateDockerfile(dirPath)
-	return name, err
+	names := make([]string, len(candidates))
+	for i, c := range candidates {
+		names[i] = c.name
+	}
+	ambiguous := len(candidates) > 1 && candidates[0].rank == candidates[1].rank
+	return names, ambiguous, nil
+}
 
+// chooseDockerfile asks the user which of the candidates to build, returning
+// an empty name if a Dockerfile should be generated instead
+func chooseDockerfile(candidates []string) (string, error) {
+	fmt.Println("Found several Dockerfiles in the repository:")
+	options := append(append([]string{}, candidates...), "Generate a Dockerfile")
+	var index int
+	GetUserChoice(options, "Which one should be used to create the dockbox? [1] ", func(choice string) error {
+		var err error
+		index, err = strconv.Atoi(choice)
+		if err != nil || index < 1 || index > len(options) {
+			return fmt.Errorf("Please enter a number between 1 and %d", len(options))
+		}
+		return nil
+	})
+	if index == len(options) {
+		return "", nil
+	}
+	return candidates[index-1], nil
 }
 
-func generateDockerfile(dirPath string) (string, error) {
+func generateDockerfile(dirPath string) (string, string, error) {
 	_, err := os.Stat(dirPath)
 
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	if nixImage, nixFile := detectNixEnvironment(dirPath); nixFile != "" {
+		if useNix, _ := GetUserBoolean("Create dockbox with the Nix environment of %s? ", nixFile); useNix {
+			fmt.Printf("Using image %s for the Nix environment of %s\n", nixImage.Image, nixFile)
+			dockerFileName, err := createDockerFileForLanguage(dirPath, nixImage)
+			return dockerFileName, "nix", err
+		}
 	}
 	stats := make(map[string]int)
 	godirwalk.Walk(dirPath,
@@ -249,108 +507,225 @@ func generateDockerfile(dirPath string) (string, error) {
 		},
 	)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	log.Println(stats)
 	sorted := SortMap(stats)
 	log.Println(sorted)
 
-	userSelectedLanguage := false
-	chosenLanguage := ""
+	chosenLanguages := chooseLanguages(sorted)
+	dockerFileName, err := createDockerFileForLanguages(dirPath, languageImages(dirPath, chosenLanguages))
+	return dockerFileName, strings.Join(chosenLanguages, ","), err
+}
+
+// chooseLanguages asks the user which of the languages found in the
+// repository, from least to most frequent, the dockbox is created with
+func chooseLanguages(sorted []Pair) []string {
+	if len(sorted) == 0 {
+		return []string{"unknown"}
+	}
+	candidates := make([]string, 0, len(sorted))
+	options := make([]string, 0, len(sorted)+1)
+	fmt.Println("Found these languages in the repository:")
 	for i := len(sorted) - 1; i >= 0; i-- {
+		candidates = append(candidates, sorted[i].Key)
 		if _, ok := LanguageToImageMapper[sorted[i].Key]; !ok {
-			userSelectedLanguage, _ = GetUserBoolean("Create dockbox with %s? Image was not found for this language so default image will be used. ", sorted[i].Key)
-			chosenLanguage = "unknown"
+			options = append(options, fmt.Sprintf("%s (%d files, image was not found for this language so default image will be used)", sorted[i].Key, sorted[i].Value))
 		} else {
-			userSelectedLanguage, _ = GetUserBoolean("Create dockbox with %s? ", sorted[i].Key)
-			chosenLanguage = sorted[i].Key
-		}
-		if userSelectedLanguage {
-			break
+			options = append(options, fmt.Sprintf("%s (%d files)", sorted[i].Key, sorted[i].Value))
 		}
 	}
+	options = append(options, "None of them, use the default image")
+	var languages []string
+	GetUserChoice(options, "Which languages should the dockbox be created with? Separate several with commas, e.g. 1,3 [1] ", func(choice string) error {
+		var err error
+		languages, err = parseLanguageSelection(choice, candidates)
+		return err
+	})
+	return languages
+}
 
-	// user does not select any language
-	if !userSelectedLanguage {
-		chosenLanguage = "unknown"
+// parseLanguageSelection returns the languages of candidates selected by the
+// comma-separated numbers of choice, in the order they were given. Languages
+// without an image are dropped when combined with others
+func parseLanguageSelection(choice string, candidates []string) ([]string, error) {
+	var languages []string
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(choice, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || index < 1 || index > len(candidates)+1 {
+			return nil, fmt.Errorf("Please enter numbers between 1 and %d", len(candidates)+1)
+		}
+		if index == len(candidates)+1 {
+			return []string{"unknown"}, nil
+		}
+		language := candidates[index-1]
+		if _, ok := LanguageToImageMapper[language]; !ok {
+			language = "unknown"
+		}
+		if !seen[language] {
+			seen[language] = true
+			languages = append(languages, language)
+		}
 	}
-
-	log.Printf("Using image %s to build dockbox...\n", LanguageToImageMapper[chosenLanguage].Image)
-	return createDockerFileForLanguage(dirPath, LanguageToImageMapper[chosenLanguage])
+	if len(languages) > 1 && seen["unknown"] {
+		for i, language := range languages {
+			if language == "unknown" {
+				languages = append(languages[:i], languages[i+1:]...)
+				break
+			}
+		}
+	}
+	return languages, nil
 }
 
 func createDockerFileForLanguage(dirPath string, language Image) (string, error) {
+	return createDockerFileForLanguages(dirPath, []Image{language})
+}
+
+// createDockerFileForLanguages generates a Dockerfile building on the first
+// of images, into which the toolchains of the others are copied or installed
+// before the setup commands of every language run
+func createDockerFileForLanguages(dirPath string, images []Image) (string, error) {
+	return writeGeneratedDockerfile(dirPath, dockerFileForLanguages(dirPath, images))
+}
+
+// dockerFileForLanguages returns the Dockerfile generated by createDockerFileForLanguages
+func dockerFileForLanguages(dirPath string, images []Image) string {
 	var sb strings.Builder
 
-	_, err := sb.WriteString(fmt.Sprintf("FROM %s\n", language.Image))
-	if err != nil {
-		return "", err
+	// Toolchains are copied from stages of their own image
+	stages := make(map[int]string)
+	for i, image := range images[1:] {
+		if len(image.Toolchain) > 0 {
+			stages[i+1] = fmt.Sprintf("toolchain%d", i+1)
+			sb.WriteString(fmt.Sprintf("FROM %s AS %s\n", image.Image, stages[i+1]))
+		}
 	}
 
-	_, err = sb.WriteString("WORKDIR /app\n")
-	if err != nil {
-		return "", err
+	sb.WriteString(fmt.Sprintf("FROM %s\n", images[0].Image))
+
+	var packages, packageCommands []string
+	for i, image := range images[1:] {
+		for _, directory := range image.Toolchain {
+			sb.WriteString(fmt.Sprintf("COPY --from=%s %s %s\n", stages[i+1], directory, directory))
+		}
+		for _, variable := range image.Env {
+			sb.WriteString(fmt.Sprintf("ENV %s\n", variable))
+		}
+		packages = append(packages, image.Packages...)
+		packageCommands = append(packageCommands, image.PackageCommands...)
+	}
+	if len(packages) > 0 {
+		sb.WriteString(fmt.Sprintf("RUN apt-get update && apt-get install -y --no-install-recommends %s && rm -rf /var/lib/apt/lists/*\n", strings.Join(packages, " ")))
+	}
+	for _, command := range packageCommands {
+		sb.WriteString(fmt.Sprintf("RUN %s\n", command))
 	}
 
-	_, err = sb.WriteString("COPY . .\n")
-	if err != nil {
-		return "", err
+	sb.WriteString("WORKDIR /app\n")
+	sb.WriteString("COPY . .\n")
+
+	for i, image := range images {
+		// Installing the Packages of a combined image replaces its commands
+		if i == 0 || len(image.Packages) == 0 {
+			for _, command := range image.Commands {
+				sb.WriteString(fmt.Sprintf("RUN %s\n", command))
+			}
+		}
+		if command := setupCommand(dirPath, image.Setup); command != "" {
+			sb.WriteString(fmt.Sprintf("RUN %s\n", command))
+		} else if len(image.Setup) > 0 {
+			log.Printf("No dependencies to install with %s found at the root of the repository, skipping its setup", image.Image)
+		}
 	}
 
-	for _, command := range language.Commands {
-		_, err := sb.WriteString(fmt.Sprintf("RUN %s\n", command))
-		if err != nil {
-			return "", err
+	if len(images[0].EntryPoint) > 0 {
+		sb.WriteString(fmt.Sprintf("ENTRYPOINT %s\n", images[0].EntryPoint))
+	}
+
+	return sb.String()
+}
+
+// setupCommand returns the command of the first of steps whose files exist at
+// the root of the repository at dirPath, or an empty string if there is none
+func setupCommand(dirPath string, steps []SetupStep) string {
+	for _, step := range steps {
+		for _, file := range step.Files {
+			if _, err := os.Stat(filepath.Join(dirPath, file)); err == nil {
+				return step.Command
+			}
 		}
 	}
+	return ""
+}
 
-	if len(language.EntryPoint) > 0 {
-		_, err = sb.WriteString(fmt.Sprintf("ENTRYPOINT %s\n", language.EntryPoint))
-		if err != nil {
+// buildGeneratedImage builds the dockbox at dirPath like buildImage. If its
+// Dockerfile was generated for languages and one of their setup steps fails,
+// the user is offered to build it again without installing dependencies. The
+// generated Dockerfile is kept, so that rebuilding the dockbox tries them again.
+func buildGeneratedImage(cli dockerClient, dirPath string, dockerFileName string, dockboxName string, labels map[string]string, buildOptions BuildOptions, language string) (string, error) {
+	imageName, err := buildImage(cli, dirPath, dockerFileName, dockboxName, labels, buildOptions)
+	var buildErr *buildError
+	if err == nil || language == "" || !errors.As(err, &buildErr) {
+		return imageName, err
+	}
+
+	languages := strings.Split(language, ",")
+	failedSetup := false
+	for _, name := range languages {
+		image, ok := LanguageToImageMapper[name]
+		if !ok {
 			return "", err
 		}
+		if command := setupCommand(dirPath, image.Setup); command != "" && buildErr.instruction() == "RUN "+command {
+			failedSetup = true
+		}
+	}
+	if !failedSetup {
+		return "", err
 	}
 
-	dockerFileBytes := []byte(sb.String())
-	dockerFileName := path.Join(HIDDEN_DIRECTORY, ".Dockerfile.dockbox")
-	err = ioutil.WriteFile(path.Join(dirPath, dockerFileName), dockerFileBytes, 0644)
+	fmt.Println(err)
+	retry, _ := GetUserBoolean("Installing the dependencies of the dockbox failed. Build it without dependencies?")
+	if !retry {
+		return "", err
+	}
+	images := languageImages(dirPath, languages)
+	for i := range images {
+		images[i].Setup = nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(dirPath, HIDDEN_DIRECTORY), ".Dockerfile-")
 	if err != nil {
 		return "", err
 	}
-
-	dockerIgnorePath := path.Join(HIDDEN_DIRECTORY, ".dockerignore.dockbox")
-	dockerIgnoreFileBytes := []byte(dockerFileName + "\n" + dockerIgnorePath)
-	err = ioutil.WriteFile(path.Join(dirPath, dockerIgnorePath), dockerIgnoreFileBytes, 0644)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(dockerFileForLanguages(dirPath, images))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return "", err
 	}
-
-	return dockerFileName, nil
+	log.Printf("Building dockbox at %s without dependencies...", dirPath)
+	return buildImage(cli, dirPath, path.Join(HIDDEN_DIRECTORY, filepath.Base(tmp.Name())), dockboxName, labels, buildOptions)
 }
 
-func buildImage(cli dockerClient, dirPath string, dockerFileName string, dockboxName string) (string, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	tar, err := archive.TarWithOptions(dirPath, &archive.TarOptions{})
+// writeGeneratedDockerfile writes a Dockerfile generated for the dockbox at
+// dirPath, returning its path relative to dirPath
+func writeGeneratedDockerfile(dirPath string, dockerFile string) (string, error) {
+	dockerFileName := path.Join(HIDDEN_DIRECTORY, ".Dockerfile.dockbox")
+	err := ioutil.WriteFile(path.Join(dirPath, dockerFileName), []byte(dockerFile), 0644)
 	if err != nil {
 		return "", err
 	}
-	imageName := dockboxNameToImageName(dockboxName)
-	opts := types.ImageBuildOptions{
-		Dockerfile: dockerFileName,
-		Tags:       []string{imageName},
-		Remove:     true,
-	}
-	res, err := cli.ImageBuild(ctx, tar, opts)
+
+	dockerIgnorePath := path.Join(HIDDEN_DIRECTORY, ".dockerignore.dockbox")
+	dockerIgnoreFileBytes := []byte(dockerFileName + "\n" + dockerIgnorePath)
+	err = ioutil.WriteFile(path.Join(dirPath, dockerIgnorePath), dockerIgnoreFileBytes, 0644)
 	if err != nil {
 		return "", err
 	}
 
-	defer res.Body.Close()
-
-	scanner := bufio.NewScanner(res.Body)
-	printImageBuildOutput(scanner)
-
-	return imageName, err
+	return dockerFileName, nil
 }
@@ -0,0 +1,596 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildImage(t *testing.T) {
+	testcases := []struct {
+		name          string
+		buildOutput   string
+		expectedError string
+	}{
+		{
+			name: "BuildSuccess",
+			buildOutput: `{"stream":"Step 1/2 : FROM ubuntu:18.04\n"}
+{"stream":" ---> 39a8cfeef173\n"}
+{"stream":"Step 2/2 : WORKDIR /app\n"}
+{"stream":"Successfully built 39a8cfeef173\n"}
+{"stream":"Successfully tagged dockbox/sample:latest\n"}
+`,
+		},
+		{
+			name: "BuildFailure",
+			buildOutput: `{"stream":"Step 1/3 : FROM python:3.8-slim-buster\n"}
+{"stream":" ---> 39a8cfeef173\n"}
+{"stream":"Step 2/3 : RUN pip install -r requirements.txt\n"}
+{"stream":"ERROR: Could not open requirements file\n"}
+{"errorDetail":{"code":1,"message":"The command '/bin/sh -c pip install -r requirements.txt' returned a non-zero code: 1"},"error":"The command '/bin/sh -c pip install -r requirements.txt' returned a non-zero code: 1"}
+`,
+			expectedError: "failed to build dockbox at Step 2/3 : RUN pip install -r requirements.txt: The command '/bin/sh -c pip install -r requirements.txt' returned a non-zero code: 1\n\n" +
+				"Last lines of build output:\n" +
+				"Step 1/3 : FROM python:3.8-slim-buster\n" +
+				"---> 39a8cfeef173\n" +
+				"Step 2/3 : RUN pip install -r requirements.txt\n" +
+				"ERROR: Could not open requirements file",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			labels := map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/sample"}
+			fakeDockerCli := &fakeDockerClient{
+				imageBuild: func(c context.Context, r io.Reader, ibo types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+					assert.Equal(t, labels, ibo.Labels)
+					return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(test.buildOutput))}, nil
+				},
+			}
+			imageName, err := buildImage(fakeDockerCli, t.TempDir(), "Dockerfile", "sample", labels, BuildOptions{})
+			if test.expectedError == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, "dockbox/sample", imageName)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+				assert.Equal(t, "", imageName)
+			}
+		})
+	}
+}
+
+func buildKitTraceMessage(t *testing.T, status *controlapi.StatusResponse) string {
+	t.Helper()
+	data, err := status.Marshal()
+	assert.Nil(t, err)
+	aux, err := json.Marshal(data)
+	assert.Nil(t, err)
+	auxMessage := json.RawMessage(aux)
+	message, err := json.Marshal(jsonmessage.JSONMessage{ID: "moby.buildkit.trace", Aux: &auxMessage})
+	assert.Nil(t, err)
+	return string(message) + "\n"
+}
+
+func TestBuildImageWithBuildKit(t *testing.T) {
+	started := time.Unix(1626748159, 0)
+	completed := started.Add(time.Second)
+	fromVertex := digest.FromString("from")
+	runVertex := digest.FromString("run")
+
+	testcases := []struct {
+		name          string
+		buildOutput   string
+		expectedError string
+	}{
+		{
+			name: "BuildKitSuccess",
+			buildOutput: buildKitTraceMessage(t, &controlapi.StatusResponse{
+				Vertexes: []*controlapi.Vertex{
+					{Digest: fromVertex, Name: "[1/2] FROM docker.io/library/ubuntu:18.04", Started: &started, Completed: &completed, Cached: true},
+					{Digest: runVertex, Name: "[2/2] WORKDIR /app", Started: &started, Completed: &completed},
+				},
+			}) + `{"id":"moby.image.id","aux":{"ID":"sha256:39a8cfeef173"}}` + "\n",
+		},
+		{
+			name: "BuildKitFailure",
+			buildOutput: buildKitTraceMessage(t, &controlapi.StatusResponse{
+				Vertexes: []*controlapi.Vertex{
+					{Digest: fromVertex, Name: "[1/2] FROM docker.io/library/node:14", Started: &started, Completed: &completed},
+					{Digest: runVertex, Name: "[2/2] RUN npm install", Started: &started},
+				},
+			}) + buildKitTraceMessage(t, &controlapi.StatusResponse{
+				Logs: []*controlapi.VertexLog{
+					{Vertex: runVertex, Msg: []byte("npm ERR! enoent ENOENT: no such file or directory, open '/app/package.json'\n")},
+				},
+			}) + buildKitTraceMessage(t, &controlapi.StatusResponse{
+				Vertexes: []*controlapi.Vertex{
+					{Digest: runVertex, Name: "[2/2] RUN npm install", Started: &started, Completed: &completed, Error: "exit code: 254"},
+				},
+			}) + `{"errorDetail":{"message":"executor failed running [/bin/sh -c npm install]: exit code: 254"},"error":"executor failed running [/bin/sh -c npm install]: exit code: 254"}` + "\n",
+			expectedError: "failed to build dockbox at [2/2] RUN npm install: executor failed running [/bin/sh -c npm install]: exit code: 254\n\n" +
+				"Last lines of build output:\n" +
+				"npm ERR! enoent ENOENT: no such file or directory, open '/app/package.json'",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			buildOptions := []types.ImageBuildOptions{}
+			fakeDockerCli := &fakeDockerClient{
+				imageBuild: func(c context.Context, r io.Reader, ibo types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					buildOptions = append(buildOptions, ibo)
+					if strings.HasPrefix(ibo.BuildID, uploadRequestRemote+":") {
+						return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+					}
+					return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(test.buildOutput))}, nil
+				},
+				dialHijack: func(c context.Context, s1, s2 string, m map[string][]string) (net.Conn, error) {
+					return nil, errors.New("session not supported by fake client")
+				},
+			}
+			imageName, err := buildImage(fakeDockerCli, t.TempDir(), "Dockerfile", "sample", nil, BuildOptions{
+				buildKit:  true,
+				buildArgs: []string{"VERSION=1.0"},
+				target:    "dev",
+			})
+			if test.expectedError == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, "dockbox/sample", imageName)
+				assert.Len(t, buildOptions, 2)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+				assert.Equal(t, "", imageName)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, opts := range buildOptions {
+				assert.Equal(t, types.BuilderBuildKit, opts.Version)
+				if opts.RemoteContext == uploadRequestRemote {
+					assert.Equal(t, "dev", opts.Target)
+					assert.Equal(t, "1.0", *opts.BuildArgs["VERSION"])
+					assert.Equal(t, []string{"dockbox/sample"}, opts.Tags)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSecret(t *testing.T) {
+	testcases := []struct {
+		spec          string
+		expected      secretsprovider.Source
+		expectedError string
+	}{
+		{spec: "id=npmrc,src=/home/user/.npmrc", expected: secretsprovider.Source{ID: "npmrc", FilePath: "/home/user/.npmrc"}},
+		{spec: "id=token,type=env,env=GITHUB_TOKEN", expected: secretsprovider.Source{ID: "token", Env: "GITHUB_TOKEN"}},
+		{spec: "id=token,type=env,src=GITHUB_TOKEN", expected: secretsprovider.Source{ID: "token", Env: "GITHUB_TOKEN"}},
+		{spec: "id=token,type=ssh", expectedError: `unsupported secret type "ssh"`},
+		{spec: "id=token,src", expectedError: `invalid secret field "src": must be a key=value pair`},
+	}
+	for _, test := range testcases {
+		source, err := parseSecret(test.spec)
+		if test.expectedError != "" {
+			assert.EqualError(t, err, test.expectedError)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, source)
+	}
+}
+
+func TestValidateDockboxName(t *testing.T) {
+	testcases := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "sample", valid: true},
+		{name: "my.repo", valid: true},
+		{name: "my_repo-2", valid: true},
+		{name: "My.Repo", valid: false},
+		{name: "-repo", valid: false},
+		{name: "repo/nested", valid: false},
+		{name: "repo:tag", valid: false},
+		{name: "", valid: false},
+	}
+	for _, test := range testcases {
+		err := validateDockboxName(test.name)
+		if test.valid {
+			assert.Nil(t, err, test.name)
+		} else {
+			assert.NotNil(t, err, test.name)
+		}
+	}
+}
+
+func TestSanitizeDockboxName(t *testing.T) {
+	testcases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "sample", expected: "sample"},
+		{name: "My.Repo", expected: "my.repo"},
+		{name: "cli.git", expected: "cli"},
+		{name: "Hello World!", expected: "hello-world"},
+		{name: "__init__.-py", expected: "init-py"},
+	}
+	for _, test := range testcases {
+		assert.Equal(t, test.expected, sanitizeDockboxName(test.name))
+	}
+	assert.Nil(t, validateDockboxName(sanitizeDockboxName("/")))
+}
+
+func TestResolveDockboxName(t *testing.T) {
+	dirPath := t.TempDir()
+	otherPath := t.TempDir()
+	testcases := []struct {
+		name          string
+		existing      map[string]string
+		inspectError  error
+		input         string
+		expectedName  string
+		expectedError string
+	}{
+		{
+			name:         "NoCollision",
+			existing:     map[string]string{},
+			expectedName: "sample",
+		},
+		{
+			name:         "SameDockbox",
+			existing:     map[string]string{"dockbox/sample": dirPath},
+			expectedName: "sample",
+		},
+		{
+			name:         "Overwrite",
+			existing:     map[string]string{"dockbox/sample": otherPath},
+			input:        "o\n",
+			expectedName: "sample",
+		},
+		{
+			name:         "Rename",
+			existing:     map[string]string{"dockbox/sample": otherPath, "dockbox/taken": otherPath},
+			input:        "x\nr\nInvalid/Name\nr\ntaken\nr\nrenamed\n",
+			expectedName: "renamed",
+		},
+		{
+			name:         "Suffix",
+			existing:     map[string]string{"dockbox/sample": otherPath, "dockbox/sample-2": otherPath},
+			input:        "s\n",
+			expectedName: "sample-3",
+		},
+		{
+			name:          "NoAnswer",
+			existing:      map[string]string{"dockbox/sample": otherPath},
+			expectedError: "EOF",
+		},
+		{
+			name:          "DaemonError",
+			existing:      map[string]string{},
+			inspectError:  errors.New("Cannot connect to the Docker daemon"),
+			expectedError: "Cannot connect to the Docker daemon",
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			setTestStdin(t, test.input)
+			fakeDockerCli := &fakeDockerClient{
+				imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+					if test.inspectError != nil {
+						return types.ImageInspect{}, nil, test.inspectError
+					}
+					existingPath, ok := test.existing[imageID]
+					if !ok {
+						return types.ImageInspect{}, nil, errors.New("Error: No such image: " + imageID)
+					}
+					return types.ImageInspect{ID: imageID, Config: &container.Config{Labels: map[string]string{LABEL_PATH: existingPath}}}, nil, nil
+				},
+			}
+			name, err := resolveDockboxName(context.Background(), fakeDockerCli, "sample", dirPath)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedName, name)
+		})
+	}
+}
+
+func TestFindDockerfiles(t *testing.T) {
+	testcases := []struct {
+		name              string
+		files             []string
+		expectedFiles     []string
+		expectedAmbiguous bool
+	}{
+		{
+			name:          "ExactFirst",
+			files:         []string{"Dockerfile.prod", "dockerfile-notes.md", "Dockerfile.windows", "Dockerfile", "docker/Dockerfile"},
+			expectedFiles: []string{"Dockerfile", "Dockerfile.prod", "Dockerfile.windows", "docker/Dockerfile"},
+		},
+		{
+			name:          "CaseInsensitive",
+			files:         []string{"dockerfile", "README.md"},
+			expectedFiles: []string{"dockerfile"},
+		},
+		{
+			name:              "Variants",
+			files:             []string{"Dockerfile.windows", "app.Dockerfile", "Dockerfile.md", "docker/Dockerfile"},
+			expectedFiles:     []string{"Dockerfile.windows", "app.Dockerfile", "docker/Dockerfile"},
+			expectedAmbiguous: true,
+		},
+		{
+			name:          "Subfolder",
+			files:         []string{"docker/Dockerfile", "docker/Dockerfile.dev", "node_modules/pkg/Dockerfile", ".github/Dockerfile", "src/main.go"},
+			expectedFiles: []string{"docker/Dockerfile", "docker/Dockerfile.dev"},
+		},
+		{
+			name:              "SeveralSubfolders",
+			files:             []string{"backend/Dockerfile", "frontend/Dockerfile"},
+			expectedFiles:     []string{"backend/Dockerfile", "frontend/Dockerfile"},
+			expectedAmbiguous: true,
+		},
+		{
+			name:          "None",
+			files:         []string{"main.go", "docs/dockerfile-notes.md"},
+			expectedFiles: []string{},
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := t.TempDir()
+			for _, file := range test.files {
+				assert.Nil(t, os.MkdirAll(filepath.Join(dirPath, filepath.Dir(file)), 0755))
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, file), []byte("FROM ubuntu:18.04\n"), 0644))
+			}
+			// Order of the entries on disk must not matter
+			for i := 0; i < 5; i++ {
+				files, ambiguous, err := findDockerfiles(dirPath)
+				assert.Nil(t, err)
+				assert.Equal(t, test.expectedFiles, files)
+				assert.Equal(t, test.expectedAmbiguous, ambiguous)
+			}
+		})
+	}
+}
+
+func TestResolveDockerfileFlag(t *testing.T) {
+	dirPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dirPath, "docker"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, "docker", "Dockerfile.dev"), []byte("FROM ubuntu:18.04\n"), 0644))
+
+	dockerFileName, err := resolveDockerfileFlag(dirPath, "docker/Dockerfile.dev")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("docker", "Dockerfile.dev"), dockerFileName)
+
+	dockerFileName, err = resolveDockerfileFlag(dirPath, filepath.Join(dirPath, "docker", "Dockerfile.dev"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("docker", "Dockerfile.dev"), dockerFileName)
+
+	_, err = resolveDockerfileFlag(dirPath, "Dockerfile")
+	assert.EqualError(t, err, "no Dockerfile found at Dockerfile in "+dirPath)
+
+	_, err = resolveDockerfileFlag(dirPath, "docker")
+	assert.EqualError(t, err, "no Dockerfile found at docker in "+dirPath)
+
+	_, err = resolveDockerfileFlag(dirPath, "../Dockerfile")
+	assert.EqualError(t, err, "Dockerfile ../Dockerfile must be inside the dockbox folder "+dirPath)
+}
+
+func TestParseLanguageSelection(t *testing.T) {
+	candidates := []string{"go", "javascript", "markdown", "python"}
+	testcases := []struct {
+		choice            string
+		expectedLanguages []string
+		expectedError     bool
+	}{
+		{choice: "1", expectedLanguages: []string{"go"}},
+		{choice: "2,1", expectedLanguages: []string{"javascript", "go"}},
+		{choice: "1, 4,1", expectedLanguages: []string{"go", "python"}},
+		{choice: "3", expectedLanguages: []string{"unknown"}},
+		{choice: "3,2", expectedLanguages: []string{"javascript"}},
+		{choice: "5", expectedLanguages: []string{"unknown"}},
+		{choice: "0", expectedError: true},
+		{choice: "1,go", expectedError: true},
+	}
+	for _, test := range testcases {
+		t.Run(test.choice, func(t *testing.T) {
+			languages, err := parseLanguageSelection(test.choice, candidates)
+			if test.expectedError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedLanguages, languages)
+		})
+	}
+}
+
+func TestCreateDockerFileForLanguages(t *testing.T) {
+	dirPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+	for _, name := range []string{"package.json", "package-lock.json", "requirements.txt"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, name), []byte{}, 0644))
+	}
+
+	images := []Image{LanguageToImageMapper["javascript"], LanguageToImageMapper["go"], LanguageToImageMapper["python"]}
+	dockerFileName, err := createDockerFileForLanguages(dirPath, images)
+	assert.Nil(t, err)
+	dockerFile, err := ioutil.ReadFile(filepath.Join(dirPath, dockerFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, `FROM golang:1.16.5-buster AS toolchain1
+FROM node:14
+COPY --from=toolchain1 /usr/local/go /usr/local/go
+ENV GOPATH=/go
+ENV PATH=/usr/local/go/bin:/go/bin:$PATH
+ENV PIP_BREAK_SYSTEM_PACKAGES=1
+RUN apt-get update && apt-get install -y --no-install-recommends python3 python3-pip python3-venv && rm -rf /var/lib/apt/lists/*
+RUN ln -sf /usr/bin/python3 /usr/local/bin/python && ln -sf /usr/bin/pip3 /usr/local/bin/pip
+WORKDIR /app
+COPY . .
+RUN npm ci
+RUN pip install -r requirements.txt
+ENTRYPOINT /bin/bash
+`, string(dockerFile))
+
+	// Combined images installed from packages skip their own commands
+	images = []Image{LanguageToImageMapper["python"], LanguageToImageMapper["c"]}
+	dockerFileName, err = createDockerFileForLanguages(dirPath, images)
+	assert.Nil(t, err)
+	dockerFile, err = ioutil.ReadFile(filepath.Join(dirPath, dockerFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, `FROM python:3.8-slim-buster
+RUN apt-get update && apt-get install -y --no-install-recommends build-essential && rm -rf /var/lib/apt/lists/*
+WORKDIR /app
+COPY . .
+RUN pip install -r requirements.txt
+ENTRYPOINT /bin/bash
+`, string(dockerFile))
+
+	// A single language builds on its image alone
+	dockerFileName, err = createDockerFileForLanguage(dirPath, LanguageToImageMapper["go"])
+	assert.Nil(t, err)
+	dockerFile, err = ioutil.ReadFile(filepath.Join(dirPath, dockerFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, "FROM golang:1.16.5-buster\nWORKDIR /app\nCOPY . .\nENTRYPOINT /bin/bash\n", string(dockerFile))
+}
+
+func TestSetupCommand(t *testing.T) {
+	testcases := []struct {
+		name            string
+		language        string
+		files           []string
+		expectedCommand string
+	}{
+		{name: "NoManifest", language: "javascript", expectedCommand: ""},
+		{name: "PackageJSON", language: "javascript", files: []string{"package.json"}, expectedCommand: "npm install"},
+		{name: "Shrinkwrap", language: "javascript", files: []string{"package.json", "npm-shrinkwrap.json"}, expectedCommand: "npm ci"},
+		{name: "Yarn", language: "javascript", files: []string{"package.json", "yarn.lock"}, expectedCommand: "yarn install --frozen-lockfile"},
+		{name: "Pnpm", language: "javascript", files: []string{"package.json", "pnpm-lock.yaml"}, expectedCommand: "npm install -g pnpm && pnpm install --frozen-lockfile"},
+		{name: "Requirements", language: "python", files: []string{"requirements.txt"}, expectedCommand: "pip install -r requirements.txt"},
+		{name: "Poetry", language: "python", files: []string{"pyproject.toml", "poetry.lock", "requirements.txt"}, expectedCommand: "pip install poetry && poetry config virtualenvs.create false && poetry install --no-root"},
+		{name: "Pipenv", language: "python", files: []string{"Pipfile", "Pipfile.lock"}, expectedCommand: "pip install pipenv && pipenv install --system --deploy"},
+		{name: "NestedRequirements", language: "python", files: []string{"backend/requirements.txt"}, expectedCommand: ""},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := t.TempDir()
+			for _, name := range test.files {
+				assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dirPath, name)), 0755))
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, name), []byte{}, 0644))
+			}
+			assert.Equal(t, test.expectedCommand, setupCommand(dirPath, LanguageToImageMapper[test.language].Setup))
+		})
+	}
+}
+
+// setTestStdin answers the prompts of the test with input
+func setTestStdin(t *testing.T, input string) {
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	_, err = w.WriteString(input)
+	assert.Nil(t, err)
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		r.Close()
+	})
+}
+
+func TestBuildGeneratedImage(t *testing.T) {
+	dirPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, "requirements.txt"), []byte("nonexistent-package\n"), 0644))
+	dockerFileName, err := createDockerFileForLanguage(dirPath, LanguageToImageMapper["python"])
+	assert.Nil(t, err)
+
+	failedSetup := `{"stream":"Step 4/5 : RUN pip install -r requirements.txt\n"}
+{"errorDetail":{"code":1,"message":"The command '/bin/sh -c pip install -r requirements.txt' returned a non-zero code: 1"},"error":"The command '/bin/sh -c pip install -r requirements.txt' returned a non-zero code: 1"}
+`
+	failure := failedSetup
+	var dockerFiles []string
+	fakeDockerCli := &fakeDockerClient{
+		imageBuild: func(c context.Context, r io.Reader, ibo types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+			dockerFile, err := ioutil.ReadFile(filepath.Join(dirPath, ibo.Dockerfile))
+			assert.Nil(t, err)
+			dockerFiles = append(dockerFiles, string(dockerFile))
+			if len(dockerFiles) == 1 {
+				return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(failure))}, nil
+			}
+			return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(`{"stream":"Successfully built 39a8cfeef173\n"}` + "\n"))}, nil
+		},
+	}
+
+	// The failure is returned unless the user retries
+	setTestStdin(t, "n\n")
+	_, err = buildGeneratedImage(fakeDockerCli, dirPath, dockerFileName, "sample", nil, BuildOptions{}, "python")
+	assert.Contains(t, fmt.Sprint(err), "RUN pip install -r requirements.txt")
+
+	// The dependencies are left out when the user retries
+	dockerFiles = nil
+	setTestStdin(t, "y\n")
+	imageName, err := buildGeneratedImage(fakeDockerCli, dirPath, dockerFileName, "sample", nil, BuildOptions{}, "python")
+	assert.Nil(t, err)
+	assert.Equal(t, "dockbox/sample", imageName)
+	assert.Equal(t, 2, len(dockerFiles))
+	assert.Contains(t, dockerFiles[0], "RUN pip install -r requirements.txt\n")
+	assert.Equal(t, "FROM python:3.8-slim-buster\nWORKDIR /app\nCOPY . .\nENTRYPOINT /bin/bash\n", dockerFiles[1])
+	// The Dockerfile without dependencies is only used for this build
+	generated, err := ioutil.ReadFile(filepath.Join(dirPath, dockerFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, dockerFiles[0], string(generated))
+	files, err := ioutil.ReadDir(filepath.Join(dirPath, HIDDEN_DIRECTORY))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+
+	// BuildKit steps are recognized too
+	dockerFiles = nil
+	started := time.Unix(1626748159, 0)
+	failure = buildKitTraceMessage(t, &controlapi.StatusResponse{
+		Vertexes: []*controlapi.Vertex{{Digest: digest.FromString("setup"), Name: "[4/5] RUN pip install -r requirements.txt", Started: &started}},
+	}) + `{"errorDetail":{"message":"executor failed running [/bin/sh -c pip install -r requirements.txt]: exit code: 1"},"error":"executor failed running [/bin/sh -c pip install -r requirements.txt]: exit code: 1"}` + "\n"
+	setTestStdin(t, "y\n")
+	_, err = buildGeneratedImage(fakeDockerCli, dirPath, dockerFileName, "sample", nil, BuildOptions{}, "python")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(dockerFiles))
+
+	// Steps only containing a setup command are not retried
+	dockerFiles = nil
+	failure = `{"stream":"Step 4/5 : RUN pip install --upgrade pip && pip install -r requirements.txt\n"}
+{"errorDetail":{"code":1,"message":"The command returned a non-zero code: 1"},"error":"The command returned a non-zero code: 1"}
+`
+	_, err = buildGeneratedImage(fakeDockerCli, dirPath, dockerFileName, "sample", nil, BuildOptions{}, "python")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(dockerFiles))
+	failure = failedSetup
+
+	// Failures of other steps are not retried
+	dockerFiles = nil
+	_, err = buildGeneratedImage(fakeDockerCli, dirPath, dockerFileName, "sample", nil, BuildOptions{}, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(dockerFiles))
+}
@@ -16,39 +16,78 @@ func (i Image) String() string {
 
 var LanguageToImageMapper = map[string]Image{
 	"python": {
-		"python:3.8-slim-buster",
-		[]string{"pip install -r requirements.txt"},
-		"/bin/bash",
+		Image:      "python:3.8-slim-buster",
+		Commands:   []string{},
+		EntryPoint: "/bin/bash",
+		Env:        []string{"PIP_BREAK_SYSTEM_PACKAGES=1"},
+		Packages:   []string{"python3", "python3-pip", "python3-venv"},
+		// Debian only installs python3 and pip3
+		PackageCommands: []string{"ln -sf /usr/bin/python3 /usr/local/bin/python && ln -sf /usr/bin/pip3 /usr/local/bin/pip"},
+		Setup: []SetupStep{
+			{[]string{"poetry.lock"}, "pip install poetry && poetry config virtualenvs.create false && poetry install --no-root"},
+			{[]string{"Pipfile.lock"}, "pip install pipenv && pipenv install --system --deploy"},
+			{[]string{"Pipfile"}, "pip install pipenv && pipenv install --system --skip-lock"},
+			{[]string{"requirements.txt"}, "pip install -r requirements.txt"},
+		},
 	},
 	"javascript": {
-		"node:14",
-		[]string{"npm install"},
-		"/bin/bash",
+		Image:      "node:14",
+		Commands:   []string{},
+		EntryPoint: "/bin/bash",
+		Toolchain:  []string{"/usr/local/bin", "/usr/local/lib/node_modules", "/usr/local/include/node", "/opt"},
+		Setup: []SetupStep{
+			{[]string{"pnpm-lock.yaml"}, "npm install -g pnpm && pnpm install --frozen-lockfile"},
+			{[]string{"yarn.lock"}, "yarn install --frozen-lockfile"},
+			{[]string{"package-lock.json", "npm-shrinkwrap.json"}, "npm ci"},
+			{[]string{"package.json"}, "npm install"},
+		},
 	},
 	"c++": {
-		"ubuntu:18.04",
-		[]string{"apt-get update && apt-get install -y build-essential"},
-		"/bin/bash",
+		Image:      "ubuntu:18.04",
+		Commands:   []string{"apt-get update && apt-get install -y build-essential"},
+		EntryPoint: "/bin/bash",
+		Packages:   []string{"build-essential"},
 	},
 	"c": {
-		"ubuntu:18.04",
-		[]string{"apt-get update && apt-get install -y build-essential"},
-		"/bin/bash",
+		Image:      "ubuntu:18.04",
+		Commands:   []string{"apt-get update && apt-get install -y build-essential"},
+		EntryPoint: "/bin/bash",
+		Packages:   []string{"build-essential"},
 	},
 	"java": {
-		"openjdk:7",
-		[]string{},
-		"/bin/bash",
+		Image:      "openjdk:7",
+		Commands:   []string{},
+		EntryPoint: "/bin/bash",
+		Packages:   []string{"default-jdk-headless"},
 	},
 	"go": {
-		"golang:1.16.5-buster",
-		[]string{},
-		"/bin/bash",
+		Image:      "golang:1.16.5-buster",
+		Commands:   []string{},
+		EntryPoint: "/bin/bash",
+		Setup:      []SetupStep{{[]string{"go.mod"}, "go mod download"}},
+		Toolchain:  []string{"/usr/local/go"},
+		Env:        []string{"GOPATH=/go", "PATH=/usr/local/go/bin:/go/bin:$PATH"},
+	},
+	"ruby": {
+		Image:      "ruby:3.0",
+		Commands:   []string{},
+		EntryPoint: "/bin/bash",
+		Setup:      []SetupStep{{[]string{"Gemfile"}, "bundle install"}},
+		Packages:   []string{"ruby-full", "ruby-bundler"},
+	},
+	"rust": {
+		Image:      "rust:1.53",
+		Commands:   []string{},
+		EntryPoint: "/bin/bash",
+		Setup:      []SetupStep{{[]string{"Cargo.toml"}, "cargo fetch"}},
+		Toolchain:  []string{"/usr/local/cargo", "/usr/local/rustup"},
+		Env:        []string{"RUSTUP_HOME=/usr/local/rustup", "CARGO_HOME=/usr/local/cargo", "PATH=/usr/local/cargo/bin:$PATH"},
+		Packages:   []string{"gcc", "libc6-dev"},
 	},
 	"unknown": {
-		"ubuntu:18.04",
-		[]string{},
-		"/bin/bash",
+		Image:      "ubuntu:18.04",
+		Commands:   []string{},
+		EntryPoint: "/bin/bash",
 	},
 }
 
@@ -650,7 +689,7 @@ var ExtensionToLanguage = map[string]string{
 	".robot":               "robotframework",
 	".ron":                 "markdown",
 	".rq":                  "sparql",
-	".rs":                  "renderscript",
+	".rs":                  "rust",
 	".rsh":                 "renderscript",
 	".rss":                 "xml",
 	".rst":                 "restructuredtext",
@@ -0,0 +1,439 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/go-connections/nat"
+)
+
+// Locations of the devcontainer.json of a repository, in order of preference
+var devcontainerFiles = []string{filepath.Join(".devcontainer", "devcontainer.json"), ".devcontainer.json"}
+
+// Folder generated Dockerfiles copy the repository to
+const containerWorkspaceFolder = "/app"
+
+var devcontainerVariablePattern = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// findDevcontainer returns the path of the devcontainer.json of the repository
+// at dirPath relative to it, or an empty string if it does not have one
+func findDevcontainer(dirPath string) string {
+	for _, name := range devcontainerFiles {
+		if exists, info, _ := pathExists(filepath.Join(dirPath, name)); exists && !info.IsDir() {
+			return name
+		}
+	}
+	return ""
+}
+
+// readDevcontainer translates the devcontainer.json of the repository at dirPath
+// into a manifest, returning nil if it does not have one or if it describes a
+// compose project, which dockbox reads from the compose file itself
+func readDevcontainer(dirPath string) (*projectManifest, error) {
+	name := findDevcontainer(dirPath)
+	if name == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dirPath, name))
+	if err != nil {
+		return nil, err
+	}
+	data = stripJSONComments(data)
+	var devcontainer devcontainerConfig
+	if err := json.Unmarshal(data, &devcontainer); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, jsonErrorMessage(data, err))
+	}
+	if devcontainer.DockerComposeFile != nil {
+		log.Printf("Warning: Ignoring %s, which describes a compose project. Compose files are only read from the root of the repository.", name)
+		return nil, nil
+	}
+	manifest, problems := devcontainer.toManifest(dirPath, name)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid %s:\n  - %s", name, strings.Join(problems, "\n  - "))
+	}
+	return manifest, nil
+}
+
+// toManifest translates the devcontainer.json at name in the repository at
+// dirPath, returning every problem found in it
+func (devcontainer *devcontainerConfig) toManifest(dirPath string, name string) (*projectManifest, []string) {
+	problems := make([]string, 0)
+	manifest := &projectManifest{source: name, Env: devcontainer.ContainerEnv, User: devcontainer.RemoteUser}
+	if manifest.User == "" {
+		manifest.User = devcontainer.ContainerUser
+	}
+	expand := func(value string) string {
+		return expandDevcontainerVariables(dirPath, value)
+	}
+
+	// Older devcontainer.json files set the Dockerfile at the top level
+	build := devcontainer.Build
+	if build.Dockerfile == "" && devcontainer.DockerFile != "" {
+		build.Dockerfile, build.Context = devcontainer.DockerFile, devcontainer.Context
+	}
+	if build.Dockerfile != "" {
+		// Paths are relative to the folder of the devcontainer.json
+		dockerFile := filepath.Join(dirPath, filepath.Dir(name), build.Dockerfile)
+		relPath, err := filepath.Rel(dirPath, dockerFile)
+		if err != nil || !isWithinDir(dirPath, dockerFile) {
+			problems = append(problems, fmt.Sprintf("build.dockerfile: %s must be inside the repository", build.Dockerfile))
+		} else if exists, _, _ := pathExists(dockerFile); !exists {
+			problems = append(problems, fmt.Sprintf("build.dockerfile: %s does not exist", relPath))
+		}
+		manifest.dockerfile = relPath
+		manifest.buildArgs = make(map[string]string, len(build.Args))
+		for key, value := range build.Args {
+			manifest.buildArgs[key] = expand(value)
+		}
+		if context := filepath.Join(dirPath, filepath.Dir(name), build.Context); build.Context != "" && filepath.Clean(context) != filepath.Clean(dirPath) {
+			log.Printf("Warning: %s builds from %s, dockbox builds from the root of the repository instead", name, build.Context)
+		}
+		if build.Target != "" {
+			log.Printf("Warning: Ignoring build.target of %s, the last stage of %s is built", name, relPath)
+		}
+	} else if devcontainer.Image == "" {
+		problems = append(problems, "image: an image or build.dockerfile is required")
+	} else if _, err := reference.ParseNormalizedNamed(devcontainer.Image); err != nil {
+		problems = append(problems, fmt.Sprintf("image: invalid image %q: %s", devcontainer.Image, err))
+	}
+	manifest.Image = devcontainer.Image
+
+	// Lifecycle commands run once the container is created, so they are the setup of the dockbox
+	lifecycle := []struct {
+		key   string
+		value interface{}
+	}{
+		{"onCreateCommand", devcontainer.OnCreateCommand},
+		{"updateContentCommand", devcontainer.UpdateContentCommand},
+		{"postCreateCommand", devcontainer.PostCreateCommand},
+	}
+	for _, step := range lifecycle {
+		commands, err := devcontainerCommands(step.value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", step.key, err))
+		}
+		for _, command := range commands {
+			manifest.Setup = append(manifest.Setup, expand(command))
+		}
+	}
+
+	for i, value := range devcontainer.ForwardPorts {
+		var port string
+		switch value := value.(type) {
+		case float64:
+			port = fmt.Sprint(value)
+		case string:
+			port = value
+		}
+		if _, err := nat.ParsePortSpec(publishedPortSpec(port)); port == "" || err != nil {
+			problems = append(problems, fmt.Sprintf("forwardPorts[%d]: invalid port %v, expected a port number", i, value))
+			continue
+		}
+		manifest.Ports = append(manifest.Ports, port)
+	}
+
+	keys := make([]string, 0, len(manifest.Env))
+	for key := range manifest.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !envKeyPattern.MatchString(key) {
+			problems = append(problems, fmt.Sprintf("containerEnv: invalid variable name %q", key))
+		}
+		manifest.Env[key] = expand(manifest.Env[key])
+	}
+
+	for i, value := range devcontainer.Mounts {
+		spec, err := devcontainerMount(dirPath, value, expand)
+		if err == nil {
+			_, err = parseManifestMount(spec)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("mounts[%d]: %s", i, err))
+			continue
+		}
+		manifest.Mounts = append(manifest.Mounts, spec)
+	}
+	return manifest, problems
+}
+
+// devcontainerCommands returns the shell commands of a lifecycle command, given
+// as a string, as an array of arguments or as an object of named commands
+func devcontainerCommands(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if strings.TrimSpace(value) == "" {
+			return nil, nil
+		}
+		return []string{value}, nil
+	case []interface{}:
+		args := make([]string, len(value))
+		for i, arg := range value {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid argument %v, expected a string", arg)
+			}
+			args[i] = shellQuote(s)
+		}
+		return []string{strings.Join(args, " ")}, nil
+	case map[string]interface{}:
+		// Named commands run in parallel in a devcontainer, in order of name here
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		commands := make([]string, 0, len(value))
+		for _, name := range names {
+			if _, ok := value[name].(map[string]interface{}); ok {
+				return nil, fmt.Errorf("invalid command %s, expected a string or an array", name)
+			}
+			command, err := devcontainerCommands(value[name])
+			if err != nil {
+				return nil, fmt.Errorf("invalid command %s: %s", name, err)
+			}
+			commands = append(commands, command...)
+		}
+		return commands, nil
+	default:
+		return nil, fmt.Errorf("invalid command %v, expected a string, an array or an object", value)
+	}
+}
+
+// shellQuote quotes an argument for a shell if needed
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\$`|&;<>()*?[]#~!{}") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// devcontainerMount converts a mount of a devcontainer.json of the repository at
+// dirPath, given in the --mount format of docker run or as an object, into a
+// mount of a manifest
+func devcontainerMount(dirPath string, value interface{}, expand func(string) string) (string, error) {
+	options := make(map[string]string)
+	switch value := value.(type) {
+	case string:
+		for _, option := range strings.Split(value, ",") {
+			parts := strings.SplitN(option, "=", 2)
+			options[strings.ToLower(strings.TrimSpace(parts[0]))] = parts[len(parts)-1]
+		}
+	case map[string]interface{}:
+		for key, option := range value {
+			options[strings.ToLower(key)] = fmt.Sprint(option)
+		}
+	default:
+		return "", fmt.Errorf("invalid mount %v, expected a string or an object", value)
+	}
+	source := expand(firstOption(options, "source", "src"))
+	target := expand(firstOption(options, "target", "destination", "dst"))
+	if target == "" {
+		return "", fmt.Errorf("mount %v has no target", value)
+	}
+
+	switch options["type"] {
+	case "bind":
+		// Sources are usually given from ${localWorkspaceFolder}
+		if filepath.IsAbs(source) {
+			absPath, err := filepath.Abs(dirPath)
+			if err != nil {
+				return "", err
+			}
+			if !isWithinDir(absPath, source) {
+				return "", fmt.Errorf("source %s of mount must be inside the repository", source)
+			}
+			if source, err = filepath.Rel(absPath, source); err != nil {
+				return "", err
+			}
+		}
+		if !strings.HasPrefix(source, ".") && !strings.HasPrefix(source, "~") {
+			source = "./" + source
+		}
+	case "volume", "":
+		if source == "" {
+			return "", fmt.Errorf("anonymous volume %s is not supported, give it a source", target)
+		}
+	default:
+		return "", fmt.Errorf("unsupported mount type %q", options["type"])
+	}
+	spec := source + ":" + target
+	if _, ok := options["readonly"]; ok || options["ro"] == "true" {
+		spec += ":ro"
+	}
+	return spec, nil
+}
+
+func firstOption(options map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := options[key]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// expandDevcontainerVariables replaces the variables of a devcontainer.json
+// describing the repository at dirPath and the environment of the host
+func expandDevcontainerVariables(dirPath string, value string) string {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		absPath = dirPath
+	}
+	return devcontainerVariablePattern.ReplaceAllStringFunc(value, func(match string) string {
+		variable := match[2 : len(match)-1]
+		switch variable {
+		case "localWorkspaceFolder":
+			return absPath
+		case "localWorkspaceFolderBasename":
+			return filepath.Base(absPath)
+		case "containerWorkspaceFolder":
+			return containerWorkspaceFolder
+		case "containerWorkspaceFolderBasename":
+			return filepath.Base(containerWorkspaceFolder)
+		}
+		if strings.HasPrefix(variable, "localEnv:") || strings.HasPrefix(variable, "env:") {
+			parts := strings.SplitN(variable[strings.Index(variable, ":")+1:], ":", 2)
+			if value, ok := os.LookupEnv(parts[0]); ok {
+				return value
+			}
+			if len(parts) == 2 {
+				return parts[1]
+			}
+			return ""
+		}
+		// Variables of the container are left for its shell
+		return match
+	})
+}
+
+// stripJSONComments removes the comments and trailing commas JSONC files such
+// as devcontainer.json can have, keeping the lines of the rest in place
+func stripJSONComments(data []byte) []byte {
+	var out bytes.Buffer
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			out.WriteByte(c)
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(data) - i - 2
+			}
+			out.Write(bytes.Repeat([]byte("\n"), bytes.Count(data[i+2:i+2+end], []byte("\n"))))
+			i += end + 3
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return removeTrailingCommas(out.Bytes())
+}
+
+func removeTrailingCommas(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString, escaped := false, false
+	for i, c := range data {
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		} else if c == '"' {
+			inString = true
+		} else if c == ',' {
+			next := bytes.TrimLeft(data[i+1:], " \t\r\n")
+			if len(next) > 0 && (next[0] == '}' || next[0] == ']') {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// jsonErrorMessage describes an error decoding data with the line it happened on
+func jsonErrorMessage(data []byte, err error) string {
+	var offset int64
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+	} else {
+		return strings.TrimPrefix(err.Error(), "json: ")
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	return fmt.Sprintf("line %d: %s", line, strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// generateDockerfileFromDevcontainer generates the Dockerfile of a dockbox from the
+// Dockerfile of its devcontainer.json, with the repository copied to the workspace
+// folder and the setup of the devcontainer run in it
+func generateDockerfileFromDevcontainer(dirPath string, manifest *projectManifest) (string, error) {
+	dockerFile, err := ioutil.ReadFile(filepath.Join(dirPath, manifest.dockerfile))
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.Write(bytes.TrimRight(dockerFile, "\n"))
+	sb.WriteString(fmt.Sprintf("\nWORKDIR %s\nCOPY . .\n", containerWorkspaceFolder))
+	for _, command := range manifest.Setup {
+		sb.WriteString(fmt.Sprintf("RUN %s\n", command))
+	}
+	return writeGeneratedDockerfile(dirPath, sb.String())
+}
+
+// devcontainerBuildOptions adds the build args of the devcontainer.json of the
+// repository at dirPath to buildOptions. The build args given on the command
+// line come last, so that they take precedence.
+func devcontainerBuildOptions(dirPath string, buildOptions BuildOptions) (BuildOptions, error) {
+	manifest, err := readProjectManifest(dirPath)
+	if err != nil || manifest == nil || len(manifest.buildArgs) == 0 {
+		return buildOptions, err
+	}
+	buildArgs := make([]string, 0, len(manifest.buildArgs)+len(buildOptions.buildArgs))
+	for key, value := range manifest.buildArgs {
+		buildArgs = append(buildArgs, key+"="+value)
+	}
+	sort.Strings(buildArgs)
+	buildOptions.buildArgs = append(buildArgs, buildOptions.buildArgs...)
+	return buildOptions, nil
+}
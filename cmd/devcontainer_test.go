@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDevcontainer = `// Generated by the VS Code extension
+{
+	"name": "App", // the name is only shown by editors
+	"image": "mcr.microsoft.com/devcontainers/python:3.9",
+	/* Setup of the
+	   environment */
+	"onCreateCommand": {
+		"tools": ["pip", "install", "black"],
+		"deps": "pip install -r requirements.txt",
+	},
+	"postCreateCommand": ["python", "-c", "print('ready')"],
+	"forwardPorts": [8000, "9090:80"],
+	"containerEnv": {
+		"WORKSPACE": "${containerWorkspaceFolder}",
+		"APP_URL": "http://localhost//app",
+	},
+	"remoteUser": "vscode",
+	"mounts": [
+		"source=${localWorkspaceFolder}/data,target=/data,type=bind,readonly",
+		{"source": "cache", "target": "/home/vscode/.cache", "type": "volume"},
+	],
+	"customizations": {"vscode": {"extensions": ["ms-python.python"]}},
+}
+`
+
+// newDevcontainerTestFolder returns a repository holding the given devcontainer.json
+func newDevcontainerTestFolder(t *testing.T, devcontainer string) string {
+	return newTestFolder(t, map[string]string{
+		"data/":                             "",
+		".devcontainer/devcontainer.json":   devcontainer,
+		HIDDEN_DIRECTORY + "/.dockbox.yaml": "image: dockbox/app1\n",
+	})
+}
+
+func TestDevcontainerImage(t *testing.T) {
+	dirPath := newDevcontainerTestFolder(t, testDevcontainer)
+
+	dockerFileName, _, err := getDockerfile(dirPath)
+	assert.Nil(t, err)
+	dockerFile, err := ioutil.ReadFile(filepath.Join(dirPath, dockerFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, `FROM mcr.microsoft.com/devcontainers/python:3.9
+WORKDIR /app
+COPY . .
+RUN pip install -r requirements.txt
+RUN pip install black
+RUN python -c 'print('\''ready'\'')'
+`, string(dockerFile))
+
+	var volumes []string
+	fakeDockerCli := &fakeDockerClient{
+		volumeCreate: func(c context.Context, options volume.VolumeCreateBody) (types.Volume, error) {
+			volumes = append(volumes, options.Name)
+			return types.Volume{Name: options.Name}, nil
+		},
+		containerCreate: func(c context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+			assert.Equal(t, "vscode", config.User)
+			assert.Equal(t, []string{"APP_URL=http://localhost//app", "WORKSPACE=/app"}, config.Env)
+			assert.Equal(t, nat.PortMap{
+				"8000/tcp": {{HostPort: "8000"}},
+				"80/tcp":   {{HostPort: "9090"}},
+			}, hostConfig.PortBindings)
+			assert.Equal(t, []mount.Mount{
+				{Type: mount.TypeBind, Source: filepath.Join(dirPath, "data"), Target: "/data", ReadOnly: true},
+				{Type: mount.TypeVolume, Source: "app1_cache", Target: "/home/vscode/.cache"},
+			}, hostConfig.Mounts)
+			return container.ContainerCreateCreatedBody{ID: "app1_ctr"}, nil
+		},
+	}
+	containerID, err := createContainerFromPath(context.Background(), fakeDockerCli, dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "app1_ctr", containerID)
+	assert.Equal(t, []string{"app1_cache"}, volumes)
+}
+
+func TestDevcontainerDockerfile(t *testing.T) {
+	dirPath := newDevcontainerTestFolder(t, `{
+	"build": {"dockerfile": "Dockerfile", "context": "..", "args": {"VARIANT": "3.9 slim"}},
+	"postCreateCommand": "make install",
+}`)
+	// The default of VARIANT in the Dockerfile is replaced by the build arg
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, ".devcontainer", "Dockerfile"), []byte("ARG VARIANT=3.10\nARG USER=vscode\nFROM python:${VARIANT}\n"), 0644))
+
+	dockerFileName, _, err := getDockerfile(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(HIDDEN_DIRECTORY, ".Dockerfile.dockbox"), dockerFileName)
+	dockerFile, err := ioutil.ReadFile(filepath.Join(dirPath, dockerFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, "ARG VARIANT=3.10\nARG USER=vscode\nFROM python:${VARIANT}\nWORKDIR /app\nCOPY . .\nRUN make install\n", string(dockerFile))
+
+	// Build args given on the command line take precedence
+	buildOptions, err := devcontainerBuildOptions(dirPath, BuildOptions{buildArgs: []string{"USER=root"}})
+	assert.Nil(t, err)
+	fakeDockerCli := &fakeDockerClient{
+		imageBuild: func(c context.Context, r io.Reader, ibo types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+			variant, user := "3.9 slim", "root"
+			assert.Equal(t, map[string]*string{"VARIANT": &variant, "USER": &user}, ibo.BuildArgs)
+			return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(`{"stream":"Successfully built 39a8cfeef173\n"}` + "\n"))}, nil
+		},
+	}
+	_, err = buildImage(fakeDockerCli, dirPath, dockerFileName, "app1", nil, buildOptions)
+	assert.Nil(t, err)
+
+	// dockbox.yaml takes precedence over devcontainer.json
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, PROJECT_MANIFEST), []byte("image: ubuntu:18.04\n"), 0644))
+	manifest, err := readProjectManifest(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "ubuntu:18.04", manifest.Image)
+}
+
+func TestDevcontainerErrors(t *testing.T) {
+	testcases := []struct {
+		name          string
+		devcontainer  string
+		expectedError string
+	}{
+		{
+			name:          "Syntax",
+			devcontainer:  "{\n  // comment\n  \"image\": \"ubuntu\"\n  \"remoteUser\": \"root\"\n}",
+			expectedError: "invalid .devcontainer/devcontainer.json: line 4: invalid character '\"' after object key:value pair",
+		},
+		{
+			name:          "WrongType",
+			devcontainer:  "{\n  \"image\": \"ubuntu\",\n  \"forwardPorts\": 8000\n}",
+			expectedError: "invalid .devcontainer/devcontainer.json: line 3: cannot unmarshal number into Go struct field devcontainerConfig.forwardPorts of type []interface {}",
+		},
+		{
+			name: "Invalid",
+			devcontainer: `{
+	"postCreateCommand": {"setup": {"run": "make"}},
+	"forwardPorts": ["db:5432", true],
+	"containerEnv": {"MY-VAR": "x"},
+	"mounts": ["target=/tmp,type=tmpfs", "source=data", 42, "source=/etc,target=/etc,type=bind", "source=~/.ssh,target=/root/.ssh,type=bind"],
+}`,
+			expectedError: `invalid .devcontainer/devcontainer.json:
+  - image: an image or build.dockerfile is required
+  - postCreateCommand: invalid command setup, expected a string or an array
+  - forwardPorts[0]: invalid port db:5432, expected a port number
+  - forwardPorts[1]: invalid port true, expected a port number
+  - containerEnv: invalid variable name "MY-VAR"
+  - mounts[0]: unsupported mount type "tmpfs"
+  - mounts[1]: mount source=data has no target
+  - mounts[2]: invalid mount 42, expected a string or an object
+  - mounts[3]: source /etc of mount must be inside the repository
+  - mounts[4]: source of mount "~/.ssh:/root/.ssh" must be a folder of the repository, given relative to it`,
+		},
+		{
+			name:          "MissingDockerfile",
+			devcontainer:  `{"build": {"dockerfile": "Dockerfile.dev"}}`,
+			expectedError: "invalid .devcontainer/devcontainer.json:\n  - build.dockerfile: .devcontainer/Dockerfile.dev does not exist",
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := newDevcontainerTestFolder(t, test.devcontainer)
+			_, _, err := getDockerfile(dirPath)
+			assert.EqualError(t, err, test.expectedError)
+		})
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	assert.Equal(t, "{\"url\": \"http://a/*b*/\" \n\n}", string(stripJSONComments([]byte("{\"url\": \"http://a/*b*/\", // c\n/* d\n */}"))))
+	assert.Equal(t, `["a,]", "b\"," ]`, string(stripJSONComments([]byte(`["a,]", "b\",", ]`))))
+}
@@ -28,6 +28,9 @@ import (
 
 var cfgFile string
 
+// Version of dockbox, recorded in the labels of images built by dockbox
+var Version = "dev"
+
 // rootCmd represents the base command when called without any subcommands
 func NewRootCmd(cli dockerClient) *cobra.Command {
 	var rootCmd = &cobra.Command{
@@ -41,14 +44,23 @@ Manage workspaces and dependencies with ease in an isolated, secure environment.
 To get started with dockbox, try entering:
 
 	dockbox create <url>`,
+		Version: Version,
 	}
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.dockbox.yaml)")
 
 	rootCmd.AddCommand(
 		NewCleanCommand(cli),
 		NewCreateCommand(cli),
+		NewDuCommand(cli),
 		NewEnterCommand(cli),
+		NewExportCommand(cli),
+		NewImportCommand(cli),
 		NewListCommand(cli),
+		NewPullCommand(cli),
+		NewPushCommand(cli),
+		NewRebuildCommand(cli),
+		NewSnapshotCommand(cli),
+		NewTrashCommand(cli),
 		NewTreeCommand(cli),
 	)
 	return rootCmd
@@ -5,15 +5,21 @@ import (
 	"flag"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"testing"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 )
@@ -33,12 +39,27 @@ type fakeDockerClient struct {
 	containerStop       func(context.Context, string, *time.Duration) error
 	containerRemove     func(context.Context, string, types.ContainerRemoveOptions) error
 	containerStart      func(context.Context, string, types.ContainerStartOptions) error
+	containerInspect    func(context.Context, string) (types.ContainerJSON, error)
+	containerCommit     func(context.Context, string, types.ContainerCommitOptions) (types.IDResponse, error)
 	containerCreate     func(context.Context, *container.Config, *container.HostConfig, *network.NetworkingConfig, *specs.Platform, string) (container.ContainerCreateCreatedBody, error)
+	volumeCreate        func(context.Context, volume.VolumeCreateBody) (types.Volume, error)
+	volumeList          func(context.Context, filters.Args) (volume.VolumeListOKBody, error)
+	volumeRemove        func(context.Context, string, bool) error
+	networkCreate       func(context.Context, string, types.NetworkCreate) (types.NetworkCreateResponse, error)
+	networkList         func(context.Context, types.NetworkListOptions) ([]types.NetworkResource, error)
+	networkRemove       func(context.Context, string) error
+	buildCachePrune     func(context.Context, types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error)
 	imageList           func(context.Context, types.ImageListOptions) ([]types.ImageSummary, error)
 	imageInspectWithRaw func(context.Context, string) (types.ImageInspect, []byte, error)
 	imageHistory        func(context.Context, string) ([]image.HistoryResponseItem, error)
 	imageRemove         func(context.Context, string, types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+	imageSave           func(context.Context, []string) (io.ReadCloser, error)
+	imageLoad           func(context.Context, io.Reader, bool) (types.ImageLoadResponse, error)
+	imageTag            func(context.Context, string, string) error
+	imagePush           func(context.Context, string, types.ImagePushOptions) (io.ReadCloser, error)
+	imagePull           func(context.Context, string, types.ImagePullOptions) (io.ReadCloser, error)
 	imageBuild          func(context.Context, io.Reader, types.ImageBuildOptions) (types.ImageBuildResponse, error)
+	dialHijack          func(context.Context, string, string, map[string][]string) (net.Conn, error)
 }
 
 func (fakeCli *fakeDockerClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
@@ -56,9 +77,36 @@ func (fakeCli *fakeDockerClient) ContainerRemove(ctx context.Context, containerI
 func (fakeCli *fakeDockerClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
 	return fakeCli.containerStart(ctx, containerID, options)
 }
+func (fakeCli *fakeDockerClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return fakeCli.containerInspect(ctx, containerID)
+}
+func (fakeCli *fakeDockerClient) ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error) {
+	return fakeCli.containerCommit(ctx, container, options)
+}
 func (fakeCli *fakeDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
 	return fakeCli.containerCreate(ctx, config, hostConfig, networkingConfig, platform, containerName)
 }
+func (fakeCli *fakeDockerClient) VolumeCreate(ctx context.Context, options volume.VolumeCreateBody) (types.Volume, error) {
+	return fakeCli.volumeCreate(ctx, options)
+}
+func (fakeCli *fakeDockerClient) VolumeList(ctx context.Context, filter filters.Args) (volume.VolumeListOKBody, error) {
+	return fakeCli.volumeList(ctx, filter)
+}
+func (fakeCli *fakeDockerClient) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	return fakeCli.volumeRemove(ctx, volumeID, force)
+}
+func (fakeCli *fakeDockerClient) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	return fakeCli.networkCreate(ctx, name, options)
+}
+func (fakeCli *fakeDockerClient) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	return fakeCli.networkList(ctx, options)
+}
+func (fakeCli *fakeDockerClient) NetworkRemove(ctx context.Context, networkID string) error {
+	return fakeCli.networkRemove(ctx, networkID)
+}
+func (fakeCli *fakeDockerClient) BuildCachePrune(ctx context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error) {
+	return fakeCli.buildCachePrune(ctx, opts)
+}
 func (fakeCli *fakeDockerClient) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
 	return fakeCli.imageList(ctx, options)
 }
@@ -71,14 +119,90 @@ func (fakeCli *fakeDockerClient) ImageHistory(ctx context.Context, imageID strin
 func (fakeCli *fakeDockerClient) ImageRemove(ctx context.Context, imageID string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
 	return fakeCli.imageRemove(ctx, imageID, options)
 }
+func (fakeCli *fakeDockerClient) ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	return fakeCli.imageSave(ctx, imageIDs)
+}
+func (fakeCli *fakeDockerClient) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+	return fakeCli.imageLoad(ctx, input, quiet)
+}
+func (fakeCli *fakeDockerClient) ImageTag(ctx context.Context, source, target string) error {
+	return fakeCli.imageTag(ctx, source, target)
+}
+func (fakeCli *fakeDockerClient) ImagePush(ctx context.Context, image string, options types.ImagePushOptions) (io.ReadCloser, error) {
+	return fakeCli.imagePush(ctx, image, options)
+}
+func (fakeCli *fakeDockerClient) ImagePull(ctx context.Context, refStr string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	return fakeCli.imagePull(ctx, refStr, options)
+}
 func (fakeCli *fakeDockerClient) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
 	return fakeCli.imageBuild(ctx, buildContext, options)
 }
+func (fakeCli *fakeDockerClient) DialHijack(ctx context.Context, url, proto string, meta map[string][]string) (net.Conn, error) {
+	return fakeCli.dialHijack(ctx, url, proto, meta)
+}
+
+// filterImagesByLabel applies the label and reference filters of options like
+// the daemon does
+func filterImagesByLabel(images []types.ImageSummary, options types.ImageListOptions) []types.ImageSummary {
+	filtered := make([]types.ImageSummary, 0)
+	for _, image := range images {
+		if options.Filters.MatchKVList("label", image.Labels) && matchReference(options.Filters, image.RepoTags) {
+			filtered = append(filtered, image)
+		}
+	}
+	return filtered
+}
+
+// matchReference reports whether one of repoTags matches the reference filters
+func matchReference(filter filters.Args, repoTags []string) bool {
+	patterns := filter.Get("reference")
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		for _, repoTag := range repoTags {
+			name := strings.SplitN(repoTag, ":", 2)[0]
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterContainersByLabel applies the label filters of options like the daemon does
+func filterContainersByLabel(containers []types.Container, options types.ContainerListOptions) []types.Container {
+	filtered := make([]types.Container, 0)
+	for _, container := range containers {
+		if options.Filters.MatchKVList("label", container.Labels) {
+			filtered = append(filtered, container)
+		}
+	}
+	return filtered
+}
+
+// newTestFolder creates a directory for a dockbox holding the given files, keyed
+// by their path. Paths ending with a slash are created as empty directories.
+func newTestFolder(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dirPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+	for name, content := range files {
+		filePath := filepath.Join(dirPath, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			assert.Nil(t, os.MkdirAll(filePath, 0755))
+			continue
+		}
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		assert.Nil(t, ioutil.WriteFile(filePath, []byte(content), 0644))
+	}
+	return dirPath
+}
 
 func TestNewRootCommand(t *testing.T) {
 	fakeCli := &fakeDockerClient{}
 	fakeRootCmd := NewRootCmd(fakeCli)
-	expected := map[string]bool{"clean": false, "create": false, "enter": false, "list": false, "tree": false}
+	expected := map[string]bool{"clean": false, "create": false, "du": false, "enter": false, "export": false, "import": false, "list": false, "pull": false, "push": false, "rebuild": false, "snapshot": false, "trash": false, "tree": false}
 	actual := fakeRootCmd.Commands()
 	for _, cmd := range actual {
 		t.Logf("%s\n", cmd.Name())
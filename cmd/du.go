@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types"
+	units "github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+// duCmd represents the du command
+func NewDuCommand(cli dockerClient) *cobra.Command {
+	var duOptions = DuOptions{}
+	var duCmd = &cobra.Command{
+		Use:   "du [OPTS]",
+		Short: "Shows the disk space used by your dockboxes",
+		Long: `Shows how much disk space each dockbox uses. Layers only used by a dockbox
+	are counted as unique to it, while layers it shares with other images are
+	counted as shared. Reclaimable space is what cleaning the dockbox would free,
+	including the writable layers of its containers.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			res, err := RunDuCommand(cli, duOptions)
+			CheckError(err)
+			fmt.Print(res)
+		},
+	}
+	duCmd.PersistentFlags().StringVarP(&duOptions.Format, "format", "f", FORMAT_TABLE, "Output format: table or json")
+	addHistoryFlags(duCmd, &duOptions.history)
+
+	return duCmd
+}
+
+func RunDuCommand(cli dockerClient, duOptions DuOptions) (string, error) {
+	if duOptions.Format != FORMAT_TABLE && duOptions.Format != FORMAT_JSON {
+		return "", fmt.Errorf("invalid format %q: must be one of table or json", duOptions.Format)
+	}
+	ctx := context.Background()
+	report, err := getDiskUsage(ctx, cli, duOptions.history)
+	if err != nil {
+		return "", err
+	}
+
+	if duOptions.Format == FORMAT_JSON {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(out) + "\n", nil
+	}
+
+	var buf bytes.Buffer
+	tabWriter := tabwriter.NewWriter(&buf, 1, 1, 2, ' ', 0)
+	fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\n", "NAME", "UNIQUE", "SHARED", "CONTAINERS", "RECLAIMABLE")
+	for _, usage := range report.Dockboxes {
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\n", usage.Name, humanSize(usage.Unique), humanSize(usage.Shared), humanSize(usage.Containers), humanSize(usage.Reclaimable))
+	}
+	tabWriter.Flush()
+	fmt.Fprintf(&buf, "\nTotal reclaimable if all dockboxes are cleaned: %s\n", humanSize(report.Reclaimable))
+	return buf.String(), nil
+}
+
+func humanSize(size int64) string {
+	return units.HumanSize(float64(size))
+}
+
+// getDiskUsage computes the disk usage of every dockbox. A layer is unique to a
+// dockbox if no other tagged image is built from it, so that it would be
+// removed along with the dockbox. Snapshots and the images of compose services
+// are counted with their dockbox.
+func getDiskUsage(ctx context.Context, cli dockerClient, treeOptions TreeOptions) (DiskUsageReport, error) {
+	report := DiskUsageReport{Dockboxes: make([]DockboxDiskUsage, 0)}
+
+	dockboxImages, err := getDockboxImages(ctx, cli, ListOptions{})
+	if err != nil {
+		return report, err
+	}
+	allImages, err := listDockboxImages(ctx, cli)
+	if err != nil {
+		return report, err
+	}
+	treeOptions.All = true
+	forest, err := buildImageForest(ctx, cli, treeOptions)
+	if err != nil {
+		return report, err
+	}
+	containers, err := listDockboxContainers(ctx, cli, types.ContainerListOptions{All: true, Size: true})
+	if err != nil {
+		return report, err
+	}
+
+	// owner maps the images of dockboxes and their companions to the dockbox image
+	owner := make(map[string]string, len(allImages))
+	nameToID := make(map[string]string, len(dockboxImages))
+	for _, image := range dockboxImages {
+		owner[image.ID] = image.ID
+		nameToID[image.Labels[LABEL_NAME]] = image.ID
+	}
+	for _, image := range allImages {
+		if dockboxID, ok := nameToID[image.Labels[LABEL_NAME]]; ok && isCompanionImage(image.Labels) {
+			owner[image.ID] = dockboxID
+		}
+	}
+
+	containerSizes := make(map[string]int64)
+	for _, container := range containers {
+		if dockboxID, ok := owner[container.ImageID]; ok {
+			containerSizes[dockboxID] += container.SizeRw
+		}
+	}
+
+	users := forest.taggedUsers()
+	owners := func(node *ImageNode) map[string]bool {
+		nodeOwners := make(map[string]bool)
+		for imageID := range users[node] {
+			nodeOwners[owner[imageID]] = true
+		}
+		return nodeOwners
+	}
+
+	for _, image := range dockboxImages {
+		usage := DockboxDiskUsage{
+			Name:       repoTagToDockboxName(image.RepoTags[0]),
+			Image:      image.ID,
+			Containers: containerSizes[image.ID],
+		}
+		counted := make(map[*ImageNode]bool)
+		for imageID, dockboxID := range owner {
+			if dockboxID != image.ID {
+				continue
+			}
+			for node := forest.IDToNode[imageID]; node != nil && !counted[node]; node = node.parent {
+				counted[node] = true
+				if nodeOwners := owners(node); len(nodeOwners) == 1 && nodeOwners[image.ID] {
+					usage.Unique += node.size
+				} else {
+					usage.Shared += node.size
+				}
+			}
+		}
+		usage.Reclaimable = usage.Unique + usage.Containers
+		report.Dockboxes = append(report.Dockboxes, usage)
+		report.Reclaimable += usage.Containers
+	}
+	sort.SliceStable(report.Dockboxes, func(i, j int) bool {
+		return report.Dockboxes[i].Name < report.Dockboxes[j].Name
+	})
+
+	// Cleaning every dockbox frees the layers only dockboxes are built from
+	for node := range users {
+		if !owners(node)[""] {
+			report.Reclaimable += node.size
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuSuccess(t *testing.T) {
+	testcases := []struct {
+		name      string
+		duOptions DuOptions
+	}{
+		{name: "DuTable", duOptions: DuOptions{Format: FORMAT_TABLE}},
+		{name: "DuJSON", duOptions: DuOptions{Format: FORMAT_JSON}},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			fakeDockerCli := newTreeTestClient()
+			fakeDockerCli.containerList = func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
+				assert.True(t, clo.Size)
+				return filterContainersByLabel([]types.Container{
+					{ID: "app1_container", ImageID: "sha256:app1", Image: "dockbox/app1", SizeRw: 5000000, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1"}},
+					{ID: "other_container", ImageID: "sha256:ubuntu", SizeRw: 7000000},
+				}, clo), nil
+			}
+			actual, err := RunDuCommand(fakeDockerCli, test.duOptions)
+			assert.Nil(t, err)
+			assert.EqualValues(t, goldenValue(t, "du/"+test.name, actual, *update), actual)
+		})
+	}
+}
+
+func TestDuInvalidFormat(t *testing.T) {
+	_, err := RunDuCommand(newTreeTestClient(), DuOptions{Format: "yaml"})
+	assert.EqualError(t, err, `invalid format "yaml": must be one of table or json`)
+}
@@ -18,7 +18,9 @@ package cmd
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/moby/term"
 
@@ -45,6 +47,8 @@ func NewEnterCommand(cli dockerClient) *cobra.Command {
 			CheckError(RunEnterCommand(cli, enterOptions))
 		},
 	}
+	enterCmd.PersistentFlags().StringVar(&enterOptions.fromSnapshot, "from-snapshot", "", "Start a new container from the snapshot with this tag")
+	enterCmd.PersistentFlags().StringVar(&enterOptions.platform, "platform", "", "Rebuild and run the dockbox for this platform (e.g. linux/amd64) using emulation if needed")
 	return enterCmd
 }
 
@@ -58,12 +62,60 @@ func RunEnterCommand(cli dockerClient, enterOptions EnterOptions) error {
 	if err != nil {
 		return err
 	}
+	if enterOptions.platform != "" {
+		platform, err := normalizePlatform(enterOptions.platform)
+		if err != nil {
+			return err
+		}
+		currentPlatform, err := getConfigByKey(enterOptions.path, "platform")
+		if err != nil {
+			return err
+		}
+		if platform != currentPlatform {
+			// The image and container were built for another platform
+			log.Printf("Rebuilding dockbox for platform %s", platform)
+			if err := RunRebuildCommand(cli, RebuildOptions{path: enterOptions.path, build: BuildOptions{platform: platform}}); err != nil {
+				return err
+			}
+			container, err = getConfigByKey(enterOptions.path, "container")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if enterOptions.fromSnapshot != "" {
+		imageName, err := getConfigByKey(enterOptions.path, "image")
+		if err != nil {
+			return err
+		}
+		snapshotName, err := snapshotImageName(imageName, enterOptions.fromSnapshot)
+		if err != nil {
+			return err
+		}
+		if _, _, err := cli.ImageInspectWithRaw(ctx, snapshotName); err != nil {
+			return fmt.Errorf("snapshot %s not found: %s", enterOptions.fromSnapshot, err)
+		}
+		previousContainer := container
+		container, err = createContainer(ctx, cli, enterOptions.path, snapshotName)
+		if err != nil {
+			return err
+		}
+		if previousContainer != "" {
+			log.Printf("Replacing container %s with a container of snapshot %s", previousContainer, snapshotName)
+			if err := removeContainer(ctx, cli, previousContainer); err != nil && !strings.Contains(err.Error(), "No such container") {
+				return err
+			}
+		}
+	}
 	if container == "" {
 		container, err = createContainerFromPath(ctx, cli, enterOptions.path)
 		if err != nil {
 			return err
 		}
 	}
+	if err := startComposeServices(ctx, cli, enterOptions.path); err != nil {
+		return err
+	}
 	_, err = runContainer(ctx, cli, container)
 	return err
 
@@ -77,14 +129,40 @@ func createContainerFromPath(ctx context.Context, cli dockerClient, path string)
 	if imageName == "" {
 		return "", errors.New("no image found for dockbox")
 	}
-	createResponse, errCreate := cli.ContainerCreate(ctx, &container.Config{
+	return createContainer(ctx, cli, path, imageName)
+}
+
+// createContainer creates the container of the dockbox at path from the given
+// image, and records it in the dockbox configuration
+func createContainer(ctx context.Context, cli dockerClient, path string, imageName string) (string, error) {
+	platformName, err := getConfigByKey(path, "platform")
+	if err != nil {
+		return "", err
+	}
+	platform, err := parsePlatform(platformName)
+	if err != nil {
+		return "", err
+	}
+	config := &container.Config{
 		Image:        imageName,
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
 		Tty:          true,
 		OpenStdin:    true,
-	}, nil, nil, nil, "")
+	}
+	dockboxName := imageToDockboxName(imageName)
+	hostConfig, networkingConfig, err := applyComposeService(ctx, cli, path, dockboxName, config)
+	if err != nil {
+		return "", err
+	}
+	if hostConfig == nil {
+		hostConfig, err = applyProjectManifest(ctx, cli, path, dockboxName, config)
+		if err != nil {
+			return "", err
+		}
+	}
+	createResponse, errCreate := cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, platform, "")
 	if errCreate != nil {
 		return "", errCreate
 	}
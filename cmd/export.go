@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Version of the bundle format written by dockbox export
+const BUNDLE_VERSION = 1
+
+// Entries of a bundle, in the order they are written
+const BUNDLE_MANIFEST = "dockbox.json"
+const BUNDLE_IMAGE = "image.tar"
+const BUNDLE_FILES = "files/"
+
+// exportCmd represents the export command
+func NewExportCommand(cli dockerClient) *cobra.Command {
+	var exportOptions = ExportOptions{}
+	var exportCmd = &cobra.Command{
+		Use:   "export <name|path> [-o <file>]",
+		Short: "Exports a dockbox as a bundle that can be imported on another machine",
+		Long: `Bundles the image of a dockbox with its configuration and generated Dockerfile,
+	and optionally its source code, into a single archive. Use dockbox import to
+	load the bundle elsewhere.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exportOptions.arg = args[0]
+			output, err := RunExportCommand(cli, exportOptions)
+			CheckError(err)
+			fmt.Println("Successfully exported dockbox to " + output)
+		},
+	}
+	exportCmd.PersistentFlags().StringVarP(&exportOptions.output, "output", "o", "", "File to write the bundle to (default <name>.tar)")
+	exportCmd.PersistentFlags().BoolVarP(&exportOptions.includeSource, "include-source", "s", false, "Also bundle the source code of the dockbox")
+	return exportCmd
+}
+
+func RunExportCommand(cli dockerClient, exportOptions ExportOptions) (string, error) {
+	ctx := context.Background()
+	imageName, err := getImageNameFromArg(exportOptions.arg)
+	if err != nil {
+		return "", err
+	}
+	info, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		return "", fmt.Errorf("no dockbox named %s: %s", repoTagToDockboxName(imageName), err)
+	}
+	var labels map[string]string
+	if info.Config != nil {
+		labels = info.Config.Labels
+	}
+
+	manifest := bundleManifest{
+		Version:       BUNDLE_VERSION,
+		Name:          repoTagToDockboxName(imageName),
+		Image:         imageName,
+		ImageID:       info.ID,
+		Source:        labels[LABEL_SOURCE],
+		Language:      labels[LABEL_LANGUAGE],
+		IncludeSource: exportOptions.includeSource,
+	}
+
+	// The folder of the dockbox holds its configuration and Dockerfile
+	dirPath := exportOptions.arg
+	if exists, _, _ := pathExists(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml")); !exists {
+		dirPath = labels[LABEL_PATH]
+		if exists, _, _ := pathExists(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml")); dirPath == "" || !exists {
+			dirPath = ""
+		}
+	}
+	if dirPath != "" {
+		for key, value := range map[string]*string{"Dockerfile": &manifest.Dockerfile, "language": &manifest.Language, "platform": &manifest.Platform} {
+			configValue, err := getConfigByKey(dirPath, key)
+			if err != nil {
+				return "", err
+			}
+			if configValue != "" {
+				*value = configValue
+			}
+		}
+	} else {
+		if exportOptions.includeSource {
+			return "", fmt.Errorf("cannot include the source code of %s as its folder no longer exists", manifest.Name)
+		}
+		log.Printf("Warning: The folder of %s no longer exists, only its image will be exported", manifest.Name)
+	}
+
+	output := exportOptions.output
+	if output == "" {
+		output = bundleFileName(manifest.Name)
+	}
+	if err := writeBundle(ctx, cli, output, manifest, dirPath); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// bundleFileName returns the default file of the bundle of a dockbox. The name
+// is escaped rather than replaced, so that different dockboxes never share a file.
+func bundleFileName(name string) string {
+	return url.PathEscape(name) + ".tar"
+}
+
+// writeBundle writes the bundle of a dockbox to output. The image is saved to a
+// temporary file first as the size of every entry must be known beforehand.
+func writeBundle(ctx context.Context, cli dockerClient, output string, manifest bundleManifest, dirPath string) error {
+	outputDir := filepath.Dir(output)
+	image, err := ioutil.TempFile(outputDir, ".image-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(image.Name())
+	defer image.Close()
+	body, err := cli.ImageSave(ctx, []string{manifest.Image})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(image, body)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to save image %s: %s", manifest.Image, err)
+	}
+
+	tmp, err := ioutil.TempFile(outputDir, ".bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	tarWriter := tar.NewWriter(tmp)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.WriteHeader(&tar.Header{Name: BUNDLE_MANIFEST, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(data); err != nil {
+		return err
+	}
+
+	if err := addFileToBundle(tarWriter, image.Name(), BUNDLE_IMAGE); err != nil {
+		return err
+	}
+	if dirPath != "" {
+		// The bundle may be written inside the folder it bundles
+		skip := map[string]bool{}
+		for _, file := range []string{image.Name(), tmp.Name(), output} {
+			if absPath, err := filepath.Abs(file); err == nil {
+				skip[absPath] = true
+			}
+		}
+		if err := addFolderToBundle(tarWriter, dirPath, manifest, skip); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), output)
+}
+
+// addFolderToBundle adds the files of the dockbox folder at dirPath needed to
+// register it again, or every file if the source code is included. Files in skip are left out.
+func addFolderToBundle(tarWriter *tar.Writer, dirPath string, manifest bundleManifest, skip map[string]bool) error {
+	roots := []string{HIDDEN_DIRECTORY}
+	if manifest.IncludeSource {
+		roots = []string{"."}
+	} else if manifest.Dockerfile != "" && !strings.HasPrefix(filepath.Clean(manifest.Dockerfile), HIDDEN_DIRECTORY+string(filepath.Separator)) {
+		// Dockerfile of the repository
+		roots = append(roots, manifest.Dockerfile)
+	}
+	for _, root := range roots {
+		err := filepath.Walk(filepath.Join(dirPath, root), func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if absPath, err := filepath.Abs(filePath); err == nil && skip[absPath] {
+				return nil
+			}
+			relPath, err := filepath.Rel(dirPath, filePath)
+			if err != nil || relPath == "." {
+				return err
+			}
+			return addFileToBundle(tarWriter, filePath, BUNDLE_FILES+filepath.ToSlash(relPath))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToBundle(tarWriter *tar.Writer, filePath string, name string) error {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(filePath); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
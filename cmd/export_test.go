@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// newExportTestFolder returns the folder of the app1 dockbox with a generated Dockerfile
+func newExportTestFolder(t *testing.T) string {
+	dirPath := filepath.Join(t.TempDir(), "app1")
+	assert.Nil(t, os.MkdirAll(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+	files := map[string]string{
+		filepath.Join(HIDDEN_DIRECTORY, ".dockbox.yaml"):         "image: dockbox/app1\ndockerfile: .dockbox/.Dockerfile.dockbox\nlanguage: Python\nplatform: linux/amd64\ncontainer: app1_ctr\n",
+		filepath.Join(HIDDEN_DIRECTORY, ".Dockerfile.dockbox"):   "FROM python:3.8\n",
+		filepath.Join(HIDDEN_DIRECTORY, ".dockerignore.dockbox"): ".dockbox/.Dockerfile.dockbox\n",
+		"main.py":                       "print('hello')\n",
+		filepath.Join("app", "util.py"): "",
+	}
+	for name, content := range files {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dirPath, name)), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, name), []byte(content), 0644))
+	}
+	return dirPath
+}
+
+// testImageArchive returns the archive of an image tagged repoTag, as saved by
+// the daemon, and the ID the daemon gives the image
+func testImageArchive(t *testing.T, repoTag string) (string, []byte) {
+	config := []byte(`{"os":"linux","comment":"` + repoTag + `"}`)
+	digest := sha256.Sum256(config)
+	imageID := hex.EncodeToString(digest[:])
+	manifest, err := json.Marshal([]map[string]interface{}{{"Config": imageID + ".json", "RepoTags": []string{repoTag}, "Layers": []string{}}})
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{{imageID + ".json", config}, {"manifest.json", manifest}} {
+		assert.Nil(t, tarWriter.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data))}))
+		_, err = tarWriter.Write(file.data)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tarWriter.Close())
+	return "sha256:" + imageID, buf.Bytes()
+}
+
+// newExportTestClient returns a clean test client that saves dockboxes as the
+// daemon does, and records the tags of the archives it loads
+func newExportTestClient(t *testing.T, loaded *[]string) *cleanTestClient {
+	cli := newCleanTestClient(t)
+	imageInspectWithRaw := cli.imageInspectWithRaw
+	cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+		info, raw, err := imageInspectWithRaw(c, imageID)
+		if err == nil && isImageDockbox(info.RepoTags[0]) {
+			info.ID, _ = testImageArchive(t, info.RepoTags[0])
+		}
+		return info, raw, err
+	}
+	cli.imageSave = func(c context.Context, imageIDs []string) (io.ReadCloser, error) {
+		_, archive := testImageArchive(t, imageIDs[0]+":latest")
+		return ioutil.NopCloser(bytes.NewReader(archive)), nil
+	}
+	cli.imageLoad = func(c context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+		tarReader := tar.NewReader(input)
+		for {
+			header, err := tarReader.Next()
+			if err != nil {
+				return types.ImageLoadResponse{}, err
+			}
+			if header.Name == "manifest.json" {
+				var savedImages []struct{ RepoTags []string }
+				assert.Nil(t, json.NewDecoder(tarReader).Decode(&savedImages))
+				*loaded = append(*loaded, savedImages[0].RepoTags...)
+				return types.ImageLoadResponse{Body: ioutil.NopCloser(strings.NewReader(`{"stream":"Loaded image: dockbox/app1:latest\n"}`))}, nil
+			}
+		}
+	}
+	return cli
+}
+
+func readTestConfig(t *testing.T, dirPath string) *viper.Viper {
+	config := viper.New()
+	config.SetConfigFile(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml"))
+	assert.Nil(t, config.ReadInConfig())
+	return config
+}
+
+func TestExportImport(t *testing.T) {
+	testcases := []struct {
+		name          string
+		includeSource bool
+		expectedFiles []string
+		missingFiles  []string
+	}{
+		{name: "Metadata", expectedFiles: []string{".dockbox/.Dockerfile.dockbox", ".dockbox/.dockerignore.dockbox"}, missingFiles: []string{"main.py", "app"}},
+		{name: "IncludeSource", includeSource: true, expectedFiles: []string{".dockbox/.Dockerfile.dockbox", "main.py", "app/util.py"}},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			var loaded []string
+			cli := newExportTestClient(t, &loaded)
+			dirPath := newExportTestFolder(t)
+			output := filepath.Join(t.TempDir(), "box.tar")
+
+			actual, err := RunExportCommand(cli, ExportOptions{arg: dirPath, output: output, includeSource: test.includeSource})
+			assert.Nil(t, err)
+			assert.Equal(t, output, actual)
+
+			destPath := filepath.Join(t.TempDir(), "imported")
+			name, actualPath, err := RunImportCommand(cli, ImportOptions{bundle: output, destPath: destPath})
+			assert.Nil(t, err)
+			assert.Equal(t, "app1", name)
+			assert.Equal(t, destPath, actualPath)
+			assert.Equal(t, []string{"dockbox/app1:latest"}, loaded)
+
+			for _, file := range test.expectedFiles {
+				exists, _, _ := pathExists(filepath.Join(destPath, file))
+				assert.True(t, exists, file)
+			}
+			for _, file := range test.missingFiles {
+				exists, _, _ := pathExists(filepath.Join(destPath, file))
+				assert.False(t, exists, file)
+			}
+
+			config := readTestConfig(t, destPath)
+			assert.Equal(t, "dockbox/app1", config.GetString("image"))
+			assert.Equal(t, ".dockbox/.Dockerfile.dockbox", config.GetString("dockerfile"))
+			assert.Equal(t, "Python", config.GetString("language"))
+			assert.Equal(t, "linux/amd64", config.GetString("platform"))
+			assert.Equal(t, "", config.GetString("container"))
+
+			// The exported folder is left untouched
+			assert.Equal(t, "app1_ctr", readTestConfig(t, dirPath).GetString("container"))
+
+			_, _, err = RunImportCommand(cli, ImportOptions{bundle: output, destPath: destPath})
+			assert.EqualError(t, err, destPath+" already contains a dockbox")
+		})
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	var loaded []string
+	cli := newExportTestClient(t, &loaded)
+
+	_, err := RunExportCommand(cli, ExportOptions{arg: "missing", output: filepath.Join(t.TempDir(), "box.tar")})
+	assert.EqualError(t, err, "no dockbox named missing: Error: No such image: dockbox/missing")
+
+	// The folder of app2 is unknown
+	_, err = RunExportCommand(cli, ExportOptions{arg: "app2", output: filepath.Join(t.TempDir(), "box.tar"), includeSource: true})
+	assert.EqualError(t, err, "cannot include the source code of app2 as its folder no longer exists")
+
+	output := filepath.Join(t.TempDir(), "box.tar")
+	_, err = RunExportCommand(cli, ExportOptions{arg: "app2", output: output})
+	assert.Nil(t, err)
+	destPath := filepath.Join(t.TempDir(), "app2")
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: output, destPath: destPath})
+	assert.Nil(t, err)
+	assert.Equal(t, "dockbox/app2", readTestConfig(t, destPath).GetString("image"))
+}
+
+// writeTestBundle writes a bundle of app1 holding the given files
+func writeTestBundle(t *testing.T, files []tar.Header) string {
+	imageID, image := testImageArchive(t, "dockbox/app1:latest")
+	return writeTestBundleWithImage(t, imageID, image, files)
+}
+
+// writeTestBundleWithImage writes a bundle of app1 holding the given image and files
+func writeTestBundleWithImage(t *testing.T, imageID string, image []byte, files []tar.Header) string {
+	bundle := filepath.Join(t.TempDir(), "box.tar")
+	file, err := os.Create(bundle)
+	assert.Nil(t, err)
+	defer file.Close()
+	tarWriter := tar.NewWriter(file)
+	manifest, err := json.Marshal(bundleManifest{Version: BUNDLE_VERSION, Name: "app1", Image: "dockbox/app1", ImageID: imageID})
+	assert.Nil(t, err)
+	assert.Nil(t, tarWriter.WriteHeader(&tar.Header{Name: BUNDLE_MANIFEST, Mode: 0644, Size: int64(len(manifest))}))
+	_, err = tarWriter.Write(manifest)
+	assert.Nil(t, err)
+	assert.Nil(t, tarWriter.WriteHeader(&tar.Header{Name: BUNDLE_IMAGE, Mode: 0644, Size: int64(len(image))}))
+	_, err = tarWriter.Write(image)
+	assert.Nil(t, err)
+	for i := range files {
+		assert.Nil(t, tarWriter.WriteHeader(&files[i]))
+	}
+	assert.Nil(t, tarWriter.Close())
+	return bundle
+}
+
+func TestImportErrors(t *testing.T) {
+	var loaded []string
+	cli := newExportTestClient(t, &loaded)
+
+	notBundle := filepath.Join(t.TempDir(), "box.tar")
+	assert.Nil(t, ioutil.WriteFile(notBundle, []byte("not a bundle"), 0644))
+	_, _, err := RunImportCommand(cli, ImportOptions{bundle: notBundle, destPath: t.TempDir()})
+	assert.EqualError(t, err, notBundle+" is not a dockbox bundle: unexpected EOF")
+
+	bundle := writeTestBundle(t, []tar.Header{{Name: BUNDLE_FILES + "../evil", Typeflag: tar.TypeReg, Mode: 0644}})
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: bundle, destPath: filepath.Join(t.TempDir(), "app1")})
+	assert.EqualError(t, err, "invalid file files/../evil in bundle")
+
+	bundle = writeTestBundle(t, []tar.Header{{Name: BUNDLE_FILES + "link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}})
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: bundle, destPath: filepath.Join(t.TempDir(), "app1")})
+	assert.EqualError(t, err, "invalid link files/link to ../../etc in bundle")
+
+	// Each link stays in the folder, but together they lead out of it
+	destPath := filepath.Join(t.TempDir(), "app1")
+	bundle = writeTestBundle(t, []tar.Header{
+		{Name: BUNDLE_FILES + "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: BUNDLE_FILES + "b", Typeflag: tar.TypeSymlink, Linkname: "a/.."},
+		{Name: BUNDLE_FILES + "b/evil", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: bundle, destPath: destPath})
+	assert.EqualError(t, err, "invalid link files/b to a/.. in bundle")
+	bundle = writeTestBundle(t, []tar.Header{
+		{Name: BUNDLE_FILES + "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: BUNDLE_FILES + "a/evil", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: bundle, destPath: destPath})
+	assert.EqualError(t, err, "invalid file files/a/evil in bundle")
+	exists, _, _ := pathExists(filepath.Join(filepath.Dir(destPath), "evil"))
+	assert.False(t, exists)
+
+	// The image must be the dockbox of the bundle, which cannot retag other images
+	imageInspectWithRaw := cli.imageInspectWithRaw
+	cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+		return types.ImageInspect{}, nil, errors.New("Error: No such image: " + imageID)
+	}
+	imageID, image := testImageArchive(t, "dockbox/app1:latest")
+	bundle = writeTestBundleWithImage(t, "sha256:app1", image, nil)
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: bundle, destPath: filepath.Join(t.TempDir(), "app1")})
+	assert.EqualError(t, err, bundle+" is not a dockbox bundle: the image it holds is not sha256:app1")
+	imageID, image = testImageArchive(t, "ubuntu:latest")
+	bundle = writeTestBundleWithImage(t, imageID, image, nil)
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: bundle, destPath: filepath.Join(t.TempDir(), "app1")})
+	assert.EqualError(t, err, bundle+" is not a dockbox bundle: the image it holds is tagged ubuntu:latest instead of dockbox/app1:latest")
+	cli.imageInspectWithRaw = imageInspectWithRaw
+
+	// Another dockbox is already named app1
+	bundle = writeTestBundle(t, nil)
+	assert.Len(t, loaded, 0, "invalid bundles must not be loaded")
+	cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+		return types.ImageInspect{ID: "sha256:other"}, nil, nil
+	}
+	_, _, err = RunImportCommand(cli, ImportOptions{bundle: bundle, destPath: filepath.Join(t.TempDir(), "app1")})
+	assert.EqualError(t, err, "cannot import app1: another dockbox with this name already exists, run dockbox clean app1 first")
+	assert.Len(t, loaded, 0, "the image must not replace the existing dockbox")
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	units "github.com/docker/go-units"
+)
+
+// walkGraph calls f on every node that would be printed in a tree starting at
+// roots, parents before children
+func walkGraph(roots []*ImageNode, printOptions ForestPrintOptions, f func(node *ImageNode, parent *ImageNode, totalSize int64)) {
+	var walk func(node *ImageNode, parent *ImageNode, depth int, parentSize int64)
+	walk = func(node *ImageNode, parent *ImageNode, depth int, parentSize int64) {
+		totalSize := parentSize + node.size
+		f(node, parent, totalSize)
+		if printOptions.maxDepth > 0 && depth >= printOptions.maxDepth {
+			return
+		}
+		for _, child := range node.visibleChildren(printOptions) {
+			walk(child, node, depth+1, totalSize)
+		}
+	}
+	for _, root := range sortNodes(roots, printOptions.sortBy) {
+		var parentSize int64 = 0
+		for parent := root.parent; parent != nil; parent = parent.parent {
+			parentSize += parent.size
+		}
+		walk(root, nil, 1, parentSize)
+	}
+}
+
+func shortImageID(ID string) string {
+	ID = strings.TrimPrefix(ID, "sha256:")
+	if len(ID) > 12 {
+		return ID[:12]
+	}
+	return ID
+}
+
+// graphLabelLines returns the lines of the label of a node in a graph: its name,
+// short ID and size
+func graphLabelLines(node *ImageNode, totalSize int64, printOptions ForestPrintOptions) []string {
+	lines := make([]string, 0, 3)
+	if node.name != "" {
+		lines = append(lines, node.name)
+	}
+	lines = append(lines, shortImageID(node.ID))
+	size := units.HumanSize(float64(node.size))
+	if printOptions.showSize {
+		size += " (total: " + units.HumanSize(float64(totalSize)) + ")"
+	}
+	return append(lines, size)
+}
+
+// dotString renders the trees starting at roots as a Graphviz DOT graph. Roots
+// are drawn as filled boxes, tagged images as boxes and intermediate layers as
+// ellipses.
+func dotString(roots []*ImageNode, printOptions ForestPrintOptions) string {
+	var nodes, edges strings.Builder
+	walkGraph(roots, printOptions, func(node *ImageNode, parent *ImageNode, totalSize int64) {
+		lines := graphLabelLines(node, totalSize, printOptions)
+		for i, line := range lines {
+			lines[i] = strings.ReplaceAll(line, `"`, `\"`)
+		}
+		attributes := []string{fmt.Sprintf(`label="%s"`, strings.Join(lines, `\n`))}
+		switch {
+		case node.parent == nil:
+			attributes = append(attributes, "shape=box", `style="filled,bold"`, "fillcolor=lightgrey")
+		case node.name != "":
+			attributes = append(attributes, "shape=box", `style="rounded"`)
+		default:
+			attributes = append(attributes, "shape=ellipse", "fontsize=10")
+		}
+		if _, ok := printOptions.colorIDS[node.ID]; ok {
+			attributes = append(attributes, "color=green", "penwidth=3")
+		}
+		fmt.Fprintf(&nodes, "  \"%s\" [%s];\n", node.ID, strings.Join(attributes, ", "))
+		if parent != nil {
+			fmt.Fprintf(&edges, "  \"%s\" -> \"%s\";\n", parent.ID, node.ID)
+		}
+	})
+
+	var sb strings.Builder
+	sb.WriteString("digraph dockbox {\n")
+	sb.WriteString("  rankdir=TB;\n")
+	sb.WriteString("  node [fontname=\"Helvetica\"];\n")
+	sb.WriteString(nodes.String())
+	sb.WriteString(edges.String())
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// mermaidString renders the trees starting at roots as a Mermaid flowchart,
+// using the same node styles as dotString
+func mermaidString(roots []*ImageNode, printOptions ForestPrintOptions) string {
+	var nodes, edges, classes strings.Builder
+	nodeIDs := make(map[string]string)
+	walkGraph(roots, printOptions, func(node *ImageNode, parent *ImageNode, totalSize int64) {
+		nodeID := fmt.Sprintf("n%d", len(nodeIDs))
+		nodeIDs[node.ID] = nodeID
+		lines := graphLabelLines(node, totalSize, printOptions)
+		for i, line := range lines {
+			lines[i] = strings.ReplaceAll(line, `"`, "#quot;")
+		}
+		label := `"` + strings.Join(lines, "<br/>") + `"`
+		switch {
+		case node.parent == nil:
+			fmt.Fprintf(&nodes, "  %s[[%s]]\n", nodeID, label)
+			fmt.Fprintf(&classes, "  class %s root\n", nodeID)
+		case node.name != "":
+			fmt.Fprintf(&nodes, "  %s(%s)\n", nodeID, label)
+			fmt.Fprintf(&classes, "  class %s tagged\n", nodeID)
+		default:
+			fmt.Fprintf(&nodes, "  %s([%s])\n", nodeID, label)
+			fmt.Fprintf(&classes, "  class %s layer\n", nodeID)
+		}
+		if _, ok := printOptions.colorIDS[node.ID]; ok {
+			fmt.Fprintf(&classes, "  class %s target\n", nodeID)
+		}
+		if parent != nil {
+			fmt.Fprintf(&edges, "  %s --> %s\n", nodeIDs[parent.ID], nodeID)
+		}
+	})
+
+	var sb strings.Builder
+	sb.WriteString("graph TD\n")
+	sb.WriteString(nodes.String())
+	sb.WriteString(edges.String())
+	sb.WriteString("  classDef root fill:#d3d3d3,stroke:#333,stroke-width:2px\n")
+	sb.WriteString("  classDef tagged fill:#fff,stroke:#333\n")
+	sb.WriteString("  classDef layer fill:#fff,stroke:#999,stroke-dasharray:3 3,font-size:10px\n")
+	sb.WriteString("  classDef target stroke:#0a0,stroke-width:3px\n")
+	sb.WriteString(classes.String())
+	return sb.String()
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/spf13/cobra"
+)
+
+// Number of concurrent ImageHistory requests used when building the image forest
+const DEFAULT_HISTORY_JOBS = 8
+
+// historyLookup fetches image histories with a bounded number of concurrent
+// requests. The history of an image is a suffix of the history of any image
+// built from it, so histories are memoized by every ID they contain and the
+// history of a shared ancestor is only fetched once. As image IDs are content
+// addressed, histories can also be cached on disk.
+type historyLookup struct {
+	cli      dockerClient
+	cacheDir string
+
+	mu   sync.Mutex
+	memo map[string][]image.HistoryResponseItem
+}
+
+func newHistoryLookup(cli dockerClient, cacheDir string) *historyLookup {
+	return &historyLookup{
+		cli:      cli,
+		cacheDir: cacheDir,
+		memo:     make(map[string][]image.HistoryResponseItem),
+	}
+}
+
+func addHistoryFlags(cmd *cobra.Command, treeOptions *TreeOptions) {
+	cmd.PersistentFlags().IntVar(&treeOptions.Jobs, "jobs", DEFAULT_HISTORY_JOBS, "Number of image histories to fetch concurrently")
+	cmd.PersistentFlags().BoolVar(&treeOptions.CacheHistory, "cache-history", false, "Cache image histories on disk to speed up later runs")
+}
+
+// historyCacheDir returns the directory used to cache image histories on disk,
+// or an empty string if histories should not be cached
+func historyCacheDir(treeOptions TreeOptions) (string, error) {
+	if !treeOptions.CacheHistory {
+		return "", nil
+	}
+	if treeOptions.CacheDir != "" {
+		return treeOptions.CacheDir, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, PREFIX, "history"), nil
+}
+
+func (h *historyLookup) memoize(hist []image.HistoryResponseItem) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, item := range hist {
+		if item.ID == "<missing>" {
+			break
+		}
+		if _, ok := h.memo[item.ID]; !ok {
+			h.memo[item.ID] = hist[i:]
+		}
+	}
+}
+
+func (h *historyLookup) memoized(imageID string) ([]image.HistoryResponseItem, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.memo[imageID]
+	return hist, ok
+}
+
+func (h *historyLookup) cachePath(imageID string) string {
+	return filepath.Join(h.cacheDir, strings.ReplaceAll(imageID, ":", "_")+".json")
+}
+
+func (h *historyLookup) readCache(imageID string) ([]image.HistoryResponseItem, bool) {
+	if h.cacheDir == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(h.cachePath(imageID))
+	if err != nil {
+		return nil, false
+	}
+	var hist []image.HistoryResponseItem
+	if err := json.Unmarshal(data, &hist); err != nil {
+		log.Printf("Warning: Ignoring invalid history cache entry for %s: %s", imageID, err)
+		return nil, false
+	}
+	return hist, true
+}
+
+// writeCache stores a history on disk. Tags are not stored since they can
+// move to other images, unlike IDs.
+func (h *historyLookup) writeCache(imageID string, hist []image.HistoryResponseItem) {
+	if h.cacheDir == "" {
+		return
+	}
+	untagged := make([]image.HistoryResponseItem, len(hist))
+	for i, item := range hist {
+		item.Tags = nil
+		untagged[i] = item
+	}
+	data, err := json.Marshal(untagged)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(h.cacheDir, 0755); err != nil {
+		log.Printf("Warning: Unable to create history cache: %s", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(h.cacheDir, ".history-")
+	if err != nil {
+		log.Printf("Warning: Unable to write history cache: %s", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.cachePath(imageID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Warning: Unable to write history cache: %s", err)
+	}
+}
+
+func (h *historyLookup) get(ctx context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+	if hist, ok := h.memoized(imageID); ok {
+		return hist, nil
+	}
+	if hist, ok := h.readCache(imageID); ok {
+		h.memoize(hist)
+		return hist, nil
+	}
+	hist, err := h.cli.ImageHistory(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+	h.memoize(hist)
+	h.writeCache(imageID, hist)
+	return hist, nil
+}
+
+// fetchAll returns the histories of all the given images using at most jobs
+// concurrent requests. Newer images are fetched first so that the histories of
+// their ancestors are already memoized when they are reached.
+func (h *historyLookup) fetchAll(ctx context.Context, images []types.ImageSummary, jobs int) (map[string][]image.HistoryResponseItem, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	ordered := make([]types.ImageSummary, len(images))
+	copy(ordered, images)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Created > ordered[j].Created
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	imageIDs := make(chan string)
+	histories := make(map[string][]image.HistoryResponseItem, len(images))
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for imageID := range imageIDs {
+				if ctx.Err() != nil {
+					continue
+				}
+				hist, err := h.get(ctx, imageID)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					cancel()
+				} else {
+					histories[imageID] = hist
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, image := range ordered {
+		select {
+		case imageIDs <- image.ID:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(imageIDs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return histories, nil
+}
@@ -0,0 +1,348 @@
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/spf13/cobra"
+)
+
+// importCmd represents the import command
+func NewImportCommand(cli dockerClient) *cobra.Command {
+	var importOptions = ImportOptions{}
+	var importCmd = &cobra.Command{
+		Use:   "import <bundle> [<directory>]",
+		Short: "Imports a dockbox from a bundle created with dockbox export",
+		Long: `Loads the image of a bundled dockbox and restores its folder, so that it can be
+	entered right away. The folder defaults to the name of the dockbox.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			importOptions.bundle = args[0]
+			if len(args) > 1 {
+				importOptions.destPath = args[1]
+			}
+			name, destPath, err := RunImportCommand(cli, importOptions)
+			CheckError(err)
+			fmt.Printf("Successfully imported dockbox %s, run dockbox enter %s to start it\n", name, destPath)
+		},
+	}
+	return importCmd
+}
+
+// RunImportCommand imports the bundle of importOptions, returning the name of
+// the dockbox and the folder it was restored to
+func RunImportCommand(cli dockerClient, importOptions ImportOptions) (string, string, error) {
+	ctx := context.Background()
+	file, err := os.Open(importOptions.bundle)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	tarReader := tar.NewReader(file)
+
+	manifest, err := readBundleManifest(tarReader)
+	if err != nil {
+		return "", "", fmt.Errorf("%s is not a dockbox bundle: %s", importOptions.bundle, err)
+	}
+	destPath := importOptions.destPath
+	if destPath == "" {
+		destPath = manifest.Name
+	}
+	if exists, _, _ := pathExists(filepath.Join(destPath, HIDDEN_DIRECTORY, ".dockbox.yaml")); exists {
+		return "", "", fmt.Errorf("%s already contains a dockbox", destPath)
+	}
+	info, exists, err := checkDockboxExists(ctx, cli, manifest.Name)
+	if err != nil {
+		return "", "", err
+	}
+	if exists && info.ID != manifest.ImageID {
+		return "", "", fmt.Errorf("cannot import %s: another dockbox with this name already exists, run dockbox clean %s first", manifest.Name, manifest.Name)
+	}
+
+	// The whole bundle is checked before its image is loaded
+	header, err := tarReader.Next()
+	if err != nil || header.Name != BUNDLE_IMAGE {
+		return "", "", fmt.Errorf("%s is not a dockbox bundle: missing image", importOptions.bundle)
+	}
+	if err := checkBundleImage(tarReader, manifest); err != nil {
+		return "", "", fmt.Errorf("%s is not a dockbox bundle: %s", importOptions.bundle, err)
+	}
+	if err := checkBundleFiles(tarReader, destPath); err != nil {
+		return "", "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	tarReader = tar.NewReader(file)
+	if _, err := readBundleManifest(tarReader); err != nil {
+		return "", "", err
+	}
+
+	if _, err := tarReader.Next(); err != nil {
+		return "", "", err
+	}
+	res, err := cli.ImageLoad(ctx, tarReader, true)
+	if err != nil {
+		return "", "", err
+	}
+	err = jsonmessage.DisplayJSONMessagesStream(res.Body, ioutil.Discard, 0, false, nil)
+	res.Body.Close()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load image %s: %s", manifest.Image, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(destPath, HIDDEN_DIRECTORY), 0755); err != nil {
+		return "", "", err
+	}
+	if err := extractBundleFiles(tarReader, destPath); err != nil {
+		return "", "", err
+	}
+	if err := registerImportedDockbox(destPath, manifest); err != nil {
+		return "", "", err
+	}
+	return manifest.Name, destPath, nil
+}
+
+func readBundleManifest(tarReader *tar.Reader) (bundleManifest, error) {
+	var manifest bundleManifest
+	header, err := tarReader.Next()
+	if err != nil {
+		return manifest, err
+	}
+	if header.Name != BUNDLE_MANIFEST {
+		return manifest, errors.New("missing " + BUNDLE_MANIFEST)
+	}
+	if err := json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+		return manifest, err
+	}
+	if manifest.Version > BUNDLE_VERSION {
+		return manifest, fmt.Errorf("bundle version %d is not supported, please update dockbox", manifest.Version)
+	}
+	if err := validateDockboxName(manifest.Name); err != nil {
+		return manifest, err
+	}
+	return manifest, nil
+}
+
+// checkBundleImage checks that the image saved in a bundle is the image of its
+// manifest, only tagged as its dockbox, so that loading it cannot replace other
+// images. The daemon identifies images by the digest of their configuration.
+func checkBundleImage(r io.Reader, manifest bundleManifest) error {
+	tarReader := tar.NewReader(r)
+	var savedImages []struct {
+		Config   string
+		RepoTags []string
+	}
+	var repositories map[string]map[string]string
+	digests := make(map[string]string)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch name := path.Clean(header.Name); {
+		case name == "manifest.json":
+			err = json.NewDecoder(tarReader).Decode(&savedImages)
+		case name == "repositories":
+			err = json.NewDecoder(tarReader).Decode(&repositories)
+		case header.Typeflag == tar.TypeReg:
+			hash := sha256.New()
+			_, err = io.Copy(hash, tarReader)
+			digests[name] = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(savedImages) != 1 || digests[path.Clean(savedImages[0].Config)] != manifest.ImageID {
+		return fmt.Errorf("the image it holds is not %s", manifest.ImageID)
+	}
+	repoTag := dockboxNameToImageName(manifest.Name) + ":latest"
+	if len(savedImages[0].RepoTags) == 0 {
+		return fmt.Errorf("the image it holds is not tagged %s", repoTag)
+	}
+	// Older daemons tag the images listed in repositories
+	repoTags := savedImages[0].RepoTags
+	for repository, tags := range repositories {
+		for tag := range tags {
+			repoTags = append(repoTags, repository+":"+tag)
+		}
+	}
+	for _, tag := range repoTags {
+		if tag != repoTag {
+			return fmt.Errorf("the image it holds is tagged %s instead of %s", tag, repoTag)
+		}
+	}
+	return nil
+}
+
+// checkBundleFiles checks every file of the dockbox folder held by a bundle
+// before any of them is extracted to destPath
+func checkBundleFiles(tarReader *tar.Reader, destPath string) error {
+	links := make(map[string]bool)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if relPath := bundleFilePath(header); relPath != "" {
+			if err := checkBundleFile(destPath, header, relPath, links); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractBundleFiles restores the files of the dockbox folder held by a bundle to destPath
+func extractBundleFiles(tarReader *tar.Reader, destPath string) error {
+	links := make(map[string]bool)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		relPath := bundleFilePath(header)
+		if relPath == "" {
+			continue
+		}
+		if err := checkBundleFile(destPath, header, relPath, links); err != nil {
+			return err
+		}
+
+		filePath := filepath.Join(destPath, relPath)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(filePath, 0755)
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(filePath), 0755); err == nil {
+				err = os.Symlink(header.Linkname, filePath)
+			}
+		case tar.TypeReg:
+			err = extractBundleFile(tarReader, filePath, os.FileMode(header.Mode).Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// bundleFilePath returns the path of an entry of a bundle within the dockbox
+// folder, or an empty string if it is not one of its files
+func bundleFilePath(header *tar.Header) string {
+	if !strings.HasPrefix(header.Name, BUNDLE_FILES) {
+		return ""
+	}
+	relPath := filepath.FromSlash(strings.TrimPrefix(header.Name, BUNDLE_FILES))
+	if relPath == "" {
+		return ""
+	}
+	return filepath.Clean(relPath)
+}
+
+// checkBundleFile checks that an entry of a bundle, and the target of the link
+// it is if any, stay within destPath. As links could lead out of it, nothing is
+// written through a link, whether it comes from the bundle or was already in
+// destPath, and no link points through another one. The links of the bundle
+// seen so far are kept in links.
+func checkBundleFile(destPath string, header *tar.Header, relPath string, links map[string]bool) error {
+	if !isWithinDir(destPath, filepath.Join(destPath, relPath)) || throughLink(destPath, relPath, links) {
+		return fmt.Errorf("invalid file %s in bundle", header.Name)
+	}
+	if header.Typeflag != tar.TypeSymlink {
+		if isLink(destPath, relPath, links) {
+			return fmt.Errorf("invalid file %s in bundle", header.Name)
+		}
+		return nil
+	}
+	// The target is resolved by the system as it is written, so it is not cleaned
+	if filepath.IsAbs(header.Linkname) {
+		return fmt.Errorf("invalid link %s to %s in bundle", header.Name, header.Linkname)
+	}
+	target := filepath.Dir(relPath) + string(filepath.Separator) + filepath.FromSlash(header.Linkname)
+	if throughLink(destPath, target, links) {
+		return fmt.Errorf("invalid link %s to %s in bundle", header.Name, header.Linkname)
+	}
+	links[relPath] = true
+	return nil
+}
+
+// throughLink reports whether relPath, relative to destPath, leaves it or goes
+// through a link before its last element
+func throughLink(destPath string, relPath string, links map[string]bool) bool {
+	parts := strings.Split(relPath, string(filepath.Separator))
+	current := ""
+	for i, part := range parts {
+		current = filepath.Join(current, part)
+		if !isWithinDir(destPath, filepath.Join(destPath, current)) {
+			return true
+		}
+		if i < len(parts)-1 && isLink(destPath, current, links) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLink reports whether relPath, relative to destPath, is a link of the bundle
+// or of destPath
+func isLink(destPath string, relPath string, links map[string]bool) bool {
+	if links[relPath] {
+		return true
+	}
+	info, err := os.Lstat(filepath.Join(destPath, relPath))
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+func isWithinDir(dir string, filePath string) bool {
+	rel, err := filepath.Rel(dir, filePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func extractBundleFile(r io.Reader, filePath string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// registerImportedDockbox writes the configuration of an imported dockbox,
+// keeping the bundled one if any but dropping its container
+func registerImportedDockbox(destPath string, manifest bundleManifest) error {
+	return writeConfig(destPath, map[string]string{
+		"image":      dockboxNameToImageName(manifest.Name),
+		"Dockerfile": manifest.Dockerfile,
+		"language":   manifest.Language,
+		"platform":   manifest.Platform,
+		"container":  "",
+	})
+}
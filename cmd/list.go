@@ -29,7 +29,9 @@ import (
 
 	"github.com/karrick/godirwalk"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/docker/docker/api/types"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // listCmd represents the list command
@@ -74,14 +76,21 @@ func RunListCommand(cli dockerClient, listOptions ListOptions) (string, error) {
 
 	var buf bytes.Buffer
 	tabWriter := tabwriter.NewWriter(&buf, 1, 1, 2, ' ', 0)
-	fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\n", "NAME", "SIZE (MB)", "CREATED", "STATUS")
+	fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\t%s\n", "NAME", "SIZE (MB)", "CREATED", "PLATFORM", "STATUS", "SOURCE")
 	for _, image := range dockboxImages {
 		boxName := repoTagToDockboxName(image.RepoTags[0])
 		status, ok := imageToStatus[image.ID]
 		if !ok {
 			status = ""
 		}
-		fmt.Fprintf(tabWriter, "%v\t%d\t%s\t%s\n", boxName, image.Size/1000000, time.Unix(image.Created, 0).UTC(), status)
+		platform := ""
+		info, _, err := cli.ImageInspectWithRaw(ctx, image.ID)
+		if err != nil {
+			log.Printf("Warning: Unable to inspect image %s: %s", image.ID, err)
+		} else {
+			platform = platforms.Format(specs.Platform{OS: info.Os, Architecture: info.Architecture, Variant: info.Variant})
+		}
+		fmt.Fprintf(tabWriter, "%v\t%d\t%s\t%s\t%s\t%s\n", boxName, image.Size/1000000, time.Unix(image.Created, 0).UTC(), platform, status, image.Labels[LABEL_SOURCE])
 	}
 	tabWriter.Flush()
 	return buf.String(), nil
@@ -90,7 +99,7 @@ func RunListCommand(cli dockerClient, listOptions ListOptions) (string, error) {
 func getDockboxImages(ctx context.Context, cli dockerClient, options ListOptions) ([]types.ImageSummary, error) {
 	filteredByPath := getDockboxesFromPaths(options)
 
-	images, err := cli.ImageList(ctx, types.ImageListOptions{})
+	images, err := listDockboxImages(ctx, cli)
 	if err != nil {
 		return nil, err
 	}
@@ -98,10 +107,7 @@ func getDockboxImages(ctx context.Context, cli dockerClient, options ListOptions
 	dockboxImages := make([]types.ImageSummary, 0)
 
 	for _, image := range images {
-		if len(image.RepoTags) == 0 {
-			continue
-		}
-		if !isImageDockbox(image.RepoTags[0]) {
+		if len(image.RepoTags) == 0 || isCompanionImage(image.Labels) {
 			continue
 		}
 
@@ -122,7 +128,7 @@ func getDockboxImages(ctx context.Context, cli dockerClient, options ListOptions
 func getRunningDockboxImages(ctx context.Context, cli dockerClient, options ListOptions) ([]types.Container, error) {
 	filteredByPath := getDockboxesFromPaths(options)
 
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	containers, err := listDockboxContainers(ctx, cli, types.ContainerListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -130,9 +136,6 @@ func getRunningDockboxImages(ctx context.Context, cli dockerClient, options List
 	dockboxContainers := make([]types.Container, 0)
 
 	for _, container := range containers {
-		if !isImageDockbox(container.Image) {
-			continue
-		}
 		if len(options.paths) == 0 {
 			dockboxContainers = append(dockboxContainers, container)
 		} else {
@@ -6,14 +6,31 @@ import (
 	"testing"
 
 	"github.com/docker/docker/api/types"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 )
 
+// fakeImageInspect returns an inspect result for an image, using linux/amd64
+// unless another platform is given for the image
+func fakeImageInspect(imageID string, imagePlatforms map[string]specs.Platform) types.ImageInspect {
+	platform, ok := imagePlatforms[imageID]
+	if !ok {
+		platform = specs.Platform{OS: "linux", Architecture: "amd64"}
+	}
+	return types.ImageInspect{
+		ID:           imageID,
+		Os:           platform.OS,
+		Architecture: platform.Architecture,
+		Variant:      platform.Variant,
+	}
+}
+
 func TestListGlobalSuccess(t *testing.T) {
 	testcases := []struct {
 		name            string
 		foundImages     []types.ImageSummary
 		foundContainers []types.Container
+		imagePlatforms  map[string]specs.Platform
 	}{
 		{
 			name: "ListGlobalNoRunning",
@@ -22,6 +39,7 @@ func TestListGlobalSuccess(t *testing.T) {
 					ID:       "some_random_ID_1",
 					Created:  1626748159,
 					RepoTags: []string{"dockbox/random"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/random"},
 					Size:     10000000,
 				},
 				{
@@ -34,6 +52,7 @@ func TestListGlobalSuccess(t *testing.T) {
 					ID:       "some_random_ID_3",
 					Created:  1626748161,
 					RepoTags: []string{"dockbox/multiple", "multiple_tags"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/multiple"},
 					Size:     123129124,
 				},
 			},
@@ -46,6 +65,7 @@ func TestListGlobalSuccess(t *testing.T) {
 					ID:       "some_random_ID_1",
 					Created:  1626748159,
 					RepoTags: []string{"dockbox/random"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/random"},
 					Size:     10000000,
 				},
 				{
@@ -58,6 +78,7 @@ func TestListGlobalSuccess(t *testing.T) {
 					ID:       "some_random_ID_3",
 					Created:  1626748161,
 					RepoTags: []string{"dockbox/multiple", "multiple_tags"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/multiple"},
 					Size:     123129124,
 				},
 			},
@@ -66,6 +87,7 @@ func TestListGlobalSuccess(t *testing.T) {
 					ID:      "some_random_container_ID_1",
 					Created: 1626748161,
 					Image:   "dockbox/random",
+					Labels:  map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/random"},
 					ImageID: "some_random_ID_1",
 					Status:  "Up 27 minutes",
 				},
@@ -80,10 +102,41 @@ func TestListGlobalSuccess(t *testing.T) {
 					ID:      "some_random_container_ID_3",
 					Created: 1626948162,
 					Image:   "dockbox/multiple",
+					Labels:  map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/multiple"},
 					ImageID: "some_random_ID_3",
 					Status:  "Up 56 minutes",
 				},
 			},
+			imagePlatforms: map[string]specs.Platform{
+				"some_random_ID_3": {OS: "linux", Architecture: "arm64", Variant: "v8"},
+			},
+		},
+		{
+			// Dockboxes created before images were labelled
+			name: "ListGlobalUnlabelled",
+			foundImages: []types.ImageSummary{
+				{
+					ID:       "some_random_ID_1",
+					Created:  1626748159,
+					RepoTags: []string{"dockbox/legacy"},
+					Size:     10000000,
+				},
+				{
+					ID:       "some_random_ID_2",
+					Created:  1626748160,
+					RepoTags: []string{"dockboxes/not_a_dockbox"},
+					Size:     900000,
+				},
+			},
+			foundContainers: []types.Container{
+				{
+					ID:      "some_random_container_ID_1",
+					Created: 1626748161,
+					Image:   "dockbox/legacy",
+					ImageID: "some_random_ID_1",
+					Status:  "Up 27 minutes",
+				},
+			},
 		},
 		{
 			name:            "ListEmpty",
@@ -95,10 +148,13 @@ func TestListGlobalSuccess(t *testing.T) {
 	for _, test := range testcases {
 		fakeDockerCli := &fakeDockerClient{
 			imageList: func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
-				return test.foundImages, nil
+				return filterImagesByLabel(test.foundImages, ilo), nil
 			},
 			containerList: func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
-				return test.foundContainers, nil
+				return filterContainersByLabel(test.foundContainers, clo), nil
+			},
+			imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+				return fakeImageInspect(imageID, test.imagePlatforms), nil, nil
 			},
 		}
 		actual, err := RunListCommand(fakeDockerCli, ListOptions{})
@@ -156,6 +212,7 @@ func TestListFromFilesSuccess(t *testing.T) {
 					ID:       "some_random_ID_1",
 					Created:  1626748159,
 					RepoTags: []string{"dockbox/nested1"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/nested1"},
 					Size:     10000000,
 				},
 				{
@@ -168,12 +225,14 @@ func TestListFromFilesSuccess(t *testing.T) {
 					ID:       "some_random_ID_3",
 					Created:  1626748161,
 					RepoTags: []string{"dockbox/nested2", "multiple_tags"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/nested2"},
 					Size:     123129124,
 				},
 				{
 					ID:       "some_random_ID_4",
 					Created:  1626749168,
 					RepoTags: []string{"dockbox/testMod2", "multiple_tags"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/testMod2"},
 					Size:     123129124,
 				},
 			},
@@ -183,6 +242,7 @@ func TestListFromFilesSuccess(t *testing.T) {
 					Created: 1626748161,
 					ImageID: "some_random_ID_3",
 					Image:   "dockbox/nested2",
+					Labels:  map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/nested2"},
 					Status:  "Up 27 minutes",
 				},
 			},
@@ -195,24 +255,28 @@ func TestListFromFilesSuccess(t *testing.T) {
 					ID:       "some_random_ID_1",
 					Created:  1626748159,
 					RepoTags: []string{"dockbox/sample1"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/sample1"},
 					Size:     10000000,
 				},
 				{
 					ID:       "some_random_ID_2",
 					Created:  1626748160,
 					RepoTags: []string{"dockbox/nested1"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/nested1"},
 					Size:     9000000,
 				},
 				{
 					ID:       "some_random_ID_3",
 					Created:  1626748161,
 					RepoTags: []string{"dockbox/nested2", "multiple_tags"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/nested2"},
 					Size:     123129124,
 				},
 				{
 					ID:       "some_random_ID_4",
 					Created:  1626748161,
 					RepoTags: []string{"dockbox/testMod2", "multiple_tags"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/testMod2"},
 					Size:     123129124,
 				},
 			},
@@ -226,18 +290,21 @@ func TestListFromFilesSuccess(t *testing.T) {
 					ID:       "some_random_ID_1",
 					Created:  1626748159,
 					RepoTags: []string{"dockbox/sample1"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/sample1"},
 					Size:     10000000,
 				},
 				{
 					ID:       "some_random_ID_2",
 					Created:  1626748159,
 					RepoTags: []string{"dockbox/testMod2"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/testMod2"},
 					Size:     10090000,
 				},
 				{
 					ID:       "some_random_ID_3",
 					Created:  1626748159,
 					RepoTags: []string{"dockbox/not_present"},
+					Labels:   map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/not_present"},
 					Size:     10090000,
 				},
 			},
@@ -246,6 +313,7 @@ func TestListFromFilesSuccess(t *testing.T) {
 					ID:      "some_random_container_ID_1",
 					Created: 1626748161,
 					Image:   "dockbox/testMod2",
+					Labels:  map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/testMod2"},
 					ImageID: "some_random_ID_2",
 					Status:  "Up 27 minutes",
 				},
@@ -257,10 +325,13 @@ func TestListFromFilesSuccess(t *testing.T) {
 	for _, test := range testcases {
 		fakeDockerCli := &fakeDockerClient{
 			imageList: func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
-				return test.foundImages, nil
+				return filterImagesByLabel(test.foundImages, ilo), nil
 			},
 			containerList: func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
-				return test.foundContainers, nil
+				return filterContainersByLabel(test.foundContainers, clo), nil
+			},
+			imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+				return fakeImageInspect(imageID, nil), nil, nil
 			},
 		}
 		actual, err := RunListCommand(fakeDockerCli, ListOptions{paths: test.paths})
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest a repository can ship at its root to describe its dockbox
+const PROJECT_MANIFEST = "dockbox.yaml"
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// readProjectManifest reads and validates the manifest of the repository at
+// dirPath, or else translates its devcontainer.json into one. It returns nil
+// if the repository has neither.
+func readProjectManifest(dirPath string) (*projectManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dirPath, PROJECT_MANIFEST))
+	if os.IsNotExist(err) {
+		return readDevcontainer(dirPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseProjectManifest(data)
+}
+
+func parseProjectManifest(data []byte) (*projectManifest, error) {
+	var manifest projectManifest
+	// Unknown keys are most likely typos
+	if err := yaml.UnmarshalStrict(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", PROJECT_MANIFEST, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if problems := manifest.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid %s:\n  - %s", PROJECT_MANIFEST, strings.Join(problems, "\n  - "))
+	}
+	return &manifest, nil
+}
+
+// validate returns every problem found in the manifest
+func (manifest *projectManifest) validate() []string {
+	problems := make([]string, 0)
+	if manifest.Image == "" {
+		problems = append(problems, "image: a base image is required")
+	} else if _, err := reference.ParseNormalizedNamed(manifest.Image); err != nil {
+		problems = append(problems, fmt.Sprintf("image: invalid image %q: %s", manifest.Image, err))
+	}
+	for i, command := range manifest.Setup {
+		if strings.TrimSpace(command) == "" {
+			problems = append(problems, fmt.Sprintf("setup[%d]: command cannot be empty", i))
+		}
+	}
+	for i, port := range manifest.Ports {
+		if _, err := nat.ParsePortSpec(publishedPortSpec(port)); err != nil {
+			problems = append(problems, fmt.Sprintf("ports[%d]: invalid port %q, expected [host:]container[/protocol]", i, port))
+		}
+	}
+	keys := make([]string, 0, len(manifest.Env))
+	for key := range manifest.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !envKeyPattern.MatchString(key) {
+			problems = append(problems, fmt.Sprintf("env: invalid variable name %q", key))
+		}
+	}
+	for i, spec := range manifest.Mounts {
+		if _, err := parseManifestMount(spec); err != nil {
+			problems = append(problems, fmt.Sprintf("mounts[%d]: %s", i, err))
+		}
+	}
+	if manifest.Resources.CPUs < 0 {
+		problems = append(problems, "resources.cpus: cannot be negative")
+	}
+	if manifest.Resources.Memory != "" {
+		if memory, err := units.RAMInBytes(manifest.Resources.Memory); err != nil || memory <= 0 {
+			problems = append(problems, fmt.Sprintf("resources.memory: invalid size %q, expected e.g. 512m or 2g", manifest.Resources.Memory))
+		}
+	}
+	return problems
+}
+
+// image returns the image the Dockerfile of the dockbox is generated from
+func (manifest *projectManifest) image() Image {
+	return Image{Image: manifest.Image, Commands: manifest.Setup, EntryPoint: manifest.Entry}
+}
+
+// publishedPortSpec publishes a port given alone on the same port of the host
+func publishedPortSpec(port string) string {
+	if strings.Contains(port, ":") {
+		return port
+	}
+	return strings.SplitN(port, "/", 2)[0] + ":" + port
+}
+
+// parseManifestMount parses a mount given as source:target[:ro|rw]. Sources
+// starting with '.' are folders of the repository, others are volumes. Other
+// folders of the host cannot be mounted, as the repository may not be trusted.
+func parseManifestMount(spec string) (mount.Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return mount.Mount{}, fmt.Errorf("invalid mount %q, expected source:target[:ro]", spec)
+	}
+	m := mount.Mount{Type: mount.TypeVolume, Source: parts[0], Target: parts[1]}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return m, fmt.Errorf("invalid mode %q in mount %q, expected ro or rw", parts[2], spec)
+		}
+	}
+	if !path.IsAbs(m.Target) {
+		return m, fmt.Errorf("target of mount %q must be an absolute path", spec)
+	}
+	if strings.HasPrefix(m.Source, "/") || strings.HasPrefix(m.Source, "~") {
+		return m, fmt.Errorf("source of mount %q must be a folder of the repository, given relative to it", spec)
+	}
+	if strings.HasPrefix(m.Source, ".") {
+		m.Type = mount.TypeBind
+	} else if !volumeNamePattern.MatchString(m.Source) {
+		return m, fmt.Errorf("invalid volume name %q in mount %q", m.Source, spec)
+	}
+	return m, nil
+}
+
+// applyProjectManifest sets the environment, ports, mounts and resource limits
+// declared by the manifest of the dockbox at dirPath on its container, creating
+// its volumes if needed. The host configuration is nil without a manifest.
+func applyProjectManifest(ctx context.Context, cli dockerClient, dirPath string, dockboxName string, config *container.Config) (*container.HostConfig, error) {
+	manifest, err := readProjectManifest(dirPath)
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+	hostConfig := &container.HostConfig{}
+	config.User = manifest.User
+
+	for key, value := range manifest.Env {
+		config.Env = append(config.Env, key+"="+value)
+	}
+	sort.Strings(config.Env)
+
+	specs := make([]string, 0, len(manifest.Ports))
+	for _, port := range manifest.Ports {
+		specs = append(specs, publishedPortSpec(port))
+	}
+	config.ExposedPorts, hostConfig.PortBindings, err = nat.ParsePortSpecs(specs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, spec := range manifest.Mounts {
+		m, err := parseManifestMount(spec)
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == mount.TypeBind {
+			if m.Source, err = resolveMountSource(dirPath, m.Source); err != nil {
+				return nil, err
+			}
+		} else {
+			if m.Source, err = createDockboxVolume(ctx, cli, dockboxName, m.Source); err != nil {
+				return nil, err
+			}
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, m)
+	}
+
+	hostConfig.NanoCPUs = int64(manifest.Resources.CPUs * 1e9)
+	if manifest.Resources.Memory != "" {
+		if hostConfig.Memory, err = units.RAMInBytes(manifest.Resources.Memory); err != nil {
+			return nil, err
+		}
+	}
+	return hostConfig, nil
+}
+
+// createDockboxVolume creates a volume of a dockbox and returns its name. Volumes
+// are namespaced by dockbox and labelled so that clean removes them.
+func createDockboxVolume(ctx context.Context, cli dockerClient, dockboxName string, name string) (string, error) {
+	name = dockboxName + "_" + name
+	_, err := cli.VolumeCreate(ctx, volume.VolumeCreateBody{Name: name, Labels: map[string]string{LABEL_NAME: dockboxName}})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// resolveMountSource returns the absolute path of a folder of the dockbox at
+// dirPath mounted from the host. Links are followed, so that a link of the
+// repository cannot lead to a folder outside of it.
+func resolveMountSource(dirPath string, source string) (string, error) {
+	dirPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return "", err
+	}
+	source = filepath.Join(dirPath, source)
+	if exists, _, _ := pathExists(source); !exists {
+		return "", errors.New("mounted folder " + source + " does not exist")
+	}
+	realDir, err := filepath.EvalSymlinks(dirPath)
+	if err != nil {
+		return "", err
+	}
+	realSource, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", err
+	}
+	if !isWithinDir(realDir, realSource) {
+		return "", fmt.Errorf("mounted folder %s is outside of the dockbox", source)
+	}
+	return source, nil
+}
+
+// generateDockerfileFromManifest generates the Dockerfile of the dockbox at dirPath
+// from its manifest or devcontainer.json, returning an empty name if it has neither
+func generateDockerfileFromManifest(dirPath string) (string, error) {
+	manifest, err := readProjectManifest(dirPath)
+	if err != nil || manifest == nil {
+		return "", err
+	}
+	if manifest.source == "" {
+		manifest.source = PROJECT_MANIFEST
+	}
+	log.Printf("Found %s in repository! Using it to create dockbox...\n", manifest.source)
+	if manifest.dockerfile != "" {
+		return generateDockerfileFromDevcontainer(dirPath, manifest)
+	}
+	return createDockerFileForLanguage(dirPath, manifest.image())
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+const testProjectManifest = `image: python:3.9-slim
+setup:
+  - pip install -r requirements.txt
+entry: python app.py
+ports:
+  - "8000"
+  - 9090:80/udp
+env:
+  DEBUG: "1"
+  APP_ENV: dev
+mounts:
+  - ./data:/app/data:ro
+  - cache:/root/.cache
+resources:
+  cpus: 1.5
+  memory: 512m
+`
+
+// newManifestTestFolder returns a repository holding the given manifest and a Dockerfile
+func newManifestTestFolder(t *testing.T, manifest string) string {
+	return newTestFolder(t, map[string]string{
+		"data/":                             "",
+		"Dockerfile":                        "FROM ubuntu:18.04\n",
+		PROJECT_MANIFEST:                    manifest,
+		HIDDEN_DIRECTORY + "/.dockbox.yaml": "image: dockbox/app1\n",
+	})
+}
+
+func TestProjectManifestDockerfile(t *testing.T) {
+	dirPath := newManifestTestFolder(t, testProjectManifest)
+
+	// The manifest takes precedence over the Dockerfile of the repository
+	dockerFileName, language, err := getDockerfile(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(HIDDEN_DIRECTORY, ".Dockerfile.dockbox"), dockerFileName)
+	assert.Equal(t, "", language)
+	dockerFile, err := ioutil.ReadFile(filepath.Join(dirPath, dockerFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, "FROM python:3.9-slim\nWORKDIR /app\nCOPY . .\nRUN pip install -r requirements.txt\nENTRYPOINT python app.py\n", string(dockerFile))
+
+	os.Remove(filepath.Join(dirPath, PROJECT_MANIFEST))
+	os.RemoveAll(filepath.Join(dirPath, HIDDEN_DIRECTORY))
+	dockerFileName, _, err = getDockerfile(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "Dockerfile", dockerFileName)
+}
+
+func TestProjectManifestContainer(t *testing.T) {
+	dirPath := newManifestTestFolder(t, testProjectManifest)
+	var volumes []volume.VolumeCreateBody
+	fakeDockerCli := &fakeDockerClient{
+		volumeCreate: func(c context.Context, options volume.VolumeCreateBody) (types.Volume, error) {
+			volumes = append(volumes, options)
+			return types.Volume{Name: options.Name, Labels: options.Labels}, nil
+		},
+		containerCreate: func(c context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+			assert.Equal(t, "dockbox/app1", config.Image)
+			assert.Equal(t, []string{"APP_ENV=dev", "DEBUG=1"}, config.Env)
+			assert.Equal(t, nat.PortSet{"8000/tcp": {}, "80/udp": {}}, config.ExposedPorts)
+			assert.Equal(t, nat.PortMap{
+				"8000/tcp": {{HostPort: "8000"}},
+				"80/udp":   {{HostPort: "9090"}},
+			}, hostConfig.PortBindings)
+			assert.Equal(t, []mount.Mount{
+				{Type: mount.TypeBind, Source: filepath.Join(dirPath, "data"), Target: "/app/data", ReadOnly: true},
+				{Type: mount.TypeVolume, Source: "app1_cache", Target: "/root/.cache"},
+			}, hostConfig.Mounts)
+			assert.Equal(t, int64(1500000000), hostConfig.NanoCPUs)
+			assert.Equal(t, int64(512*1024*1024), hostConfig.Memory)
+			return container.ContainerCreateCreatedBody{ID: "app1_ctr"}, nil
+		},
+	}
+
+	containerID, err := createContainerFromPath(context.Background(), fakeDockerCli, dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "app1_ctr", containerID)
+	assert.Equal(t, []volume.VolumeCreateBody{{Name: "app1_cache", Labels: map[string]string{LABEL_NAME: "app1"}}}, volumes)
+}
+
+func TestProjectManifestMountOutside(t *testing.T) {
+	dirPath := newManifestTestFolder(t, "image: ubuntu:18.04\nmounts: [\"./home:/root\"]\n")
+	outside := t.TempDir()
+	assert.Nil(t, os.Symlink(outside, filepath.Join(dirPath, "home")))
+
+	// A link of the repository cannot lead out of it
+	_, err := createContainerFromPath(context.Background(), &fakeDockerClient{}, dirPath)
+	assert.EqualError(t, err, "mounted folder "+filepath.Join(dirPath, "home")+" is outside of the dockbox")
+}
+
+func TestProjectManifestErrors(t *testing.T) {
+	testcases := []struct {
+		name          string
+		manifest      string
+		expectedError string
+	}{
+		{
+			name:          "UnknownKey",
+			manifest:      "image: ubuntu:18.04\nport:\n  - 8000\n",
+			expectedError: "invalid dockbox.yaml: unmarshal errors:\n  line 2: field port not found in type cmd.projectManifest",
+		},
+		{
+			name:          "WrongType",
+			manifest:      "image: ubuntu:18.04\nsetup: make\n",
+			expectedError: "invalid dockbox.yaml: unmarshal errors:\n  line 2: cannot unmarshal !!str `make` into []string",
+		},
+		{
+			name: "Invalid",
+			manifest: `setup: [""]
+ports: ["80:http"]
+env:
+  MY-VAR: x
+mounts: ["data", "cache:relative", "./data:/data:rx", "bad name:/data", "~/.ssh:/root/.ssh", "/:/host"]
+resources:
+  cpus: -1
+  memory: lots
+`,
+			expectedError: `invalid dockbox.yaml:
+  - image: a base image is required
+  - setup[0]: command cannot be empty
+  - ports[0]: invalid port "80:http", expected [host:]container[/protocol]
+  - env: invalid variable name "MY-VAR"
+  - mounts[0]: invalid mount "data", expected source:target[:ro]
+  - mounts[1]: target of mount "cache:relative" must be an absolute path
+  - mounts[2]: invalid mode "rx" in mount "./data:/data:rx", expected ro or rw
+  - mounts[3]: invalid volume name "bad name" in mount "bad name:/data"
+  - mounts[4]: source of mount "~/.ssh:/root/.ssh" must be a folder of the repository, given relative to it
+  - mounts[5]: source of mount "/:/host" must be a folder of the repository, given relative to it
+  - resources.cpus: cannot be negative
+  - resources.memory: invalid size "lots", expected e.g. 512m or 2g`,
+		},
+		{
+			name:          "InvalidImage",
+			manifest:      "image: Ubuntu\n",
+			expectedError: "invalid dockbox.yaml:\n  - image: invalid image \"Ubuntu\": invalid reference format: repository name must be lowercase",
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := newManifestTestFolder(t, test.manifest)
+			_, _, err := getDockerfile(dirPath)
+			assert.EqualError(t, err, test.expectedError)
+		})
+	}
+}
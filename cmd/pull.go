@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+// pullCmd represents the pull command
+func NewPullCommand(cli dockerClient) *cobra.Command {
+	var pullOptions = PullOptions{}
+	var pullCmd = &cobra.Command{
+		Use:   "pull <registry/repo[:tag]> [<directory>]",
+		Short: "Pulls a dockbox pushed to a registry",
+		Long: `Pulls a dockbox pushed with dockbox push and sets up a folder from which it can
+	be entered, without needing its source code. The folder defaults to the name
+	of the dockbox.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			pullOptions.ref = args[0]
+			if len(args) > 1 {
+				pullOptions.destPath = args[1]
+			}
+			name, destPath, err := RunPullCommand(cli, pullOptions)
+			CheckError(err)
+			fmt.Printf("Successfully pulled dockbox %s, run dockbox enter %s to start it\n", name, destPath)
+		},
+	}
+	pullCmd.PersistentFlags().StringVarP(&pullOptions.dockboxName, "name", "n", "", "Name of the dockbox (defaults to its name when it was pushed)")
+	return pullCmd
+}
+
+// RunPullCommand pulls the dockbox of pullOptions, returning its name and the
+// folder it can be entered from
+func RunPullCommand(cli dockerClient, pullOptions PullOptions) (string, string, error) {
+	ctx := context.Background()
+	ref, err := parseRegistryReference(pullOptions.ref)
+	if err != nil {
+		return "", "", err
+	}
+	refName := reference.FamiliarString(ref)
+	if pullOptions.dockboxName != "" {
+		if err := validateDockboxName(pullOptions.dockboxName); err != nil {
+			return "", "", err
+		}
+	}
+	if pullOptions.destPath != "" {
+		if exists, _, _ := pathExists(filepath.Join(pullOptions.destPath, HIDDEN_DIRECTORY, ".dockbox.yaml")); exists {
+			return "", "", fmt.Errorf("%s already contains a dockbox", pullOptions.destPath)
+		}
+	}
+	auth, err := registryAuth(ref, pullOptions.configDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Only the tag created by this pull is removed, not one the user already had
+	_, _, err = cli.ImageInspectWithRaw(ctx, refName)
+	refExisted := err == nil
+	untagRef := func() {
+		if !refExisted {
+			untagImage(ctx, cli, refName)
+		}
+	}
+
+	body, err := cli.ImagePull(ctx, refName, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", "", err
+	}
+	err = printTransferProgress(body)
+	body.Close()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to pull %s: %s", refName, err)
+	}
+
+	info, _, err := cli.ImageInspectWithRaw(ctx, refName)
+	if err != nil {
+		return "", "", err
+	}
+	labels := map[string]string{}
+	if info.Config != nil && info.Config.Labels != nil {
+		labels = info.Config.Labels
+	}
+	if _, ok := labels[LABEL_SOURCE]; !ok {
+		untagRef()
+		return "", "", fmt.Errorf("%s is not a dockbox", refName)
+	}
+
+	name := pullOptions.dockboxName
+	if name == "" {
+		name = labels[LABEL_NAME]
+	}
+	if name == "" {
+		name = sanitizeDockboxName(path.Base(reference.Path(ref)))
+	}
+	imageName := dockboxNameToImageName(name)
+	existing, exists, err := checkDockboxExists(ctx, cli, name)
+	if err != nil {
+		untagRef()
+		return "", "", err
+	}
+	// A renamed dockbox is built from the image pulled
+	if exists && existing.ID != info.ID && existing.Parent != info.ID {
+		untagRef()
+		return "", "", fmt.Errorf("cannot pull %s: another dockbox named %s already exists, use --name to pick another name", refName, name)
+	}
+	destPath := pullOptions.destPath
+	if destPath == "" {
+		destPath = name
+		if exists, _, _ := pathExists(filepath.Join(destPath, HIDDEN_DIRECTORY, ".dockbox.yaml")); exists {
+			untagRef()
+			return "", "", fmt.Errorf("%s already contains a dockbox", destPath)
+		}
+	}
+
+	// The dockbox is only known locally by its dockbox tag. Clean finds the
+	// resources of a dockbox by its name label, so a renamed dockbox is relabelled.
+	if labels[LABEL_NAME] != name {
+		err := relabelImage(ctx, cli, refName, imageName, map[string]string{LABEL_NAME: name})
+		untagRef()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to rename %s to %s: %s", refName, name, err)
+		}
+	} else if local, err := parseRegistryReference(imageName); err != nil || reference.FamiliarString(local) != refName {
+		if err := cli.ImageTag(ctx, refName, imageName); err != nil {
+			return "", "", err
+		}
+		untagRef()
+	}
+
+	if err := os.MkdirAll(filepath.Join(destPath, HIDDEN_DIRECTORY), 0755); err != nil {
+		return "", "", err
+	}
+	err = writeConfig(destPath, map[string]string{
+		"image":     imageName,
+		"language":  labels[LABEL_LANGUAGE],
+		"platform":  platforms.Format(specs.Platform{OS: info.Os, Architecture: info.Architecture, Variant: info.Variant}),
+		"container": "",
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return name, destPath, nil
+}
+
+// relabelImage builds an image tagged target from the image source, only
+// changing the given labels
+func relabelImage(ctx context.Context, cli dockerClient, source string, target string, labels map[string]string) error {
+	dockerFile := []byte("FROM " + source + "\n")
+	var buildContext bytes.Buffer
+	tarWriter := tar.NewWriter(&buildContext)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerFile))}); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(dockerFile); err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return buildImageWithLegacyBuilder(ctx, cli, &buildContext, types.ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Tags:       []string{target},
+		Remove:     true,
+		Labels:     labels,
+	})
+}
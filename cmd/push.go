@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/registry"
+	"github.com/spf13/cobra"
+)
+
+// pushCmd represents the push command
+func NewPushCommand(cli dockerClient) *cobra.Command {
+	var pushOptions = PushOptions{}
+	var pushCmd = &cobra.Command{
+		Use:   "push <name|path> <registry/repo[:tag]>",
+		Short: "Pushes a dockbox to a registry",
+		Long: `Pushes the image of a dockbox to a registry, so that it can be entered
+	elsewhere with dockbox pull. Credentials are those of docker login, including
+	the credential helpers of the Docker configuration.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			pushOptions.arg = args[0]
+			pushOptions.ref = args[1]
+			ref, err := RunPushCommand(cli, pushOptions)
+			CheckError(err)
+			fmt.Println("Successfully pushed dockbox to " + ref)
+		},
+	}
+	return pushCmd
+}
+
+func RunPushCommand(cli dockerClient, pushOptions PushOptions) (string, error) {
+	ctx := context.Background()
+	imageName, err := getImageNameFromArg(pushOptions.arg)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := cli.ImageInspectWithRaw(ctx, imageName); err != nil {
+		return "", fmt.Errorf("no dockbox named %s: %s", repoTagToDockboxName(imageName), err)
+	}
+	ref, err := parseRegistryReference(pushOptions.ref)
+	if err != nil {
+		return "", err
+	}
+	auth, err := registryAuth(ref, pushOptions.configDir)
+	if err != nil {
+		return "", err
+	}
+
+	// Labels of the dockbox are part of its image and travel along with it
+	refName := reference.FamiliarString(ref)
+	if local, err := parseRegistryReference(imageName); err != nil || reference.FamiliarString(local) != refName {
+		if err := cli.ImageTag(ctx, imageName, refName); err != nil {
+			return "", err
+		}
+		// Only the dockbox tag is kept locally
+		defer untagImage(ctx, cli, refName)
+	}
+
+	body, err := cli.ImagePush(ctx, refName, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if err := printTransferProgress(body); err != nil {
+		return "", fmt.Errorf("failed to push %s: %s", refName, err)
+	}
+	return refName, nil
+}
+
+// parseRegistryReference parses the reference of an image in a registry,
+// defaulting to the latest tag
+func parseRegistryReference(ref string) (reference.NamedTagged, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference %q: %s", ref, err)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return nil, fmt.Errorf("invalid reference %q: use a tag instead of a digest", ref)
+	}
+	return reference.TagNameOnly(named).(reference.NamedTagged), nil
+}
+
+// registryAuth returns the encoded credentials for the registry of ref, as stored
+// by docker login in the Docker configuration at configDir or the default one
+func registryAuth(ref reference.Named, configDir string) (string, error) {
+	repoInfo, err := registry.ParseRepositoryInfo(ref)
+	if err != nil {
+		return "", err
+	}
+	if configDir == "" {
+		configDir = config.Dir()
+	}
+	configFile, err := config.Load(configDir)
+	if err != nil {
+		return "", err
+	}
+	authConfig, err := configFile.GetAuthConfig(registry.GetAuthConfigKey(repoInfo.Index))
+	if err != nil {
+		return "", fmt.Errorf("failed to get credentials for %s: %s", repoInfo.Index.Name, err)
+	}
+	return command.EncodeAuthToBase64(types.AuthConfig(authConfig))
+}
+
+func untagImage(ctx context.Context, cli dockerClient, imageName string) {
+	if _, err := cli.ImageRemove(ctx, imageName, types.ImageRemoveOptions{}); err != nil {
+		log.Printf("Warning: Unable to remove tag %s: %s", imageName, err)
+	}
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+)
+
+// registryTestClient stands in for a daemon talking to a local registry
+type registryTestClient struct {
+	*fakeDockerClient
+	local  map[string]types.ImageInspect
+	remote map[string]types.ImageInspect
+	auths  []string
+}
+
+func normalizeTestRef(ref string) string {
+	if !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		return ref + ":latest"
+	}
+	return ref
+}
+
+func newRegistryTestClient(t *testing.T) *registryTestClient {
+	cli := &registryTestClient{
+		local: map[string]types.ImageInspect{
+			"dockbox/app1:latest": {ID: "sha256:app1", Os: "linux", Architecture: "amd64", Config: &container.Config{Labels: map[string]string{
+				LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_NAME: "app1", LABEL_LANGUAGE: "Python",
+			}}},
+		},
+		remote: map[string]types.ImageInspect{
+			"localhost:5000/ubuntu:18.04": {ID: "sha256:ubuntu", Os: "linux", Architecture: "amd64"},
+		},
+	}
+	cli.fakeDockerClient = &fakeDockerClient{
+		imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+			info, ok := cli.local[normalizeTestRef(imageID)]
+			if !ok {
+				return info, nil, errors.New("Error: No such image: " + imageID)
+			}
+			return info, nil, nil
+		},
+		imageTag: func(c context.Context, source, target string) error {
+			info, ok := cli.local[normalizeTestRef(source)]
+			if !ok {
+				return errors.New("Error: No such image: " + source)
+			}
+			cli.local[normalizeTestRef(target)] = info
+			return nil
+		},
+		imageRemove: func(c context.Context, imageID string, iro types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+			delete(cli.local, normalizeTestRef(imageID))
+			return []types.ImageDeleteResponseItem{{Untagged: imageID}}, nil
+		},
+		imagePush: func(c context.Context, image string, options types.ImagePushOptions) (io.ReadCloser, error) {
+			cli.auths = append(cli.auths, options.RegistryAuth)
+			cli.remote[image] = cli.local[image]
+			return ioutil.NopCloser(strings.NewReader(`{"status":"Pushed","id":"app1"}`)), nil
+		},
+		imageBuild: func(c context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+			tarReader := tar.NewReader(buildContext)
+			_, err := tarReader.Next()
+			assert.Nil(t, err)
+			dockerFile, err := ioutil.ReadAll(tarReader)
+			assert.Nil(t, err)
+			base := cli.local[normalizeTestRef(strings.TrimSpace(strings.TrimPrefix(string(dockerFile), "FROM ")))]
+			labels := make(map[string]string)
+			for key, value := range base.Config.Labels {
+				labels[key] = value
+			}
+			for key, value := range options.Labels {
+				labels[key] = value
+			}
+			info := base
+			info.ID, info.Parent, info.Config = base.ID+"-relabelled", base.ID, &container.Config{Labels: labels}
+			for _, tag := range options.Tags {
+				cli.local[normalizeTestRef(tag)] = info
+			}
+			return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(`{"stream":"Successfully built relabelled\n"}`))}, nil
+		},
+		imagePull: func(c context.Context, refStr string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			cli.auths = append(cli.auths, options.RegistryAuth)
+			info, ok := cli.remote[refStr]
+			if !ok {
+				return ioutil.NopCloser(strings.NewReader(`{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`)), nil
+			}
+			cli.local[refStr] = info
+			return ioutil.NopCloser(strings.NewReader(`{"status":"Downloaded newer image for ` + refStr + `"}`)), nil
+		},
+	}
+	return cli
+}
+
+// newRegistryTestConfig returns a Docker configuration logged in to the local registry
+func newRegistryTestConfig(t *testing.T) string {
+	configDir := t.TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"auths":{"localhost:5000":{"auth":"`+auth+`"}}}`), 0644))
+	return configDir
+}
+
+func decodeTestAuth(t *testing.T, encoded string) types.AuthConfig {
+	var authConfig types.AuthConfig
+	data, err := base64.URLEncoding.DecodeString(encoded)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(data, &authConfig))
+	return authConfig
+}
+
+func TestPushPull(t *testing.T) {
+	cli := newRegistryTestClient(t)
+	configDir := newRegistryTestConfig(t)
+
+	ref, err := RunPushCommand(cli, PushOptions{arg: "app1", ref: "localhost:5000/team/app1:v1", configDir: configDir})
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:5000/team/app1:v1", ref)
+	assert.Equal(t, "sha256:app1", cli.remote[ref].ID)
+	assert.Equal(t, "app1", cli.remote[ref].Config.Labels[LABEL_NAME])
+	_, tagged := cli.local[ref]
+	assert.False(t, tagged, "the registry tag must not be kept locally")
+	authConfig := decodeTestAuth(t, cli.auths[0])
+	assert.Equal(t, "user", authConfig.Username)
+	assert.Equal(t, "secret", authConfig.Password)
+	assert.Equal(t, "localhost:5000", authConfig.ServerAddress)
+
+	// Pulled on a machine without the dockbox
+	delete(cli.local, "dockbox/app1:latest")
+	destPath := filepath.Join(t.TempDir(), "app1")
+	name, actualPath, err := RunPullCommand(cli, PullOptions{ref: ref, destPath: destPath, configDir: configDir})
+	assert.Nil(t, err)
+	assert.Equal(t, "app1", name)
+	assert.Equal(t, destPath, actualPath)
+	assert.Equal(t, "user", decodeTestAuth(t, cli.auths[1]).Username)
+	assert.Equal(t, "sha256:app1", cli.local["dockbox/app1:latest"].ID)
+	_, tagged = cli.local[ref]
+	assert.False(t, tagged, "the registry tag must not be kept locally")
+
+	config := readTestConfig(t, destPath)
+	assert.Equal(t, "dockbox/app1", config.GetString("image"))
+	assert.Equal(t, "Python", config.GetString("language"))
+	assert.Equal(t, "linux/amd64", config.GetString("platform"))
+	assert.Equal(t, "", config.GetString("container"))
+
+	_, _, err = RunPullCommand(cli, PullOptions{ref: ref, destPath: destPath, configDir: configDir})
+	assert.EqualError(t, err, destPath+" already contains a dockbox")
+
+	name, _, err = RunPullCommand(cli, PullOptions{ref: ref, destPath: t.TempDir(), dockboxName: "app1-copy", configDir: configDir})
+	assert.Nil(t, err)
+	assert.Equal(t, "app1-copy", name)
+	// The renamed dockbox is cleaned by its new name
+	renamed := cli.local["dockbox/app1-copy:latest"]
+	assert.Equal(t, "sha256:app1", renamed.Parent)
+	assert.Equal(t, "app1-copy", renamed.Config.Labels[LABEL_NAME])
+	assert.Equal(t, "https://github.com/dockboxhq/app1", renamed.Config.Labels[LABEL_SOURCE])
+	assert.Equal(t, "app1", cli.local["dockbox/app1:latest"].Config.Labels[LABEL_NAME])
+	_, tagged = cli.local[ref]
+	assert.False(t, tagged, "the registry tag must not be kept locally")
+
+	// Pulling it again under the same name keeps it
+	_, _, err = RunPullCommand(cli, PullOptions{ref: ref, destPath: t.TempDir(), dockboxName: "app1-copy", configDir: configDir})
+	assert.Nil(t, err)
+}
+
+func TestPushPullErrors(t *testing.T) {
+	cli := newRegistryTestClient(t)
+	configDir := newRegistryTestConfig(t)
+
+	_, err := RunPushCommand(cli, PushOptions{arg: "missing", ref: "localhost:5000/missing", configDir: configDir})
+	assert.EqualError(t, err, "no dockbox named missing: Error: No such image: dockbox/missing")
+
+	_, err = RunPushCommand(cli, PushOptions{arg: "app1", ref: "localhost:5000/app1@sha256:4bf7b6b2d0b4c3e49e3c4e4ee7bd16e40e3e5e0e3e5e0e3e5e0e3e5e0e3e5e0e", configDir: configDir})
+	assert.EqualError(t, err, `invalid reference "localhost:5000/app1@sha256:4bf7b6b2d0b4c3e49e3c4e4ee7bd16e40e3e5e0e3e5e0e3e5e0e3e5e0e3e5e0e": use a tag instead of a digest`)
+
+	_, _, err = RunPullCommand(cli, PullOptions{ref: "localhost:5000/missing", destPath: t.TempDir(), configDir: configDir})
+	assert.EqualError(t, err, "failed to pull localhost:5000/missing:latest: manifest unknown")
+
+	_, _, err = RunPullCommand(cli, PullOptions{ref: "localhost:5000/ubuntu:18.04", destPath: t.TempDir(), configDir: configDir})
+	assert.EqualError(t, err, "localhost:5000/ubuntu:18.04 is not a dockbox")
+	_, tagged := cli.local["localhost:5000/ubuntu:18.04"]
+	assert.False(t, tagged)
+	// Tags the user had before the pull are kept
+	cli.local["localhost:5000/ubuntu:18.04"] = cli.remote["localhost:5000/ubuntu:18.04"]
+	_, _, err = RunPullCommand(cli, PullOptions{ref: "localhost:5000/ubuntu:18.04", destPath: t.TempDir(), configDir: configDir})
+	assert.EqualError(t, err, "localhost:5000/ubuntu:18.04 is not a dockbox")
+	_, tagged = cli.local["localhost:5000/ubuntu:18.04"]
+	assert.True(t, tagged)
+
+	// Another dockbox is already named app1
+	cli.remote["localhost:5000/app1:latest"] = types.ImageInspect{ID: "sha256:other", Config: &container.Config{Labels: map[string]string{LABEL_SOURCE: "https://github.com/other/app1", LABEL_NAME: "app1"}}}
+	_, _, err = RunPullCommand(cli, PullOptions{ref: "localhost:5000/app1", destPath: t.TempDir(), configDir: configDir})
+	assert.EqualError(t, err, "cannot pull localhost:5000/app1:latest: another dockbox named app1 already exists, use --name to pick another name")
+	assert.Equal(t, "sha256:app1", cli.local["dockbox/app1:latest"].ID)
+}
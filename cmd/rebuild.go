@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// rebuildCmd represents the rebuild command
+func NewRebuildCommand(cli dockerClient) *cobra.Command {
+	var rebuildOptions RebuildOptions
+	var rebuildCmd = &cobra.Command{
+		Use:   "rebuild [<path>]",
+		Short: "Rebuilds the dockbox in a given directory",
+		Long: `Use this command to rebuild the image of an existing dockbox, for example after 
+	changing its Dockerfile. The container of the dockbox is replaced with a new one.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rebuildOptions.path = "."
+			if len(args) > 0 {
+				rebuildOptions.path = args[0]
+			}
+			CheckError(RunRebuildCommand(cli, rebuildOptions))
+		},
+	}
+	addBuildFlags(rebuildCmd, &rebuildOptions.build)
+	return rebuildCmd
+}
+
+func RunRebuildCommand(cli dockerClient, rebuildOptions RebuildOptions) error {
+	ctx := context.Background()
+	imageName, err := getConfigByKey(rebuildOptions.path, "image")
+	if err != nil {
+		return err
+	}
+	if imageName == "" {
+		return errors.New("no image found for dockbox")
+	}
+
+	changePlatform := rebuildOptions.build.platform != ""
+	if changePlatform {
+		rebuildOptions.build.platform, err = normalizePlatform(rebuildOptions.build.platform)
+	} else {
+		rebuildOptions.build.platform, err = getConfigByKey(rebuildOptions.path, "platform")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep the source of the dockbox, the other labels are refreshed
+	source, err := filepath.Abs(rebuildOptions.path)
+	if err != nil {
+		return err
+	}
+	if info, _, err := cli.ImageInspectWithRaw(ctx, imageName); err == nil && info.Config != nil {
+		if previousSource, ok := info.Config.Labels[LABEL_SOURCE]; ok {
+			source = previousSource
+		}
+	}
+	dockboxName := repoTagToDockboxName(imageName)
+
+	project, primary, err := loadDockboxComposeProject(rebuildOptions.path)
+	if err != nil {
+		return err
+	}
+	if project != nil {
+		log.Printf("Rebuilding services of dockbox at %s...", rebuildOptions.path)
+		_, err = buildComposeProject(cli, rebuildOptions.path, project, primary.Name, dockboxName, source, rebuildOptions.build)
+		if err != nil {
+			return err
+		}
+		if err := removeComposeServices(ctx, cli, project, primary.Name, dockboxName); err != nil {
+			return err
+		}
+	} else {
+		dockerFileName, err := getConfigByKey(rebuildOptions.path, "dockerfile")
+		if err != nil {
+			return err
+		}
+		language, err := getConfigByKey(rebuildOptions.path, "language")
+		if err != nil {
+			return err
+		}
+		// The Dockerfile generated from a manifest or devcontainer.json follows its changes
+		manifest, err := readProjectManifest(rebuildOptions.path)
+		if err != nil {
+			return err
+		}
+		buildOptions := rebuildOptions.build
+		if dockerFileName == "" || manifest != nil {
+			dockerFileName, language, err = getDockerfile(rebuildOptions.path)
+			if err != nil {
+				return err
+			}
+			buildOptions, err = devcontainerBuildOptions(rebuildOptions.path, buildOptions)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Rebuilding dockbox at %s using %s...", rebuildOptions.path, dockerFileName)
+		labels := dockboxLabels(dockboxName, source, rebuildOptions.path, language)
+		_, err = buildGeneratedImage(cli, rebuildOptions.path, dockerFileName, dockboxName, labels, buildOptions, language)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The platform is only recorded once the dockbox was built for it
+	if changePlatform {
+		if err := setConfigKey("platform", rebuildOptions.build.platform, rebuildOptions.path); err != nil {
+			return err
+		}
+	}
+
+	oldContainerID, err := getConfigByKey(rebuildOptions.path, "container")
+	if err != nil {
+		return err
+	}
+	if oldContainerID != "" {
+		err = removeContainer(ctx, cli, oldContainerID)
+		if err != nil && !strings.Contains(err.Error(), "No such container") {
+			return err
+		}
+	}
+
+	_, err = createContainerFromPath(ctx, cli, rebuildOptions.path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully rebuilt dockbox: %s\n", imageName)
+	return nil
+}
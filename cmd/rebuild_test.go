@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebuildPlatform(t *testing.T) {
+	testcases := []struct {
+		name              string
+		buildOutput       string
+		enter             bool
+		expectedPlatform  string
+		expectedContainer string
+		expectedRemoved   []string
+		expectedError     string
+	}{
+		{
+			name:              "Rebuild",
+			buildOutput:       `{"stream":"Successfully built 39a8cfeef173\n"}`,
+			expectedPlatform:  "linux/arm64",
+			expectedContainer: "app1_arm64",
+			expectedRemoved:   []string{"app1_amd64"},
+		},
+		{
+			name:              "BuildFailure",
+			buildOutput:       `{"errorDetail":{"message":"no match for platform in manifest"},"error":"no match for platform in manifest"}`,
+			expectedPlatform:  "linux/amd64",
+			expectedContainer: "app1_amd64",
+			expectedError:     "failed to build dockbox: no match for platform in manifest",
+		},
+		{
+			// Entering on another platform rebuilds the dockbox for it
+			name:              "EnterBuildFailure",
+			buildOutput:       `{"errorDetail":{"message":"no match for platform in manifest"},"error":"no match for platform in manifest"}`,
+			enter:             true,
+			expectedPlatform:  "linux/amd64",
+			expectedContainer: "app1_amd64",
+			expectedError:     "failed to build dockbox: no match for platform in manifest",
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := t.TempDir()
+			assert.Nil(t, os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, "Dockerfile"), []byte("FROM ubuntu:18.04\n"), 0644))
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml"), []byte("image: dockbox/app1\ndockerfile: Dockerfile\ncontainer: app1_amd64\nplatform: linux/amd64\n"), 0644))
+
+			var removed []string
+			fakeDockerCli := &fakeDockerClient{
+				imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+					return types.ImageInspect{ID: imageID, Config: &container.Config{}}, nil, nil
+				},
+				imageBuild: func(c context.Context, r io.Reader, ibo types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+					assert.Equal(t, "linux/arm64", ibo.Platform)
+					return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(test.buildOutput + "\n"))}, nil
+				},
+				containerRemove: func(c context.Context, containerID string, options types.ContainerRemoveOptions) error {
+					removed = append(removed, containerID)
+					return nil
+				},
+				containerCreate: func(c context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+					assert.Equal(t, "arm64", platform.Architecture)
+					return container.ContainerCreateCreatedBody{ID: "app1_arm64"}, nil
+				},
+			}
+			var err error
+			if test.enter {
+				err = RunEnterCommand(fakeDockerCli, EnterOptions{path: dirPath, platform: "arm64"})
+			} else {
+				err = RunRebuildCommand(fakeDockerCli, RebuildOptions{path: dirPath, build: BuildOptions{platform: "arm64"}})
+			}
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+			} else {
+				assert.Nil(t, err)
+			}
+			config := readTestConfig(t, dirPath)
+			assert.Equal(t, test.expectedPlatform, config.GetString("platform"))
+			assert.Equal(t, test.expectedContainer, config.GetString("container"))
+			assert.Equal(t, test.expectedRemoved, removed)
+		})
+	}
+}
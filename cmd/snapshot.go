@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/spf13/cobra"
+)
+
+// snapshotCmd represents the snapshot command
+func NewSnapshotCommand(cli dockerClient) *cobra.Command {
+	var snapshotOptions = SnapshotOptions{}
+	var snapshotCmd = &cobra.Command{
+		Use:   "snapshot [<path>]",
+		Short: "Saves the state of a dockbox's container as a new image",
+		Long: `Saves everything done inside a dockbox, such as installed tools or generated
+	data, as an image built on top of the dockbox. Start from a snapshot with
+	dockbox enter --from-snapshot <tag>.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			snapshotOptions.path = "."
+			if len(args) > 0 {
+				snapshotOptions.path = args[0]
+			}
+			imageName, err := RunSnapshotCommand(cli, snapshotOptions)
+			CheckError(err)
+			fmt.Println("Successfully saved snapshot: " + imageName)
+		},
+	}
+	snapshotCmd.PersistentFlags().StringVarP(&snapshotOptions.tag, "tag", "t", "", "Tag of the snapshot (default snapshot-<date>-<time>)")
+	return snapshotCmd
+}
+
+func RunSnapshotCommand(cli dockerClient, snapshotOptions SnapshotOptions) (string, error) {
+	ctx := context.Background()
+	containerID, err := getConfigByKey(snapshotOptions.path, "container")
+	if err != nil {
+		return "", err
+	}
+	if containerID == "" {
+		return "", errors.New("this dockbox has no container to snapshot, run dockbox enter first")
+	}
+	imageName, err := getConfigByKey(snapshotOptions.path, "image")
+	if err != nil {
+		return "", err
+	}
+
+	tag := snapshotOptions.tag
+	if tag == "" {
+		now := snapshotOptions.now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		tag = "snapshot-" + now.UTC().Format("20060102-150405")
+	}
+	snapshotName, err := snapshotImageName(imageName, tag)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = cli.ContainerCommit(ctx, containerID, types.ContainerCommitOptions{
+		Reference: snapshotName,
+		Comment:   "Snapshot of " + repoTagToDockboxName(imageName),
+		Pause:     true,
+		// Labels of the dockbox image are kept by the daemon
+		Config: &container.Config{Labels: map[string]string{LABEL_SNAPSHOT: tag}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return snapshotName, nil
+}
+
+// snapshotImageName returns the image of the snapshot of a dockbox with the given tag
+func snapshotImageName(imageName string, tag string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", err
+	}
+	tagged, err := reference.WithTag(reference.TrimNamed(named), tag)
+	if err != nil {
+		return "", fmt.Errorf("invalid snapshot tag %q: must only contain letters, digits, '.', '_' and '-' and start with a letter, digit or '_'", tag)
+	}
+	return reference.FamiliarString(tagged), nil
+}
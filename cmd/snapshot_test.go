@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	dirPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml"), []byte("image: dockbox/app1\ncontainer: app1_ctr\n"), 0644))
+	emptyPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(emptyPath, HIDDEN_DIRECTORY), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(emptyPath, HIDDEN_DIRECTORY, ".dockbox.yaml"), []byte("image: dockbox/app1\n"), 0644))
+
+	testcases := []struct {
+		name          string
+		options       SnapshotOptions
+		expectedImage string
+		expectedError string
+	}{
+		{name: "DefaultTag", options: SnapshotOptions{path: dirPath, now: time.Unix(1626748159, 0)}, expectedImage: "dockbox/app1:snapshot-20210720-022919"},
+		{name: "Tag", options: SnapshotOptions{path: dirPath, tag: "with-tools"}, expectedImage: "dockbox/app1:with-tools"},
+		{name: "InvalidTag", options: SnapshotOptions{path: dirPath, tag: "with tools"}, expectedError: `invalid snapshot tag "with tools": must only contain letters, digits, '.', '_' and '-' and start with a letter, digit or '_'`},
+		{name: "NoContainer", options: SnapshotOptions{path: emptyPath}, expectedError: "this dockbox has no container to snapshot, run dockbox enter first"},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			var commits []types.ContainerCommitOptions
+			fakeDockerCli := &fakeDockerClient{
+				containerCommit: func(c context.Context, containerID string, options types.ContainerCommitOptions) (types.IDResponse, error) {
+					assert.Equal(t, "app1_ctr", containerID)
+					commits = append(commits, options)
+					return types.IDResponse{ID: "sha256:snapshot"}, nil
+				},
+			}
+			imageName, err := RunSnapshotCommand(fakeDockerCli, test.options)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				assert.Len(t, commits, 0)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedImage, imageName)
+			assert.Len(t, commits, 1)
+			assert.Equal(t, test.expectedImage, commits[0].Reference)
+			assert.Equal(t, imageName[len("dockbox/app1:"):], commits[0].Config.Labels[LABEL_SNAPSHOT])
+		})
+	}
+}
+
+// newSnapshotTestClient returns a clean test client in which app1 has a snapshot
+func newSnapshotTestClient(t *testing.T) *cleanTestClient {
+	labels := map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_NAME: "app1"}
+	snapshotLabels := map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1", LABEL_NAME: "app1", LABEL_SNAPSHOT: "snap1"}
+	snapshot := types.ImageSummary{ID: "sha256:app1snap", RepoTags: []string{"dockbox/app1:snap1"}, Created: 1626748400, Labels: snapshotLabels}
+	snapshotHistory := append([]image.HistoryResponseItem{
+		{ID: "sha256:app1snap", Created: 1626748400, Size: 5000000, Tags: []string{"dockbox/app1:snap1"}},
+	}, treeTestHistories["sha256:app1"]...)
+
+	cli := newCleanTestClient(t)
+	imageList, imageHistory, imageInspectWithRaw := cli.imageList, cli.imageHistory, cli.imageInspectWithRaw
+	cli.imageList = func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+		images, err := imageList(c, ilo)
+		for i := range images {
+			if images[i].ID == "sha256:app1" {
+				images[i].Labels = labels
+			}
+		}
+		return append(images, filterImagesByLabel([]types.ImageSummary{snapshot}, ilo)...), err
+	}
+	cli.imageHistory = func(c context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+		if imageID == snapshot.ID {
+			return snapshotHistory, nil
+		}
+		return imageHistory(c, imageID)
+	}
+	cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+		if imageID == snapshot.ID || imageID == "dockbox/app1:snap1" {
+			return types.ImageInspect{ID: snapshot.ID, RepoTags: snapshot.RepoTags}, nil, nil
+		}
+		info, raw, err := imageInspectWithRaw(c, imageID)
+		if err == nil && info.ID == "sha256:app1" {
+			info.Config.Labels = labels
+		}
+		return info, raw, err
+	}
+	return cli
+}
+
+func TestSnapshotInTree(t *testing.T) {
+	// Snapshots are not dockboxes of their own
+	forest, err := buildImageForest(context.Background(), newSnapshotTestClient(t), TreeOptions{})
+	assert.Nil(t, err)
+	_, ok := forest.IDToNode["sha256:app1snap"]
+	assert.False(t, ok)
+	dockboxImages, err := getDockboxImages(context.Background(), newSnapshotTestClient(t), ListOptions{})
+	assert.Nil(t, err)
+	for _, image := range dockboxImages {
+		assert.NotEqual(t, "sha256:app1snap", image.ID)
+	}
+
+	forest, err = buildImageForest(context.Background(), newSnapshotTestClient(t), TreeOptions{All: true})
+	assert.Nil(t, err)
+	snapshot, ok := forest.IDToNode["sha256:app1snap"]
+	assert.True(t, ok)
+	assert.Equal(t, "app1:snap1", snapshot.name)
+	assert.Equal(t, "app1", snapshot.parent.name)
+}
+
+func TestSnapshotInDiskUsage(t *testing.T) {
+	cli := newSnapshotTestClient(t)
+	cli.containerList = func(c context.Context, clo types.ContainerListOptions) ([]types.Container, error) {
+		return []types.Container{
+			{ID: "app1_ctr", ImageID: "sha256:app1", Image: "dockbox/app1", SizeRw: 1000000, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1"}},
+			{ID: "app1_snap_ctr", ImageID: "sha256:app1snap", Image: "dockbox/app1:snap1", SizeRw: 2000000, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1"}},
+		}, nil
+	}
+	report, err := getDiskUsage(context.Background(), cli, TreeOptions{})
+	assert.Nil(t, err)
+	found := false
+	for _, usage := range report.Dockboxes {
+		assert.NotEqual(t, "app1:snap1", usage.Name)
+		if usage.Name == "app1" {
+			found = true
+			// The layers of the snapshot and of app1 are only used by app1
+			assert.Equal(t, int64(6000000), usage.Unique)
+			assert.Equal(t, int64(3000000), usage.Containers)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestCleanIncludesSnapshots(t *testing.T) {
+	cli := newSnapshotTestClient(t)
+	targetIDs, _, err := selectCleanTargets(context.Background(), cli, CleanOptions{args: []string{"app1"}, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app1snap"}, targetIDs)
+
+	// Selectors only select dockboxes, along with their snapshots
+	targetIDs, _, err = selectCleanTargets(context.Background(), cli, CleanOptions{all: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app2", "sha256:flask", "sha256:app1snap"}, targetIDs)
+	targetIDs, _, err = selectCleanTargets(context.Background(), cli, CleanOptions{args: []string{"app1*"}, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app1snap"}, targetIDs)
+	imageList := cli.imageList
+	cli.imageList = func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+		images, err := imageList(c, ilo)
+		for i := range images {
+			if images[i].ID == "sha256:app1snap" {
+				images[i].Created = 1626000000
+			}
+		}
+		return images, err
+	}
+	targetIDs, _, err = selectCleanTargets(context.Background(), cli, CleanOptions{olderThan: "10d", now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app2", "sha256:flask"}, targetIDs)
+
+	// A snapshot can be cleaned on its own
+	targetIDs, _, err = selectCleanTargets(context.Background(), cli, CleanOptions{args: []string{"app1:snap1"}, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1snap"}, targetIDs)
+
+	_, _, err = selectCleanTargets(context.Background(), &fakeDockerClient{
+		imageList: func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+			return nil, errors.New("Cannot connect to the Docker daemon")
+		},
+	}, CleanOptions{args: []string{"app1"}})
+	assert.EqualError(t, err, "Cannot connect to the Docker daemon")
+}
+
+func TestEnterFromSnapshot(t *testing.T) {
+	dirPath := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml"), []byte("image: dockbox/app1\ncontainer: app1_ctr\n"), 0644))
+
+	var created, removed []string
+	fakeDockerCli := &fakeDockerClient{
+		imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+			assert.Equal(t, "dockbox/app1:snap1", imageID)
+			return types.ImageInspect{ID: "sha256:app1snap"}, nil, nil
+		},
+		containerCreate: func(c context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+			assert.Equal(t, "dockbox/app1:snap1", config.Image)
+			created = append(created, fmt.Sprintf("app1_snap_ctr%d", len(created)+1))
+			return container.ContainerCreateCreatedBody{ID: created[len(created)-1]}, nil
+		},
+		containerRemove: func(c context.Context, containerID string, options types.ContainerRemoveOptions) error {
+			removed = append(removed, containerID)
+			return nil
+		},
+		containerAttach: func(c context.Context, containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+			return types.HijackedResponse{}, errors.New("cannot attach in tests")
+		},
+	}
+	// Each new container of the snapshot replaces the previous one
+	for i := 0; i < 2; i++ {
+		err := RunEnterCommand(fakeDockerCli, EnterOptions{path: dirPath, fromSnapshot: "snap1"})
+		assert.EqualError(t, err, "cannot attach in tests")
+	}
+	assert.Equal(t, []string{"app1_snap_ctr1", "app1_snap_ctr2"}, created)
+	assert.Equal(t, []string{"app1_ctr", "app1_snap_ctr1"}, removed)
+	assert.Equal(t, "app1_snap_ctr2", readTestConfig(t, dirPath).GetString("container"))
+}
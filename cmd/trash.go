@@ -0,0 +1,408 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	units "github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+// How long dockboxes are kept in the trash by default
+const DEFAULT_TRASH_RETENTION = "30d"
+
+// trashCmd represents the trash command
+func NewTrashCommand(cli dockerClient) *cobra.Command {
+	var trashOptions = TrashOptions{}
+	var trashCmd = &cobra.Command{
+		Use:   "trash",
+		Short: "Lists, restores or empties cleaned dockboxes kept in the trash",
+		Long: `Dockboxes cleaned with clean --trash are saved to the trash before being
+	removed, and can be restored until they expire. How long they are kept is set
+	when they are cleaned, with clean --trash-retention.`,
+	}
+
+	trashCmd.AddCommand(
+		&cobra.Command{
+			Use:   "list",
+			Short: "Lists the dockboxes in the trash",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				res, err := RunTrashListCommand(trashOptions)
+				CheckError(err)
+				fmt.Print(res)
+			},
+		},
+		&cobra.Command{
+			Use:   "restore <name>...",
+			Short: "Restores dockboxes from the trash",
+			Args:  cobra.MinimumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				trashOptions.names = args
+				CheckError(RunTrashRestoreCommand(cli, trashOptions))
+			},
+		},
+		&cobra.Command{
+			Use:   "empty [<name>...]",
+			Short: "Permanently deletes dockboxes from the trash, or all of them if none are given",
+			Run: func(cmd *cobra.Command, args []string) {
+				trashOptions.names = args
+				CheckError(RunTrashEmptyCommand(trashOptions))
+			},
+		},
+	)
+	return trashCmd
+}
+
+// defaultTrashDir returns the directory in which trashed dockboxes are saved,
+// following the XDG base directory specification
+func defaultTrashDir() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, PREFIX, "trash"), nil
+}
+
+// openTrash returns the trash directory of trashOptions, removing expired entries from it
+func openTrash(trashOptions TrashOptions) (string, error) {
+	dir := trashOptions.dir
+	if dir == "" {
+		var err error
+		dir, err = defaultTrashDir()
+		if err != nil {
+			return "", err
+		}
+	}
+	if trashOptions.now.IsZero() {
+		trashOptions.now = time.Now()
+	}
+
+	entries, err := readTrash(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if trashOptions.now.After(entry.expiresAt()) {
+			log.Printf("Removing expired dockbox %s from the trash", entry.Name)
+			if err := removeTrashEntry(dir, entry.Name); err != nil {
+				return "", err
+			}
+		}
+	}
+	return dir, nil
+}
+
+func trashRetention(trashOptions TrashOptions) (time.Duration, error) {
+	if trashOptions.retention == "" {
+		return parseAge(DEFAULT_TRASH_RETENTION)
+	}
+	return parseAge(trashOptions.retention)
+}
+
+// expiresAt returns when the entry expires. Entries saved before their expiry
+// was recorded are kept for the default retention.
+func (entry trashEntry) expiresAt() time.Time {
+	if entry.ExpiresAt.IsZero() {
+		retention, _ := parseAge(DEFAULT_TRASH_RETENTION)
+		return entry.DeletedAt.Add(retention)
+	}
+	return entry.ExpiresAt
+}
+
+// trashFileName returns the name of the files of a trash entry, without extension.
+// Names are escaped rather than replaced, so that entries never share files,
+// and without characters that some systems do not allow in file names.
+func trashFileName(name string) string {
+	return url.QueryEscape(name)
+}
+
+func readTrash(dir string) ([]trashEntry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]trashEntry, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var entry trashEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("Warning: Ignoring invalid trash entry %s: %s", file, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+func findTrashEntry(dir string, name string) (trashEntry, error) {
+	var entry trashEntry
+	data, err := ioutil.ReadFile(filepath.Join(dir, trashFileName(name)+".json"))
+	if os.IsNotExist(err) {
+		return entry, fmt.Errorf("no dockbox named %s in the trash", name)
+	}
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, err
+	}
+	if entry.Name != name {
+		return entry, fmt.Errorf("no dockbox named %s in the trash", name)
+	}
+	return entry, nil
+}
+
+func removeTrashEntry(dir string, name string) error {
+	for _, ext := range []string{".tar", ".json"} {
+		if err := os.Remove(filepath.Join(dir, trashFileName(name)+ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashDockbox saves the image of a dockbox to the trash along with its metadata,
+// including the .dockbox directory of its folder at dirPath if it has one, to
+// be kept for the given retention
+func trashDockbox(ctx context.Context, cli dockerClient, dir string, node *ImageNode, dirPath string, now time.Time, retention time.Duration) error {
+	info, _, err := cli.ImageInspectWithRaw(ctx, node.ID)
+	if err != nil {
+		return err
+	}
+	entry := trashEntry{
+		Name:      node.displayName(),
+		Image:     info.ID,
+		RepoTags:  info.RepoTags,
+		Path:      dirPath,
+		DeletedAt: now.UTC(),
+		ExpiresAt: now.Add(retention).UTC(),
+	}
+	if info.Config != nil {
+		entry.Source = info.Config.Labels[LABEL_SOURCE]
+		if entry.Path == "" {
+			entry.Path = info.Config.Labels[LABEL_PATH]
+		}
+	}
+	if dirPath != "" {
+		if entry.Metadata, err = readDockboxMetadata(dirPath); err != nil {
+			return err
+		}
+	}
+	// Saving by tag keeps the tags in the archive, unlike saving by ID
+	refs := info.RepoTags
+	if len(refs) == 0 {
+		refs = []string{info.ID}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	body, err := cli.ImageSave(ctx, refs)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tarPath := filepath.Join(dir, trashFileName(entry.Name)+".tar")
+	tmp, err := ioutil.TempFile(dir, ".trash-")
+	if err != nil {
+		return err
+	}
+	entry.Size, err = io.Copy(tmp, body)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), tarPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save %s to the trash: %s", entry.Name, err)
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, trashFileName(entry.Name)+".json"), data, 0644); err != nil {
+		return err
+	}
+	log.Printf("Saved %s to the trash at %s", entry.Name, tarPath)
+	return nil
+}
+
+// readDockboxMetadata returns the files of the .dockbox directory of the dockbox at dirPath
+func readDockboxMetadata(dirPath string) (map[string][]byte, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dirPath, HIDDEN_DIRECTORY))
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string][]byte, len(files))
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dirPath, HIDDEN_DIRECTORY, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		metadata[file.Name()] = data
+	}
+	return metadata, nil
+}
+
+// restoreDockboxMetadata writes the .dockbox directory of a trashed dockbox back
+// to its folder, unless the folder was removed or holds a dockbox again
+func restoreDockboxMetadata(entry trashEntry) (bool, error) {
+	if entry.Path == "" || len(entry.Metadata) == 0 {
+		return false, nil
+	}
+	if exists, _, _ := pathExists(entry.Path); !exists {
+		return false, nil
+	}
+	metadataDir := filepath.Join(entry.Path, HIDDEN_DIRECTORY)
+	if exists, _, _ := pathExists(metadataDir); exists {
+		return false, nil
+	}
+	if err := os.Mkdir(metadataDir, 0755); err != nil {
+		return false, err
+	}
+	for name, data := range entry.Metadata {
+		if err := ioutil.WriteFile(filepath.Join(metadataDir, filepath.Base(name)), data, 0644); err != nil {
+			return false, err
+		}
+	}
+	// The container of the dockbox was removed along with it
+	return true, writeConfig(entry.Path, map[string]string{"container": ""})
+}
+
+func RunTrashListCommand(trashOptions TrashOptions) (string, error) {
+	dir, err := openTrash(trashOptions)
+	if err != nil {
+		return "", err
+	}
+	entries, err := readTrash(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "The trash is empty\n", nil
+	}
+	now := trashOptions.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var buf bytes.Buffer
+	tabWriter := tabwriter.NewWriter(&buf, 1, 1, 2, ' ', 0)
+	fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\n", "NAME", "SIZE", "DELETED", "EXPIRES", "SOURCE")
+	for _, entry := range entries {
+		deleted := units.HumanDuration(now.Sub(entry.DeletedAt)) + " ago"
+		expires := "in " + units.HumanDuration(entry.expiresAt().Sub(now))
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\n", entry.Name, humanSize(entry.Size), deleted, expires, entry.Source)
+	}
+	tabWriter.Flush()
+	return buf.String(), nil
+}
+
+func RunTrashRestoreCommand(cli dockerClient, trashOptions TrashOptions) error {
+	ctx := context.Background()
+	dir, err := openTrash(trashOptions)
+	if err != nil {
+		return err
+	}
+	for _, name := range trashOptions.names {
+		entry, err := findTrashEntry(dir, name)
+		if err != nil {
+			return err
+		}
+		for _, tag := range entry.RepoTags {
+			if info, _, err := cli.ImageInspectWithRaw(ctx, tag); err == nil && info.ID != entry.Image {
+				return fmt.Errorf("cannot restore %s: the image %s already exists", entry.Name, tag)
+			}
+		}
+
+		archive, err := os.Open(filepath.Join(dir, trashFileName(entry.Name)+".tar"))
+		if err != nil {
+			return err
+		}
+		res, err := cli.ImageLoad(ctx, archive, true)
+		if err != nil {
+			archive.Close()
+			return err
+		}
+		err = jsonmessage.DisplayJSONMessagesStream(res.Body, ioutil.Discard, 0, false, nil)
+		res.Body.Close()
+		archive.Close()
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %s", entry.Name, err)
+		}
+
+		restored, err := restoreDockboxMetadata(entry)
+		if err != nil {
+			return fmt.Errorf("failed to restore the folder of %s: %s", entry.Name, err)
+		}
+		if err := removeTrashEntry(dir, entry.Name); err != nil {
+			return err
+		}
+		fmt.Println("Successfully restored dockbox: " + entry.Name)
+		if restored {
+			fmt.Printf("Restored the dockbox metadata of %s, run dockbox enter %s to start it\n", entry.Path, entry.Path)
+		} else if exists, _, _ := pathExists(entry.Path); entry.Path != "" && !exists {
+			fmt.Printf("The folder of %s was removed, run dockbox create %s to get it back\n", entry.Name, entry.Source)
+		}
+	}
+	return nil
+}
+
+func RunTrashEmptyCommand(trashOptions TrashOptions) error {
+	dir, err := openTrash(trashOptions)
+	if err != nil {
+		return err
+	}
+	names := trashOptions.names
+	if len(names) == 0 {
+		entries, err := readTrash(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("The trash is empty")
+		return nil
+	}
+	for _, name := range names {
+		if _, err := findTrashEntry(dir, name); err != nil {
+			return err
+		}
+		if err := removeTrashEntry(dir, name); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Permanently deleted %d dockbox(es) from the trash\n", len(names))
+	return nil
+}
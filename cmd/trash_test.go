@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTrashTestClient returns a clean test client that saves images as archives
+// holding their references, and records the archives it loads
+func newTrashTestClient(t *testing.T, loaded *[]string) *cleanTestClient {
+	cli := newCleanTestClient(t)
+	cli.imageSave = func(c context.Context, imageIDs []string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("archive of " + strings.Join(imageIDs, ","))), nil
+	}
+	cli.imageLoad = func(c context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+		data, err := ioutil.ReadAll(input)
+		assert.Nil(t, err)
+		*loaded = append(*loaded, string(data))
+		return types.ImageLoadResponse{Body: ioutil.NopCloser(strings.NewReader(`{"stream":"Loaded image: dockbox/app1:latest\n"}`))}, nil
+	}
+	return cli
+}
+
+func TestTrashCleanAndRestore(t *testing.T) {
+	var loaded []string
+	cli := newTrashTestClient(t, &loaded)
+	trashOptions := TrashOptions{dir: t.TempDir(), now: cleanTestNow.Add(2 * 24 * time.Hour)}
+
+	err := RunCleanCommand(cli, CleanOptions{args: []string{"app*"}, useTrash: true, trash: trashOptions, yes: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:app1", "sha256:app2", "sha256:setup"}, cli.removedImages)
+	for _, file := range []string{"app1.tar", "app1.json", "app2.tar", "app2.json"} {
+		exists, _, _ := pathExists(filepath.Join(trashOptions.dir, file))
+		assert.True(t, exists, file)
+	}
+
+	// Dockboxes already in the trash are never replaced
+	err = RunCleanCommand(cli, CleanOptions{args: []string{"app1"}, useTrash: true, trash: trashOptions, yes: true, now: cleanTestNow})
+	assert.EqualError(t, err, "the trash already holds a dockbox named app1, restore it or run dockbox trash empty app1 first")
+
+	actual, err := RunTrashListCommand(trashOptions)
+	assert.Nil(t, err)
+	assert.EqualValues(t, goldenValue(t, "trash/TrashList", actual, *update), actual)
+
+	trashOptions.names = []string{"app1"}
+	assert.Nil(t, RunTrashRestoreCommand(cli, trashOptions))
+	assert.Equal(t, []string{"archive of dockbox/app1:latest"}, loaded)
+	entries, err := readTrash(trashOptions.dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "app2", entries[0].Name)
+
+	assert.EqualError(t, RunTrashRestoreCommand(cli, trashOptions), "no dockbox named app1 in the trash")
+}
+
+func TestTrashExpiry(t *testing.T) {
+	var loaded []string
+	cli := newTrashTestClient(t, &loaded)
+	dir := t.TempDir()
+	forest, err := buildImageForest(context.Background(), cli, TreeOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, trashDockbox(context.Background(), cli, dir, forest.IDToNode["sha256:app1"], "", cleanTestNow, 24*time.Hour))
+	assert.Nil(t, trashDockbox(context.Background(), cli, dir, forest.IDToNode["sha256:flask"], "", cleanTestNow.Add(-48*time.Hour), 24*time.Hour))
+	// Each dockbox is kept for the retention it was cleaned with
+	assert.Nil(t, trashDockbox(context.Background(), cli, dir, forest.IDToNode["sha256:app2"], "", cleanTestNow.Add(-48*time.Hour), 30*24*time.Hour))
+
+	_, err = openTrash(TrashOptions{dir: dir, now: cleanTestNow.Add(12 * time.Hour)})
+	assert.Nil(t, err)
+	entries, err := readTrash(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "app1", entries[0].Name)
+	assert.Equal(t, "app2", entries[1].Name)
+	exists, _, _ := pathExists(filepath.Join(dir, "flask.tar"))
+	assert.False(t, exists)
+
+	err = RunCleanCommand(cli, CleanOptions{args: []string{"flask"}, useTrash: true, trash: TrashOptions{dir: dir, retention: "forever"}, yes: true, now: cleanTestNow})
+	assert.EqualError(t, err, `invalid duration "forever"`)
+}
+
+func TestTrashEmpty(t *testing.T) {
+	var loaded []string
+	cli := newTrashTestClient(t, &loaded)
+	dir := t.TempDir()
+	forest, err := buildImageForest(context.Background(), cli, TreeOptions{})
+	assert.Nil(t, err)
+	for _, imageID := range []string{"sha256:app1", "sha256:app2", "sha256:flask"} {
+		assert.Nil(t, trashDockbox(context.Background(), cli, dir, forest.IDToNode[imageID], "", cleanTestNow, 24*time.Hour))
+	}
+	trashOptions := TrashOptions{dir: dir, now: cleanTestNow}
+
+	trashOptions.names = []string{"missing"}
+	assert.EqualError(t, RunTrashEmptyCommand(trashOptions), "no dockbox named missing in the trash")
+
+	trashOptions.names = []string{"app2"}
+	assert.Nil(t, RunTrashEmptyCommand(trashOptions))
+	entries, err := readTrash(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	trashOptions.names = nil
+	assert.Nil(t, RunTrashEmptyCommand(trashOptions))
+	entries, err = readTrash(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestTrashFileNames(t *testing.T) {
+	var loaded []string
+	cli := newTrashTestClient(t, &loaded)
+	dir := t.TempDir()
+	forest, err := buildImageForest(context.Background(), cli, TreeOptions{})
+	assert.Nil(t, err)
+	// Names only differing by characters that cannot be used in file names
+	snapshot, other := *forest.IDToNode["sha256:app1"], *forest.IDToNode["sha256:app2"]
+	snapshot.name, other.name = "app1:snap", "app1_snap"
+	assert.Nil(t, trashDockbox(context.Background(), cli, dir, &snapshot, "", cleanTestNow, 24*time.Hour))
+	assert.Nil(t, trashDockbox(context.Background(), cli, dir, &other, "", cleanTestNow, 24*time.Hour))
+
+	entries, err := readTrash(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	entry, err := findTrashEntry(dir, "app1:snap")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:app1", entry.Image)
+	entry, err = findTrashEntry(dir, "app1_snap")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:app2", entry.Image)
+}
+
+func TestTrashRestoresMetadata(t *testing.T) {
+	var loaded []string
+	cli := newTrashTestClient(t, &loaded)
+	dirPath := newDockboxFolder(t, "dockbox/app1", false)
+	assert.Nil(t, setConfigKey("container", "app1_ctr", dirPath))
+	imageInspectWithRaw := cli.imageInspectWithRaw
+	cli.imageInspectWithRaw = func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+		info, raw, err := imageInspectWithRaw(c, imageID)
+		if err == nil && info.ID == "sha256:app1" {
+			info.Config.Labels = map[string]string{LABEL_SOURCE: dirPath, LABEL_PATH: dirPath}
+		}
+		return info, raw, err
+	}
+	trashOptions := TrashOptions{dir: t.TempDir(), now: cleanTestNow}
+
+	// Only the metadata of a dockbox created from a local folder is removed
+	err := RunCleanCommand(cli, CleanOptions{args: []string{"app1"}, useTrash: true, trash: trashOptions, yes: true, now: cleanTestNow})
+	assert.Nil(t, err)
+	exists, _, _ := pathExists(filepath.Join(dirPath, HIDDEN_DIRECTORY))
+	assert.False(t, exists)
+
+	trashOptions.names = []string{"app1"}
+	assert.Nil(t, RunTrashRestoreCommand(cli, trashOptions))
+	config := readTestConfig(t, dirPath)
+	assert.Equal(t, "dockbox/app1", config.GetString("image"))
+	assert.Equal(t, "", config.GetString("container"))
+}
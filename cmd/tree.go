@@ -19,9 +19,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	units "github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
@@ -29,32 +32,133 @@ import (
 func NewTreeCommand(cli dockerClient) *cobra.Command {
 	var treeOptions = TreeOptions{}
 	var treeCmd = &cobra.Command{
-		Use:   "tree [OPTS]",
+		Use:   "tree [OPTS] [<name|path>]",
 		Short: "Shows a tree of dockbox image histories",
-		Long:  `A command to visualize the tree structure of the dependencies of your image`,
-		Args:  cobra.ExactArgs(0),
+		Long: `A command to visualize the tree structure of the dependencies of your image.
+	Given the name or path of a dockbox, only the images it is built from and the
+	images built from it are shown.`,
+		Args: cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			CheckError(RunTreeCommand(cli, treeOptions))
+			if len(args) > 0 {
+				treeOptions.Target = args[0]
+			}
+			res, err := RunTreeCommand(cli, treeOptions)
+			CheckError(err)
+			fmt.Print(res)
 		},
 	}
 	treeCmd.PersistentFlags().BoolVarP(&treeOptions.All, "all", "a", false, "Use all images on system (not just dockboxes)")
+	treeCmd.PersistentFlags().StringVar(&treeOptions.Sort, "sort", SORT_BY_NAME, "Order of sibling images: name, created (oldest first) or size (largest first)")
+	treeCmd.PersistentFlags().BoolVarP(&treeOptions.ShowSize, "size", "s", false, "Show the size of each layer and the cumulative size of each image")
+	treeCmd.PersistentFlags().BoolVar(&treeOptions.ShowAge, "age", false, "Show how long ago each image was created")
+	treeCmd.PersistentFlags().IntVarP(&treeOptions.Depth, "depth", "d", 0, "Maximum number of levels to show (0 for no limit)")
+	treeCmd.PersistentFlags().BoolVar(&treeOptions.Ancestors, "ancestors", false, "Only show the images the given dockbox is built from")
+	treeCmd.PersistentFlags().BoolVar(&treeOptions.Descendants, "descendants", false, "Only show the given dockbox and the images built from it")
+	treeCmd.PersistentFlags().StringVarP(&treeOptions.Format, "format", "f", FORMAT_TREE, "Output format: tree, dot (Graphviz) or mermaid")
+	addHistoryFlags(treeCmd, &treeOptions)
 
 	return treeCmd
 }
 
-func RunTreeCommand(cli dockerClient, treeOptions TreeOptions) error {
+func RunTreeCommand(cli dockerClient, treeOptions TreeOptions) (string, error) {
+	if treeOptions.Sort != SORT_BY_NAME && treeOptions.Sort != SORT_BY_CREATED && treeOptions.Sort != SORT_BY_SIZE {
+		return "", fmt.Errorf("invalid sort order %q: must be one of name, created or size", treeOptions.Sort)
+	}
+	if treeOptions.Format != FORMAT_TREE && treeOptions.Format != FORMAT_DOT && treeOptions.Format != FORMAT_MERMAID {
+		return "", fmt.Errorf("invalid format %q: must be one of tree, dot or mermaid", treeOptions.Format)
+	}
 	ctx := context.Background()
 	forest, err := buildImageForest(ctx, cli, treeOptions)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if len(forest.roots) == 0 {
-		fmt.Println("No images found")
+	if len(forest.roots) == 0 && treeOptions.Format == FORMAT_TREE {
+		return "No images found\n", nil
+	}
+
+	printOptions := ForestPrintOptions{
+		sortBy:   treeOptions.Sort,
+		showSize: treeOptions.ShowSize,
+		showAge:  treeOptions.ShowAge,
+		maxDepth: treeOptions.Depth,
+	}
+	roots := forest.roots
+	if treeOptions.Target != "" {
+		target, err := findTargetNode(ctx, cli, forest, treeOptions.Target)
+		if err != nil {
+			return "", err
+		}
+		var root *ImageNode
+		root, printOptions = targetView(target, treeOptions, printOptions)
+		roots = []*ImageNode{root}
 	}
 
-	forest.PrintForest(ForestPrintOptions{})
-	return nil
+	switch treeOptions.Format {
+	case FORMAT_DOT:
+		return dotString(roots, printOptions), nil
+	case FORMAT_MERMAID:
+		return mermaidString(roots, printOptions), nil
+	}
+	builder := &strings.Builder{}
+	for _, tree := range sortNodes(roots, printOptions.sortBy) {
+		builder.WriteString(tree.TreeString(printOptions))
+	}
+	return builder.String(), nil
+}
+
+// findTargetNode returns the node of the dockbox with the given name or path
+func findTargetNode(ctx context.Context, cli dockerClient, forest *ImageForest, nameOrPath string) (*ImageNode, error) {
+	imageName, err := getImageNameFromArg(nameOrPath)
+	if err != nil {
+		return nil, err
+	}
+	info, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := forest.IDToNode[info.ID]
+	if !ok {
+		return nil, fmt.Errorf("could not find %s in the image tree", imageName)
+	}
+	return node, nil
+}
+
+// targetView returns the node to start printing from and the options needed to
+// show only the ancestry chain and/or the descendants of target, highlighting
+// the target itself
+func targetView(target *ImageNode, treeOptions TreeOptions, printOptions ForestPrintOptions) (*ImageNode, ForestPrintOptions) {
+	showAncestors := treeOptions.Ancestors || !treeOptions.Descendants
+	showDescendants := treeOptions.Descendants || !treeOptions.Ancestors
+
+	printOptions.colorIDS = map[string]string{target.ID: "\033[32;1m"}
+	printOptions.textColorCurNodeOnly = true
+	printOptions.visibleIDs = map[string]bool{}
+	if showDescendants {
+		target.visit(func(node *ImageNode) {
+			printOptions.visibleIDs[node.ID] = true
+		})
+	} else {
+		printOptions.visibleIDs[target.ID] = true
+	}
+	if !showAncestors {
+		return target, printOptions
+	}
+
+	root := target
+	for root.parent != nil {
+		root = root.parent
+		printOptions.visibleIDs[root.ID] = true
+	}
+	return root, printOptions
+}
+
+// visit calls f on node and all of its descendants
+func (node *ImageNode) visit(f func(*ImageNode)) {
+	f(node)
+	for _, child := range node.children {
+		child.visit(f)
+	}
 }
 
 func buildImageForest(ctx context.Context, cli dockerClient, treeOptions TreeOptions) (*ImageForest, error) {
@@ -73,6 +177,36 @@ func buildImageForest(ctx context.Context, cli dockerClient, treeOptions TreeOpt
 		}
 	}
 
+	cacheDir, err := historyCacheDir(treeOptions)
+	if err != nil {
+		return nil, err
+	}
+	jobs := treeOptions.Jobs
+	if jobs < 1 {
+		jobs = DEFAULT_HISTORY_JOBS
+	}
+	histories, err := newHistoryLookup(cli, cacheDir).fetchAll(ctx, dockboxImages, jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cached histories have no tags, so intermediate images are named from the
+	// tags they currently have
+	var tagsByID map[string][]string
+	if cacheDir != "" {
+		taggedImages := dockboxImages
+		if !treeOptions.All {
+			taggedImages, err = cli.ImageList(ctx, types.ImageListOptions{All: false})
+			if err != nil {
+				return nil, err
+			}
+		}
+		tagsByID = make(map[string][]string, len(taggedImages))
+		for _, image := range taggedImages {
+			tagsByID[image.ID] = image.RepoTags
+		}
+	}
+
 	leafList := make([]*ImageNode, len(dockboxImages))
 	rootList := make([]*ImageNode, 0)
 
@@ -86,24 +220,35 @@ func buildImageForest(ctx context.Context, cli dockerClient, treeOptions TreeOpt
 		} else {
 			name = image.ID
 		}
-		leafList[i] = &ImageNode{
-			name:     name,
-			ID:       image.ID,
-			children: make(map[string]*ImageNode),
-		}
-		IDtoImageNode[image.ID] = leafList[i]
-		// log.Printf("Finding Image History for : %s %v \n", image.ID, image.RepoTags)
-		hist, err := cli.ImageHistory(ctx, image.ID)
-		if err != nil {
-			return nil, err
+		// The image may already be in the forest as the parent of another image
+		if node, ok := IDtoImageNode[image.ID]; ok {
+			node.name = name
+			leafList[i] = node
+		} else {
+			leafList[i] = &ImageNode{
+				name:     name,
+				ID:       image.ID,
+				children: make(map[string]*ImageNode),
+			}
+			IDtoImageNode[image.ID] = leafList[i]
 		}
+		hist := histories[image.ID]
 		childNode := leafList[i]
+		// The size of a root already includes its missing layers
+		if len(hist) > 0 && !inRootList[childNode.ID] {
+			childNode.created = hist[0].Created
+			childNode.size = hist[0].Size
+		}
 		for i, item := range hist {
 			if i == 0 {
 				continue
 			}
 			if item.ID == "<missing>" {
 				if !inRootList[childNode.ID] {
+					// Layers without an ID belong to the image above them
+					for _, missing := range hist[i:] {
+						childNode.size += missing.Size
+					}
 					rootList = append(rootList, childNode)
 				}
 				inRootList[childNode.ID] = true
@@ -114,15 +259,26 @@ func buildImageForest(ctx context.Context, cli dockerClient, treeOptions TreeOpt
 					name:     "",
 					ID:       item.ID,
 					children: make(map[string]*ImageNode),
+					created:  item.Created,
+					size:     item.Size,
+				}
+				tags := item.Tags
+				if tagsByID != nil {
+					tags = tagsByID[item.ID]
 				}
-				if len(item.Tags) > 0 {
-					IDtoImageNode[item.ID].name = repoTagToDockboxName(item.Tags[0])
+				if len(tags) > 0 {
+					IDtoImageNode[item.ID].name = repoTagToDockboxName(tags[0])
 				}
 			}
 			IDtoImageNode[item.ID].children[childNode.ID] = childNode
 			childNode.parent = IDtoImageNode[item.ID]
 			childNode = IDtoImageNode[item.ID]
 		}
+		if childNode.parent == nil && !inRootList[childNode.ID] {
+			// Base image built locally, so its history has no missing layers
+			rootList = append(rootList, childNode)
+			inRootList[childNode.ID] = true
+		}
 	}
 
 	rootNames := make([]string, len(rootList))
@@ -138,15 +294,88 @@ func buildImageForest(ctx context.Context, cli dockerClient, treeOptions TreeOpt
 	}, nil
 }
 
-// Adapted from https://stackoverflow.com/questions/4965335/how-to-print-binary-tree-diagram-in-java
-func (node *ImageNode) print(sb *strings.Builder, prefix string, childrenPrefix string, printOptions ForestPrintOptions) {
-	sb.WriteString(prefix)
-	var item string
+// taggedUsers returns, for each node, the IDs of the listed images built from
+// it, including the image of the node itself if it was listed
+func (forest *ImageForest) taggedUsers() map[*ImageNode]map[string]bool {
+	users := make(map[*ImageNode]map[string]bool)
+	for _, leaf := range forest.leaves {
+		for node := leaf; node != nil; node = node.parent {
+			if users[node] == nil {
+				users[node] = make(map[string]bool)
+			}
+			users[node][leaf.ID] = true
+		}
+	}
+	return users
+}
+
+func (node *ImageNode) displayName() string {
 	if node.name == "" {
-		item = node.ID
-	} else {
-		item = node.name
+		return node.ID
+	}
+	return node.name
+}
+
+// sortNodes orders sibling nodes so that trees are always printed the same way
+func sortNodes(nodes []*ImageNode, sortBy string) []*ImageNode {
+	sorted := make([]*ImageNode, len(nodes))
+	copy(sorted, nodes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		switch sortBy {
+		case SORT_BY_CREATED:
+			if a.created != b.created {
+				return a.created < b.created
+			}
+		case SORT_BY_SIZE:
+			if a.size != b.size {
+				return a.size > b.size
+			}
+		}
+		if a.displayName() != b.displayName() {
+			return a.displayName() < b.displayName()
+		}
+		return a.ID < b.ID
+	})
+	return sorted
+}
+
+// visibleChildren returns the children of node to print, in order
+func (node *ImageNode) visibleChildren(printOptions ForestPrintOptions) []*ImageNode {
+	children := make([]*ImageNode, 0, len(node.children))
+	for _, child := range node.children {
+		if printOptions.visibleIDs == nil || printOptions.visibleIDs[child.ID] {
+			children = append(children, child)
+		}
 	}
+	return sortNodes(children, printOptions.sortBy)
+}
+
+// columns returns the extra information shown next to a node
+func (node *ImageNode) columns(totalSize int64, printOptions ForestPrintOptions) string {
+	columns := make([]string, 0)
+	if printOptions.showSize {
+		columns = append(columns, fmt.Sprintf("layer: %s", units.HumanSize(float64(node.size))))
+		columns = append(columns, fmt.Sprintf("total: %s", units.HumanSize(float64(totalSize))))
+	}
+	if printOptions.showAge && node.created > 0 {
+		now := printOptions.now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		columns = append(columns, units.HumanDuration(now.Sub(time.Unix(node.created, 0)))+" ago")
+	}
+	if len(columns) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(columns, ", ") + ")"
+}
+
+// Adapted from https://stackoverflow.com/questions/4965335/how-to-print-binary-tree-diagram-in-java
+func (node *ImageNode) print(sb *strings.Builder, prefix string, childrenPrefix string, depth int, parentSize int64, printOptions ForestPrintOptions) {
+	sb.WriteString(prefix)
+	totalSize := parentSize + node.size
+	item := node.displayName() + node.columns(totalSize, printOptions)
 	var textColour string
 	if val, ok := printOptions.colorIDS[node.ID]; ok {
 		textColour = val
@@ -162,30 +391,46 @@ func (node *ImageNode) print(sb *strings.Builder, prefix string, childrenPrefix
 	sb.WriteString(item)
 
 	sb.WriteString("\n")
-	i := 0
-	for _, child := range node.children {
-		if i < len(node.children)-1 {
-			child.print(sb, childrenPrefix+"├── ", childrenPrefix+textColour+"│   "+printOptions.textColor, printOptions)
+	if printOptions.maxDepth > 0 && depth >= printOptions.maxDepth {
+		return
+	}
+	children := node.visibleChildren(printOptions)
+	for i, child := range children {
+		if i < len(children)-1 {
+			child.print(sb, childrenPrefix+"├── ", childrenPrefix+textColour+"│   "+printOptions.textColor, depth+1, totalSize, printOptions)
 		} else {
-			child.print(sb, childrenPrefix+textColour+"└── "+printOptions.textColor, childrenPrefix+"    ", printOptions)
+			child.print(sb, childrenPrefix+textColour+"└── "+printOptions.textColor, childrenPrefix+"    ", depth+1, totalSize, printOptions)
 		}
-		i++
 	}
 }
 
-func (node *ImageNode) PrintTree(printOptions ForestPrintOptions) {
+func (node *ImageNode) TreeString(printOptions ForestPrintOptions) string {
 	builder := &strings.Builder{}
 	if printOptions.textColor == "" {
 		printOptions.textColor = "\033[0m"
 	}
-	node.print(builder, "", "", printOptions)
-	fmt.Print(builder.String())
+	var parentSize int64 = 0
+	for parent := node.parent; parent != nil; parent = parent.parent {
+		parentSize += parent.size
+	}
+	node.print(builder, "", "", 1, parentSize, printOptions)
 	// reset colour
-	fmt.Print("\033[0m")
+	builder.WriteString("\033[0m")
+	return builder.String()
 }
 
-func (forest *ImageForest) PrintForest(printOptions ForestPrintOptions) {
-	for _, tree := range forest.roots {
-		tree.PrintTree(printOptions)
+func (node *ImageNode) PrintTree(printOptions ForestPrintOptions) {
+	fmt.Print(node.TreeString(printOptions))
+}
+
+func (forest *ImageForest) ForestString(printOptions ForestPrintOptions) string {
+	builder := &strings.Builder{}
+	for _, tree := range sortNodes(forest.roots, printOptions.sortBy) {
+		builder.WriteString(tree.TreeString(printOptions))
 	}
+	return builder.String()
+}
+
+func (forest *ImageForest) PrintForest(printOptions ForestPrintOptions) {
+	fmt.Print(forest.ForestString(printOptions))
 }
@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/stretchr/testify/assert"
+)
+
+// Two dockboxes built on ubuntu:18.04 sharing a setup layer, and one built on python:3.8
+var treeTestImages = []types.ImageSummary{
+	{ID: "sha256:app1", RepoTags: []string{"dockbox/app1:latest"}, Created: 1626748300, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app1"}},
+	{ID: "sha256:app2", RepoTags: []string{"dockbox/app2:latest"}, Created: 1626748100, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/app2"}},
+	{ID: "sha256:flask", RepoTags: []string{"dockbox/flask:latest"}, Created: 1626748159, Labels: map[string]string{LABEL_SOURCE: "https://github.com/dockboxhq/flask"}},
+	{ID: "sha256:ubuntu", RepoTags: []string{"ubuntu:18.04"}},
+	{ID: "sha256:python", RepoTags: []string{"python:3.8"}},
+}
+
+var treeTestHistories = map[string][]image.HistoryResponseItem{
+	"sha256:app1": {
+		{ID: "sha256:app1", Created: 1626748300, Size: 1000000, Tags: []string{"dockbox/app1:latest"}},
+		{ID: "sha256:setup", Created: 1626748200, Size: 150000000},
+		{ID: "sha256:ubuntu", Created: 1626000000, Size: 0, Tags: []string{"ubuntu:18.04"}},
+		{ID: "<missing>", Created: 1626000000, Size: 63000000},
+	},
+	"sha256:app2": {
+		{ID: "sha256:app2", Created: 1626748100, Size: 25000000, Tags: []string{"dockbox/app2:latest"}},
+		{ID: "sha256:setup", Created: 1626748200, Size: 150000000},
+		{ID: "sha256:ubuntu", Created: 1626000000, Size: 0, Tags: []string{"ubuntu:18.04"}},
+		{ID: "<missing>", Created: 1626000000, Size: 63000000},
+	},
+	"sha256:flask": {
+		{ID: "sha256:flask", Created: 1626748159, Size: 40000000, Tags: []string{"dockbox/flask:latest"}},
+		{ID: "sha256:python", Created: 1626100000, Size: 0, Tags: []string{"python:3.8"}},
+		{ID: "<missing>", Created: 1626100000, Size: 110000000},
+	},
+	"sha256:ubuntu": {
+		{ID: "sha256:ubuntu", Created: 1626000000, Size: 0, Tags: []string{"ubuntu:18.04"}},
+		{ID: "<missing>", Created: 1626000000, Size: 63000000},
+	},
+	"sha256:python": {
+		{ID: "sha256:python", Created: 1626100000, Size: 0, Tags: []string{"python:3.8"}},
+		{ID: "<missing>", Created: 1626100000, Size: 110000000},
+	},
+}
+
+func newTreeTestClient() *fakeDockerClient {
+	return &fakeDockerClient{
+		imageList: func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+			return filterImagesByLabel(treeTestImages, ilo), nil
+		},
+		imageInspectWithRaw: func(c context.Context, imageID string) (types.ImageInspect, []byte, error) {
+			for _, image := range treeTestImages {
+				info := types.ImageInspect{ID: image.ID, RepoTags: image.RepoTags, Config: &container.Config{Labels: image.Labels}}
+				if image.ID == imageID {
+					return info, nil, nil
+				}
+				for _, tag := range image.RepoTags {
+					if tag == imageID || tag == imageID+":latest" {
+						return info, nil, nil
+					}
+				}
+			}
+			return types.ImageInspect{}, nil, errors.New("Error: No such image: " + imageID)
+		},
+		imageHistory: func(c context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+			hist, ok := treeTestHistories[imageID]
+			if !ok {
+				return nil, errors.New("Error: No such image: " + imageID)
+			}
+			return hist, nil
+		},
+	}
+}
+
+func TestTreeSuccess(t *testing.T) {
+	testcases := []struct {
+		name         string
+		treeOptions  TreeOptions
+		printOptions ForestPrintOptions
+	}{
+		{name: "TreeDockboxes", treeOptions: TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_NAME}},
+		{name: "TreeAll", treeOptions: TreeOptions{All: true, Format: FORMAT_TREE, Sort: SORT_BY_NAME}},
+		{name: "TreeSortCreated", treeOptions: TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_CREATED}},
+		{name: "TreeSortSize", treeOptions: TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_SIZE, ShowSize: true}},
+		{name: "TreeDepth", treeOptions: TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_NAME, Depth: 2}},
+		// Base images are listed after the dockboxes built on them
+		{name: "TreeAllSize", treeOptions: TreeOptions{All: true, Format: FORMAT_TREE, Sort: SORT_BY_NAME, ShowSize: true}},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			// Output must not depend on the order of map iteration
+			first, err := RunTreeCommand(newTreeTestClient(), test.treeOptions)
+			assert.Nil(t, err)
+			for i := 0; i < 10; i++ {
+				actual, err := RunTreeCommand(newTreeTestClient(), test.treeOptions)
+				assert.Nil(t, err)
+				assert.Equal(t, first, actual)
+			}
+			assert.EqualValues(t, goldenValue(t, "tree/"+test.name, first, *update), first)
+		})
+	}
+}
+
+func TestTreeTarget(t *testing.T) {
+	dirPath := t.TempDir()
+	err := os.Mkdir(filepath.Join(dirPath, HIDDEN_DIRECTORY), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dirPath, HIDDEN_DIRECTORY, ".dockbox.yaml"), []byte("image: dockbox/flask\n"), 0644)
+	assert.Nil(t, err)
+
+	testcases := []struct {
+		name        string
+		treeOptions TreeOptions
+	}{
+		{name: "TreeTarget", treeOptions: TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_NAME, Target: "app1"}},
+		{name: "TreeTargetAncestors", treeOptions: TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_NAME, Target: "app1", Ancestors: true, ShowSize: true}},
+		{name: "TreeTargetDescendants", treeOptions: TreeOptions{All: true, Format: FORMAT_TREE, Sort: SORT_BY_NAME, Target: "app2", Descendants: true}},
+		{name: "TreeTargetPath", treeOptions: TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_NAME, Target: dirPath}},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := RunTreeCommand(newTreeTestClient(), test.treeOptions)
+			assert.Nil(t, err)
+			assert.EqualValues(t, goldenValue(t, "tree/"+test.name, actual, *update), actual)
+		})
+	}
+
+	_, err = RunTreeCommand(newTreeTestClient(), TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_NAME, Target: "missing"})
+	assert.EqualError(t, err, "Error: No such image: dockbox/missing")
+}
+
+func TestGetImageNameFromArg(t *testing.T) {
+	testcases := []struct {
+		arg           string
+		expectedImage string
+	}{
+		{arg: "app1", expectedImage: "dockbox/app1"},
+		{arg: "dockbox/app1", expectedImage: "dockbox/app1"},
+		{arg: "dockbox-demo", expectedImage: "dockbox/dockbox-demo"},
+		{arg: "dockbox", expectedImage: "dockbox/dockbox"},
+	}
+	for _, test := range testcases {
+		t.Run(test.arg, func(t *testing.T) {
+			imageName, err := getImageNameFromArg(test.arg)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedImage, imageName)
+		})
+	}
+	assert.Equal(t, "dockbox-demo:latest", repoTagToDockboxName("dockbox-demo:latest"))
+}
+
+func TestTreeGraph(t *testing.T) {
+	testcases := []struct {
+		name        string
+		treeOptions TreeOptions
+	}{
+		{name: "TreeDot", treeOptions: TreeOptions{Format: FORMAT_DOT, Sort: SORT_BY_NAME}},
+		{name: "TreeMermaid", treeOptions: TreeOptions{Format: FORMAT_MERMAID, Sort: SORT_BY_NAME, ShowSize: true}},
+		{name: "TreeDotTarget", treeOptions: TreeOptions{Format: FORMAT_DOT, Sort: SORT_BY_NAME, Target: "app2"}},
+		{name: "TreeMermaidTarget", treeOptions: TreeOptions{Format: FORMAT_MERMAID, Sort: SORT_BY_NAME, Target: "flask"}},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := RunTreeCommand(newTreeTestClient(), test.treeOptions)
+			assert.Nil(t, err)
+			assert.EqualValues(t, goldenValue(t, "tree/"+test.name, actual, *update), actual)
+		})
+	}
+
+	_, err := RunTreeCommand(newTreeTestClient(), TreeOptions{Format: "svg", Sort: SORT_BY_NAME})
+	assert.EqualError(t, err, `invalid format "svg": must be one of tree, dot or mermaid`)
+}
+
+func TestTreeAge(t *testing.T) {
+	forest, err := buildImageForest(context.Background(), newTreeTestClient(), TreeOptions{})
+	assert.Nil(t, err)
+	actual := forest.ForestString(ForestPrintOptions{showAge: true, now: time.Unix(1626748300, 0).Add(48 * time.Hour)})
+	assert.EqualValues(t, goldenValue(t, "tree/TreeAge", actual, *update), actual)
+}
+
+func TestTreeInvalidSort(t *testing.T) {
+	_, err := RunTreeCommand(newTreeTestClient(), TreeOptions{Format: FORMAT_TREE, Sort: "colour"})
+	assert.EqualError(t, err, `invalid sort order "colour": must be one of name, created or size`)
+}
+
+func TestTreeHistoryCache(t *testing.T) {
+	var calls int32
+	cli := newTreeTestClient()
+	imageHistory := cli.imageHistory
+	cli.imageHistory = func(c context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+		atomic.AddInt32(&calls, 1)
+		return imageHistory(c, imageID)
+	}
+	treeOptions := TreeOptions{Format: FORMAT_TREE, Sort: SORT_BY_NAME, Jobs: 1, CacheHistory: true, CacheDir: t.TempDir()}
+
+	// The history of app1 includes ubuntu, so only the dockboxes are looked up
+	first, err := RunTreeCommand(cli, TreeOptions{All: true, Format: FORMAT_TREE, Sort: SORT_BY_NAME, Jobs: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), calls)
+	assert.EqualValues(t, goldenValue(t, "tree/TreeAll", first, false), first)
+
+	calls = 0
+	actual, err := RunTreeCommand(cli, treeOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), calls)
+	assert.EqualValues(t, goldenValue(t, "tree/TreeDockboxes", actual, false), actual)
+
+	calls = 0
+	actual, err = RunTreeCommand(cli, treeOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), calls)
+	assert.EqualValues(t, goldenValue(t, "tree/TreeDockboxes", actual, false), actual)
+}
+
+func TestTreeHistoryError(t *testing.T) {
+	cli := newTreeTestClient()
+	cli.imageHistory = func(c context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+		if imageID == "sha256:app2" {
+			return nil, errors.New("Error: No such image: " + imageID)
+		}
+		<-c.Done()
+		return nil, c.Err()
+	}
+	_, err := buildImageForest(context.Background(), cli, TreeOptions{Jobs: 4})
+	assert.EqualError(t, err, "Error: No such image: sha256:app2")
+}
+
+// newBenchmarkTreeClient returns a client with the given number of dockboxes,
+// in groups built on the same setup layers, and a simulated daemon latency
+func newBenchmarkTreeClient(dockboxes int, latency time.Duration) *fakeDockerClient {
+	images := make([]types.ImageSummary, 0, dockboxes)
+	histories := make(map[string][]image.HistoryResponseItem, dockboxes)
+	base := []image.HistoryResponseItem{
+		{ID: "sha256:ubuntu", Created: 1626000000, Tags: []string{"ubuntu:18.04"}},
+		{ID: "<missing>", Created: 1626000000, Size: 63000000},
+	}
+	for i := 0; i < dockboxes; i++ {
+		id := fmt.Sprintf("sha256:app%d", i)
+		tag := fmt.Sprintf("dockbox/app%d:latest", i)
+		images = append(images, types.ImageSummary{ID: id, RepoTags: []string{tag}, Created: int64(i), Labels: map[string]string{LABEL_SOURCE: tag}})
+		setup := image.HistoryResponseItem{ID: fmt.Sprintf("sha256:setup%d", i%10), Created: 1626000100}
+		histories[id] = append([]image.HistoryResponseItem{{ID: id, Created: 1626000200, Tags: []string{tag}}, setup}, base...)
+	}
+	return &fakeDockerClient{
+		imageList: func(c context.Context, ilo types.ImageListOptions) ([]types.ImageSummary, error) {
+			return filterImagesByLabel(images, ilo), nil
+		},
+		imageHistory: func(c context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+			time.Sleep(latency)
+			return histories[imageID], nil
+		},
+	}
+}
+
+func BenchmarkBuildImageForest(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cli := newBenchmarkTreeClient(200, time.Millisecond)
+	for _, jobs := range []int{1, DEFAULT_HISTORY_JOBS} {
+		b.Run(fmt.Sprintf("Jobs%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := buildImageForest(context.Background(), cli, TreeOptions{Jobs: jobs}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("Cached", func(b *testing.B) {
+		treeOptions := TreeOptions{Jobs: DEFAULT_HISTORY_JOBS, CacheHistory: true, CacheDir: b.TempDir()}
+		for i := 0; i < b.N; i++ {
+			if _, err := buildImageForest(context.Background(), cli, treeOptions); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
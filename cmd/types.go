@@ -3,12 +3,15 @@ package cmd
 import (
 	"context"
 	"io"
+	"net"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -18,48 +21,281 @@ type dockerClient interface {
 	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
 	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
 	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error)
 	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error)
 
+	VolumeCreate(ctx context.Context, options volume.VolumeCreateBody) (types.Volume, error)
+	VolumeList(ctx context.Context, filter filters.Args) (volume.VolumeListOKBody, error)
+	VolumeRemove(ctx context.Context, volumeID string, force bool) error
+	NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	NetworkRemove(ctx context.Context, networkID string) error
+	BuildCachePrune(ctx context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error)
+
 	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
 	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
 	ImageHistory(ctx context.Context, imageID string) ([]image.HistoryResponseItem, error)
 	ImageRemove(ctx context.Context, imageID string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+	ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error)
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error)
+	ImageTag(ctx context.Context, source, target string) error
+	ImagePush(ctx context.Context, image string, options types.ImagePushOptions) (io.ReadCloser, error)
+	ImagePull(ctx context.Context, refStr string, options types.ImagePullOptions) (io.ReadCloser, error)
 	ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error)
+
+	DialHijack(ctx context.Context, url, proto string, meta map[string][]string) (net.Conn, error)
 }
 
 type Image struct {
-	Image      string
+	Image string
+	// Commands run on Image, which Packages replace when it is combined with
+	// the image of another language
 	Commands   []string
 	EntryPoint string
+	// Directories of the toolchain, copied from Image when it is combined with
+	// the image of another language
+	Toolchain []string
+	// Environment of the toolchain when it is combined with another language
+	Env []string
+	// Debian packages installed when the toolchain is combined with another language
+	Packages []string
+	// Commands completing the installation of Packages
+	PackageCommands []string
+	// Alternative steps installing the dependencies of the repository, of
+	// which only the first whose files exist is run
+	Setup []SetupStep
+}
+
+// SetupStep is a command installing dependencies, run if one of Files exists
+// at the root of the repository
+type SetupStep struct {
+	Files   []string
+	Command string
+}
+
+// projectManifest is the dockbox.yaml a repository can ship to describe its dockbox
+type projectManifest struct {
+	Image     string            `yaml:"image"`
+	Setup     []string          `yaml:"setup"`
+	Entry     string            `yaml:"entry"`
+	Ports     []string          `yaml:"ports"`
+	Env       map[string]string `yaml:"env"`
+	Mounts    []string          `yaml:"mounts"`
+	Resources manifestResources `yaml:"resources"`
+	User      string            `yaml:"user"`
+
+	// Set for manifests translated from a devcontainer.json
+	source     string
+	dockerfile string
+	buildArgs  map[string]string
+}
+
+type manifestResources struct {
+	CPUs   float64 `yaml:"cpus"`
+	Memory string  `yaml:"memory"`
+}
+
+// devcontainerConfig holds the parts of a devcontainer.json dockbox understands
+type devcontainerConfig struct {
+	Image      string            `json:"image"`
+	Build      devcontainerBuild `json:"build"`
+	DockerFile string            `json:"dockerFile"`
+	Context    string            `json:"context"`
+	// Lifecycle commands can be a string, an array of arguments or an object of commands
+	OnCreateCommand      interface{}       `json:"onCreateCommand"`
+	UpdateContentCommand interface{}       `json:"updateContentCommand"`
+	PostCreateCommand    interface{}       `json:"postCreateCommand"`
+	ForwardPorts         []interface{}     `json:"forwardPorts"`
+	ContainerEnv         map[string]string `json:"containerEnv"`
+	RemoteUser           string            `json:"remoteUser"`
+	ContainerUser        string            `json:"containerUser"`
+	Mounts               []interface{}     `json:"mounts"`
+	DockerComposeFile    interface{}       `json:"dockerComposeFile"`
+}
+
+type devcontainerBuild struct {
+	Dockerfile string            `json:"dockerfile"`
+	Context    string            `json:"context"`
+	Args       map[string]string `json:"args"`
+	Target     string            `json:"target"`
 }
 
 type CleanOptions struct {
-	confirmBefore bool
-	keepFolder    bool
-	isImage       bool
+	confirmBefore   bool
+	keepFolder      bool
+	isImage         bool
+	all             bool
+	olderThan       string
+	unused          string
+	keepBase        bool
+	force           bool
+	pruneBuildCache bool
+	trash           TrashOptions
+	useTrash        bool
+	yes             bool
+	history         TreeOptions
+	now             time.Time
 
-	dockboxName string
+	args []string
+}
+
+type keptImage struct {
+	node   *ImageNode
+	reason string
+}
+
+type cleanFolder struct {
+	path         string
+	metadataOnly bool
+}
+
+type cleanPlan struct {
+	dockboxes       []*ImageNode
+	targetIDs       map[string]bool
+	images          []*ImageNode
+	kept            []keptImage
+	containers      []string
+	volumes         []string
+	networks        []string
+	folders         []cleanFolder
+	dirPaths        map[string]string
+	pruneBuildCache bool
+	trashDir        string
+}
+
+type TrashOptions struct {
+	dir       string
+	retention string
+	now       time.Time
+
+	names []string
+}
+
+// trashEntry is the metadata saved along with the image of a dockbox in the trash
+type trashEntry struct {
+	Name      string    `json:"name"`
+	Image     string    `json:"image"`
+	RepoTags  []string  `json:"repoTags"`
+	Source    string    `json:"source,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Metadata holds the files of the .dockbox directory of the dockbox, by name
+	Metadata map[string][]byte `json:"metadata,omitempty"`
+}
+
+type BuildOptions struct {
+	buildArgs []string
+	target    string
+	platform  string
+	buildKit  bool
+	secrets   []string
 }
 
 type CreateOptions struct {
 	source      string
 	destPath    string
 	dockerFile  string
+	service     string
 	remove      bool
 	dockboxName string
+	build       BuildOptions
+}
+
+type RebuildOptions struct {
+	path  string
+	build BuildOptions
 }
 
 type EnterOptions struct {
 	path string
 	// dockboxName string
-	containerID string
+	containerID  string
+	platform     string
+	fromSnapshot string
+}
+
+type SnapshotOptions struct {
+	path string
+	tag  string
+	now  time.Time
+}
+type ExportOptions struct {
+	arg           string
+	output        string
+	includeSource bool
+}
+
+type ImportOptions struct {
+	bundle   string
+	destPath string
+}
+
+// bundleManifest describes the dockbox held by a bundle created with dockbox export
+type bundleManifest struct {
+	Version       int    `json:"version"`
+	Name          string `json:"name"`
+	Image         string `json:"image"`
+	ImageID       string `json:"imageID"`
+	Source        string `json:"source,omitempty"`
+	Dockerfile    string `json:"dockerfile,omitempty"`
+	Language      string `json:"language,omitempty"`
+	Platform      string `json:"platform,omitempty"`
+	IncludeSource bool   `json:"includeSource"`
+}
+
+type PushOptions struct {
+	arg       string
+	ref       string
+	configDir string
 }
+
+type PullOptions struct {
+	ref         string
+	destPath    string
+	dockboxName string
+	configDir   string
+}
+
 type ListOptions struct {
 	paths []string
 }
 
 type TreeOptions struct {
-	All bool
+	All         bool
+	Sort        string
+	ShowSize    bool
+	ShowAge     bool
+	Depth       int
+	Target      string
+	Ancestors   bool
+	Descendants bool
+	Format      string
+
+	Jobs         int
+	CacheHistory bool
+	CacheDir     string
+}
+
+type DuOptions struct {
+	Format  string
+	history TreeOptions
+}
+
+type DockboxDiskUsage struct {
+	Name        string `json:"name"`
+	Image       string `json:"image"`
+	Unique      int64  `json:"unique"`
+	Shared      int64  `json:"shared"`
+	Containers  int64  `json:"containers"`
+	Reclaimable int64  `json:"reclaimable"`
+}
+
+type DiskUsageReport struct {
+	Dockboxes   []DockboxDiskUsage `json:"dockboxes"`
+	Reclaimable int64              `json:"reclaimable"`
 }
 
 type ImageNode struct {
@@ -67,6 +303,8 @@ type ImageNode struct {
 	parent   *ImageNode
 	name     string
 	ID       string
+	created  int64
+	size     int64
 }
 
 type ImageForest struct {
@@ -80,4 +318,10 @@ type ForestPrintOptions struct {
 	colorIDS             map[string]string
 	textColorCurNodeOnly bool
 	branchColor          string
+	sortBy               string
+	showSize             bool
+	showAge              bool
+	maxDepth             int
+	now                  time.Time
+	visibleIDs           map[string]bool
 }
@@ -1,13 +1,13 @@
 package cmd
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 
 	"io"
 	"log"
+	"os"
 	"runtime"
 	"strings"
 	"sync"
@@ -16,8 +16,11 @@ import (
 	"github.com/docker/cli/cli/streams"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/stdcopy"
+	controlapi "github.com/moby/buildkit/api/services/control"
 	"github.com/moby/term"
+	digest "github.com/opencontainers/go-digest"
 )
 
 func GetUserBoolean(prompt string, a ...interface{}) (bool, error) {
@@ -50,53 +53,235 @@ func GetUserString(prompt string, a ...interface{}) (string, error) {
 	return input, nil
 }
 
-func printStatus(result map[string]interface{}) {
-	if result["id"] == nil {
-		result["id"] = ""
+// GetUserChoice lists the numbered options and asks prompt until accept takes
+// the answer. Without an answer, such as when not run interactively, the first
+// option is chosen.
+func GetUserChoice(options []string, prompt string, accept func(choice string) error) {
+	for i, option := range options {
+		fmt.Printf("  %d) %s\n", i+1, option)
 	}
-	if result["progress"] == nil {
-		result["progress"] = ""
+	for {
+		choice, err := GetUserString(prompt)
+		if err != nil {
+			log.Printf("No answer given, choosing %s", options[0])
+			choice = "1"
+		}
+		if err := accept(choice); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return
 	}
-	fmt.Printf("%s %s %s", result["status"], result["id"], result["progress"])
 }
 
-func printImageBuildOutput(scanner *bufio.Scanner) {
-	curLine := 0
-	lastLine := 0
-	IDToLine := make(map[string]int)
-	for scanner.Scan() {
-		jsonText := scanner.Text()
-		// fmt.Println(jsonText)
-		var result map[string]interface{}
-		json.Unmarshal([]byte(jsonText), &result)
-		// log.Print(jsonText)
-		if val, ok := result["stream"]; ok {
-			fmt.Print(val.(string))
+// printTransferProgress displays the progress of an image push or pull, returning
+// the error reported by the daemon if the transfer failed
+func printTransferProgress(body io.Reader) error {
+	out := streams.NewOut(os.Stdout)
+	return jsonmessage.DisplayJSONMessagesStream(body, out, out.FD(), out.IsTerminal(), nil)
+}
+
+func printStatus(message jsonmessage.JSONMessage) {
+	fmt.Printf("%s %s %s", message.Status, message.ID, message.ProgressMessage)
+}
+
+// Number of build output lines kept to give context when a build fails
+const buildLogTailLength = 10
+
+// buildError is returned when the Docker daemon reports a failure while
+// building a dockbox image.
+type buildError struct {
+	step    string
+	message string
+	logTail []string
+}
+
+func (e *buildError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("failed to build dockbox")
+	if e.step != "" {
+		sb.WriteString(fmt.Sprintf(" at %s", e.step))
+	}
+	sb.WriteString(fmt.Sprintf(": %s", e.message))
+	if len(e.logTail) > 0 {
+		sb.WriteString("\n\nLast lines of build output:\n")
+		sb.WriteString(strings.Join(e.logTail, "\n"))
+	}
+	return sb.String()
+}
+
+// instruction returns the Dockerfile instruction of the step that failed, without
+// the "Step 4/5 : " prefix of the legacy builder or the "[4/5] " one of BuildKit
+func (e *buildError) instruction() string {
+	if strings.HasPrefix(e.step, "Step ") {
+		if i := strings.Index(e.step, " : "); i >= 0 {
+			return e.step[i+len(" : "):]
+		}
+	}
+	if strings.HasPrefix(e.step, "[") {
+		if i := strings.Index(e.step, "] "); i >= 0 {
+			return e.step[i+len("] "):]
+		}
+	}
+	return e.step
+}
+
+// buildOutput keeps track of what has been printed so far while decoding
+// the message stream returned by ImageBuild.
+type buildOutput struct {
+	step    string
+	logTail []string
+
+	// Legacy builder status lines
+	curLine  int
+	lastLine int
+	IDToLine map[string]int
+
+	// BuildKit vertices, numbered in the order they were first seen
+	vertexToNumber map[digest.Digest]int
+	vertexStarted  map[digest.Digest]bool
+	vertexDone     map[digest.Digest]bool
+}
+
+func (b *buildOutput) addLogLines(text string, prefix string) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
 			continue
 		}
+		if len(b.logTail) == buildLogTailLength {
+			b.logTail = b.logTail[1:]
+		}
+		b.logTail = append(b.logTail, line)
+		if prefix != "" {
+			fmt.Printf("%s %s\n", prefix, line)
+		}
+	}
+}
+
+func (b *buildOutput) printStream(text string) {
+	fmt.Print(text)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "Step ") {
+			b.step = line
+		}
+	}
+	b.addLogLines(text, "")
+}
 
-		if _, ok := result["status"]; ok {
-			if _, ok2 := result["id"]; !ok2 {
-				fmt.Println(result["status"])
-				continue
+func (b *buildOutput) printStatus(message jsonmessage.JSONMessage) {
+	if message.ID == "" {
+		fmt.Println(message.Status)
+		return
+	}
+	ID := message.ID
+	if _, ok := b.IDToLine[ID]; !ok {
+		b.IDToLine[ID] = b.lastLine
+		b.lastLine++
+	}
+	if b.curLine < b.IDToLine[ID] {
+		// Move up
+		fmt.Printf("%c[%dA", 27, b.IDToLine[ID]-b.curLine)
+
+	} else if b.curLine > b.IDToLine[ID] {
+		// Move down
+		fmt.Printf("%c[%dB", 27, b.curLine-b.IDToLine[ID])
+	}
+	b.curLine = b.IDToLine[ID]
+	fmt.Printf("%c[2K\r", 27)
+	printStatus(message)
+}
+
+// printBuildKitTrace prints the vertices and logs contained in a
+// moby.buildkit.trace aux message in a format similar to `docker build --progress=plain`
+func (b *buildOutput) printBuildKitTrace(aux *json.RawMessage) error {
+	var data []byte
+	if err := json.Unmarshal(*aux, &data); err != nil {
+		return err
+	}
+	var status controlapi.StatusResponse
+	if err := status.Unmarshal(data); err != nil {
+		return err
+	}
+
+	for _, vertex := range status.Vertexes {
+		number, ok := b.vertexToNumber[vertex.Digest]
+		if !ok {
+			number = len(b.vertexToNumber) + 1
+			b.vertexToNumber[vertex.Digest] = number
+		}
+		if vertex.Started != nil && !b.vertexStarted[vertex.Digest] {
+			b.vertexStarted[vertex.Digest] = true
+			b.step = vertex.Name
+			fmt.Printf("#%d %s\n", number, vertex.Name)
+		}
+		if vertex.Error != "" {
+			b.step = vertex.Name
+			fmt.Printf("#%d ERROR: %s\n", number, vertex.Error)
+			continue
+		}
+		if vertex.Completed != nil && !b.vertexDone[vertex.Digest] {
+			b.vertexDone[vertex.Digest] = true
+			if vertex.Cached {
+				fmt.Printf("#%d CACHED\n", number)
+			} else if vertex.Started != nil {
+				fmt.Printf("#%d DONE %.1fs\n", number, vertex.Completed.Sub(*vertex.Started).Seconds())
 			}
-			ID := result["id"].(string)
-			if _, ok := IDToLine[ID]; !ok {
-				IDToLine[ID] = lastLine
-				lastLine++
+		}
+	}
+
+	for _, vertexLog := range status.Logs {
+		number, ok := b.vertexToNumber[vertexLog.Vertex]
+		if !ok {
+			number = len(b.vertexToNumber) + 1
+			b.vertexToNumber[vertexLog.Vertex] = number
+		}
+		b.addLogLines(string(vertexLog.Msg), fmt.Sprintf("#%d", number))
+	}
+	return nil
+}
+
+// printImageBuildOutput decodes the JSON message stream of an image build,
+// printing progress as it arrives. Both legacy builder and BuildKit streams are
+// supported. An error is returned if the daemon reports that the build failed.
+func printImageBuildOutput(body io.Reader) error {
+	output := &buildOutput{
+		logTail:        make([]string, 0, buildLogTailLength),
+		IDToLine:       make(map[string]int),
+		vertexToNumber: make(map[digest.Digest]int),
+		vertexStarted:  make(map[digest.Digest]bool),
+		vertexDone:     make(map[digest.Digest]bool),
+	}
+	decoder := json.NewDecoder(body)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
 			}
-			if curLine < IDToLine[ID] {
-				// Move up
-				fmt.Printf("%c[%dA", 27, IDToLine[ID]-curLine)
+			return err
+		}
+
+		if message.Error != nil {
+			return &buildError{step: output.step, message: message.Error.Message, logTail: output.logTail}
+		}
 
-			} else if curLine > IDToLine[ID] {
-				// Move down
-				fmt.Printf("%c[%dB", 27, curLine-IDToLine[ID])
+		if message.Aux != nil {
+			if message.ID == "moby.buildkit.trace" {
+				if err := output.printBuildKitTrace(message.Aux); err != nil {
+					log.Printf("Unable to decode BuildKit trace: %s", err)
+				}
 			}
-			curLine = IDToLine[ID]
-			fmt.Printf("%c[2K\r", 27)
-			printStatus(result)
+			continue
+		}
+
+		if message.Stream != "" {
+			output.printStream(message.Stream)
+			continue
+		}
 
+		if message.Status != "" {
+			output.printStatus(message)
 		}
 	}
 }
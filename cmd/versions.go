@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Official images of the languages whose version a repository can declare,
+// tagged with that version
+var versionedImages = map[string]string{
+	"python":     "python:%s-slim",
+	"javascript": "node:%s",
+	"go":         "golang:%s",
+	"ruby":       "ruby:%s",
+	"java":       "eclipse-temurin:%s",
+	"rust":       "rust:%s",
+}
+
+// Nix environments a repository can declare, in order of preference
+var nixEnvironments = []struct {
+	file  string
+	image Image
+}{
+	{"flake.nix", Image{
+		Image:      "nixos/nix",
+		Commands:   []string{"nix --extra-experimental-features 'nix-command flakes' develop --command true"},
+		EntryPoint: "nix --extra-experimental-features 'nix-command flakes' develop",
+	}},
+	{"shell.nix", Image{Image: "nixos/nix", Commands: []string{"nix-shell --run true"}, EntryPoint: "nix-shell"}},
+	{"default.nix", Image{Image: "nixos/nix", Commands: []string{"nix-shell --run true"}, EntryPoint: "nix-shell"}},
+}
+
+var versionTagPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+var versionNumberPattern = regexp.MustCompile(`[0-9]+(\.[0-9]+){0,2}`)
+var goDirectivePattern = regexp.MustCompile(`(?m)^go\s+([0-9.]+)\s*$`)
+var rustChannelPattern = regexp.MustCompile(`(?m)^\s*channel\s*=\s*"([^"]+)"`)
+var pomJavaVersionPattern = regexp.MustCompile(`<(maven\.compiler\.release|release|java\.version|maven\.compiler\.source|maven\.compiler\.target)>\s*([0-9.]+)\s*</`)
+
+// detectLanguageVersion returns the version of language declared by the
+// repository at dirPath and the file declaring it, or empty strings if it
+// does not declare one
+func detectLanguageVersion(dirPath string, language string) (string, string) {
+	readFile := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dirPath, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	firstLine := func(name string) string {
+		scanner := bufio.NewScanner(strings.NewReader(readFile(name)))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				return line
+			}
+		}
+		return ""
+	}
+
+	switch language {
+	case "python":
+		if version := firstLine(".python-version"); version != "" {
+			return version, ".python-version"
+		}
+	case "javascript":
+		if version := firstLine(".nvmrc"); version != "" {
+			return strings.TrimPrefix(version, "v"), ".nvmrc"
+		}
+		var packageJSON struct {
+			Engines struct {
+				Node string `json:"node"`
+			} `json:"engines"`
+		}
+		if err := json.Unmarshal([]byte(readFile("package.json")), &packageJSON); err == nil && packageJSON.Engines.Node != "" {
+			// Ranges such as >=16 or ^18.12.0 are satisfied by the latest release of their first major version
+			if version := versionNumberPattern.FindString(packageJSON.Engines.Node); version != "" {
+				return strings.Split(version, ".")[0], "package.json"
+			}
+		}
+	case "go":
+		if match := goDirectivePattern.FindStringSubmatch(readFile("go.mod")); match != nil {
+			return match[1], "go.mod"
+		}
+	case "ruby":
+		if version := firstLine(".ruby-version"); version != "" {
+			return strings.TrimPrefix(version, "ruby-"), ".ruby-version"
+		}
+	case "java":
+		if version := firstLine(".java-version"); version != "" {
+			return javaMajorVersion(version), ".java-version"
+		}
+		if match := pomJavaVersionPattern.FindStringSubmatch(readFile("pom.xml")); match != nil {
+			return javaMajorVersion(match[2]), "pom.xml"
+		}
+	case "rust":
+		for _, name := range []string{"rust-toolchain.toml", "rust-toolchain"} {
+			content := readFile(name)
+			if match := rustChannelPattern.FindStringSubmatch(content); match != nil {
+				return match[1], name
+			}
+			// The legacy rust-toolchain file can hold the channel alone
+			if version := firstLine(name); version != "" && !strings.Contains(content, "[") {
+				return version, name
+			}
+		}
+	}
+	return "", ""
+}
+
+// javaMajorVersion returns the major version of Java, which is the minor
+// version of releases up to Java 8, such as 1.8
+func javaMajorVersion(version string) string {
+	if strings.HasPrefix(version, "1.") {
+		version = strings.TrimPrefix(version, "1.")
+	}
+	return strings.Split(version, ".")[0]
+}
+
+// languageImage returns the image to generate the Dockerfile of the repository
+// at dirPath from for language, tagged with the version the repository
+// declares, and describes the choice to the user
+func languageImage(dirPath string, language string) Image {
+	image, ok := LanguageToImageMapper[language]
+	if !ok {
+		image = LanguageToImageMapper["unknown"]
+	}
+	version, source := detectLanguageVersion(dirPath, language)
+	if version != "" && !versionTagPattern.MatchString(version) {
+		log.Printf("Warning: Ignoring version %q of %s declared in %s, it has no matching image", version, language, source)
+		version = ""
+	}
+	if version == "" {
+		fmt.Printf("Using image %s for %s\n", image.Image, language)
+		return image
+	}
+	image.Image = fmt.Sprintf(versionedImages[language], version)
+	fmt.Printf("Using image %s for %s %s (from %s)\n", image.Image, language, version, source)
+	return image
+}
+
+// languageImages returns the images to generate the Dockerfile of the repository
+// at dirPath from for languages, the first of which it builds on. The others
+// are copied from the image of the version the repository declares, unless
+// they are installed from the packages of the first image, of its version.
+func languageImages(dirPath string, languages []string) []Image {
+	images := make([]Image, len(languages))
+	for i, language := range languages {
+		image, ok := LanguageToImageMapper[language]
+		if i == 0 || !ok || len(image.Toolchain) > 0 {
+			images[i] = languageImage(dirPath, language)
+			continue
+		}
+		if version, source := detectLanguageVersion(dirPath, language); version != "" {
+			log.Printf("Warning: Ignoring version %s of %s declared in %s, it is installed from the packages of %s", version, language, source, images[0].Image)
+		}
+		fmt.Printf("Installing %s from the packages of %s\n", language, images[0].Image)
+		images[i] = image
+	}
+	return images
+}
+
+// detectNixEnvironment returns the Nix environment declared by the repository
+// at dirPath and the file declaring it, or an empty file name if it does not
+// declare one
+func detectNixEnvironment(dirPath string) (Image, string) {
+	for _, environment := range nixEnvironments {
+		if _, err := os.Stat(filepath.Join(dirPath, environment.file)); err == nil {
+			return environment.image, environment.file
+		}
+	}
+	return Image{}, ""
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLanguageImage(t *testing.T) {
+	testcases := []struct {
+		name          string
+		language      string
+		files         map[string]string
+		expectedImage string
+	}{
+		{
+			name:          "Default",
+			language:      "python",
+			expectedImage: "python:3.8-slim-buster",
+		},
+		{
+			name:          "PythonVersion",
+			language:      "python",
+			files:         map[string]string{".python-version": "# pyenv\n3.9.7\n3.8.12\n"},
+			expectedImage: "python:3.9.7-slim",
+		},
+		{
+			name:          "Nvmrc",
+			language:      "javascript",
+			files:         map[string]string{".nvmrc": "v18.12.1\n", "package.json": `{"engines": {"node": ">=14"}}`},
+			expectedImage: "node:18.12.1",
+		},
+		{
+			name:          "PackageJSONEngines",
+			language:      "javascript",
+			files:         map[string]string{"package.json": `{"engines": {"node": "^16.13.0 || >=18"}}`},
+			expectedImage: "node:16",
+		},
+		{
+			name:          "GoMod",
+			language:      "go",
+			files:         map[string]string{"go.mod": "module example.com/app\n\ngo 1.21\n\nrequire example.com/lib v1.0.0\n"},
+			expectedImage: "golang:1.21",
+		},
+		{
+			name:          "RubyVersion",
+			language:      "ruby",
+			files:         map[string]string{".ruby-version": "ruby-3.2.2\n"},
+			expectedImage: "ruby:3.2.2",
+		},
+		{
+			name:          "JavaVersion",
+			language:      "java",
+			files:         map[string]string{".java-version": "1.8\n"},
+			expectedImage: "eclipse-temurin:8",
+		},
+		{
+			name:          "PomRelease",
+			language:      "java",
+			files:         map[string]string{"pom.xml": "<project>\n  <properties>\n    <maven.compiler.release>17</maven.compiler.release>\n  </properties>\n</project>\n"},
+			expectedImage: "eclipse-temurin:17",
+		},
+		{
+			name:          "RustToolchain",
+			language:      "rust",
+			files:         map[string]string{"rust-toolchain.toml": "[toolchain]\nchannel = \"1.70.0\"\ncomponents = [\"clippy\"]\n"},
+			expectedImage: "rust:1.70.0",
+		},
+		{
+			name:          "LegacyRustToolchain",
+			language:      "rust",
+			files:         map[string]string{"rust-toolchain": "1.65\n"},
+			expectedImage: "rust:1.65",
+		},
+		{
+			name:          "UnsupportedVersion",
+			language:      "rust",
+			files:         map[string]string{"rust-toolchain.toml": "[toolchain]\nchannel = \"nightly-2023-01-01\"\n"},
+			expectedImage: "rust:1.53",
+		},
+		{
+			name:          "UnknownLanguage",
+			language:      "unknown",
+			files:         map[string]string{".python-version": "3.9\n"},
+			expectedImage: "ubuntu:18.04",
+		},
+	}
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := t.TempDir()
+			for name, content := range test.files {
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, name), []byte(content), 0644))
+			}
+			assert.Equal(t, test.expectedImage, languageImage(dirPath, test.language).Image)
+		})
+	}
+}
+
+func TestLanguageImages(t *testing.T) {
+	dirPath := t.TempDir()
+	files := map[string]string{".nvmrc": "18.12.1\n", "go.mod": "module app\n\ngo 1.21\n", ".python-version": "3.9.7\n"}
+	for name, content := range files {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, name), []byte(content), 0644))
+	}
+
+	// Only python is installed from the packages of the first image, whatever its version
+	images := languageImages(dirPath, []string{"javascript", "go", "python"})
+	assert.Equal(t, "node:18.12.1", images[0].Image)
+	assert.Equal(t, "golang:1.21", images[1].Image)
+	assert.Equal(t, LanguageToImageMapper["python"].Image, images[2].Image)
+	assert.Equal(t, LanguageToImageMapper["python"].Packages, images[2].Packages)
+}
+
+func TestDetectNixEnvironment(t *testing.T) {
+	dirPath := t.TempDir()
+	_, nixFile := detectNixEnvironment(dirPath)
+	assert.Equal(t, "", nixFile)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, "shell.nix"), []byte("{ pkgs ? import <nixpkgs> {} }: pkgs.mkShell {}\n"), 0644))
+	image, nixFile := detectNixEnvironment(dirPath)
+	assert.Equal(t, "shell.nix", nixFile)
+	assert.Equal(t, "nixos/nix", image.Image)
+	assert.Equal(t, "nix-shell", image.EntryPoint)
+
+	// Flakes take precedence over shell.nix
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirPath, "flake.nix"), []byte("{ outputs = { self }: {}; }\n"), 0644))
+	_, nixFile = detectNixEnvironment(dirPath)
+	assert.Equal(t, "flake.nix", nixFile)
+}
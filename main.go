@@ -19,6 +19,10 @@ import (
 	"github.com/dockboxhq/cli/cmd"
 )
 
+// Set by goreleaser at build time
+var version = "dev"
+
 func main() {
+	cmd.Version = version
 	cmd.Execute()
 }